@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/wk8/kraken-proxy/pkg"
+)
+
+// checkCommand validates the config, and exits with a non-zero status if it's not valid; meant for CI.
+// It lists the registries, along with the file each comes from when using includes.
+type checkCommand struct{}
+
+func (c *checkCommand) Execute([]string) error {
+	config, err := pkg.NewConfig(opts.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		if configErrors, ok := err.(pkg.ConfigErrors); ok {
+			for _, configErr := range configErrors {
+				fmt.Fprintf(os.Stderr, "  * %v\n", configErr)
+			}
+		}
+		return errors.Errorf("%q is not valid", opts.ConfigPath)
+	}
+
+	fmt.Printf("%q is valid, registries:\n", opts.ConfigPath)
+	for _, registry := range config.Registries {
+		source := registry.Source()
+		if source == "" {
+			source = opts.ConfigPath
+		}
+		fmt.Printf("  * %s, with %d redirect(s), from %q\n", registry.Address, len(registry.Redirects), source)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/wk8/kraken-proxy/pkg"
+)
+
+// clientConfigCommand prints what a node's container runtime needs to pull images through the proxy.
+type clientConfigCommand struct {
+	Runtime  string   `long:"runtime" choice:"dockerd" choice:"containerd" choice:"cri-o" default:"dockerd" description:"The container runtime to generate the config for"`
+	ProxyURL string   `long:"proxy-url" description:"How clients reach the proxy, defaults to the listen address, with the hostname if it doesn't specify a host"`
+	NoProxy  []string `long:"no-proxy" description:"Additional NO_PROXY entries, can be repeated"`
+}
+
+func (c *clientConfigCommand) Execute([]string) error {
+	config, err := pkg.NewConfig(opts.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	clientConfig, err := pkg.NewClientConfig(config, pkg.ContainerRuntime(c.Runtime), c.ProxyURL, c.NoProxy...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(clientConfig)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/wk8/kraken-proxy/pkg"
+)
+
+// convertCommand prints the registries derived from Docker's and containerd's mirror configs, as YAML that
+// can be used as an included file, or pasted into the config.
+type convertCommand struct {
+	DockerDaemon    string `long:"docker-daemon" description:"Path to a Docker daemon.json file"`
+	ContainerdHosts string `long:"containerd-hosts" description:"Path to a containerd registry config directory, e.g. /etc/containerd/certs.d"`
+}
+
+func (c *convertCommand) Execute([]string) error {
+	if c.DockerDaemon == "" && c.ContainerdHosts == "" {
+		return errors.New("at least one of --docker-daemon and --containerd-hosts is required")
+	}
+
+	var registries []pkg.Registry
+	if c.DockerDaemon != "" {
+		imported, err := pkg.ImportDockerDaemonConfig(c.DockerDaemon)
+		if err != nil {
+			return err
+		}
+		registries = append(registries, imported...)
+	}
+	if c.ContainerdHosts != "" {
+		imported, err := pkg.ImportContainerdHosts(c.ContainerdHosts)
+		if err != nil {
+			return err
+		}
+		registries = append(registries, imported...)
+	}
+
+	sources := make(map[string]string, len(registries))
+	for i := range registries {
+		registry := &registries[i]
+		if source, present := sources[registry.Address]; present {
+			log.Warnf("%s is defined in both %q and %q, its redirects need to be merged by hand", registry.Address, source, registry.Source())
+		}
+		sources[registry.Address] = registry.Source()
+	}
+
+	bytes, err := pkg.MarshalRegistries(registries)
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize registries")
+	}
+	_, err = os.Stdout.Write(bytes)
+	return err
+}
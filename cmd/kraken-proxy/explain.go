@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/wk8/kraken-proxy/pkg"
+)
+
+// explainCommand describes how pulls of an image get routed with the config, to troubleshoot pulls.
+type explainCommand struct {
+	Probe bool `long:"probe" description:"Send a HEAD request for the image's manifest to each registry that would be tried"`
+	JSON  bool `long:"json" description:"Print the explanation as JSON"`
+
+	Args struct {
+		Image string `positional-arg-name:"image-ref" description:"e.g. ubuntu:20.04, or quay.io/org/repo@sha256:..."`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *explainCommand) Execute([]string) error {
+	config, err := pkg.NewConfig(opts.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	hijacker, err := pkg.NewDockerRegistryHijacker(config)
+	if err != nil {
+		return err
+	}
+
+	explanation, err := hijacker.Explain(context.Background(), c.Args.Image, c.Probe)
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(explanation)
+	}
+	fmt.Print(explanation)
+	return nil
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/wk8/kraken-proxy/version"
 
@@ -11,6 +16,8 @@ import (
 	"github.com/wk8/kraken-proxy/pkg"
 )
 
+const defaultShutdownGracePeriod = 30 * time.Second
+
 var opts struct {
 	LogLevel   string `long:"log-level" env:"LOG_LEVEL" description:"Log level" default:"info"`
 	ConfigPath string `long:"config" env:"CONFIG" description:"Path to config" default:"config.yml"`
@@ -18,7 +25,9 @@ var opts struct {
 }
 
 func main() {
-	parseArgs()
+	if commandRan := parseArgs(); commandRan {
+		return
+	}
 
 	if opts.Version {
 		fmt.Println("Version:", version.VERSION)
@@ -29,6 +38,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("unable to parse config %q: %v", opts.ConfigPath, err)
 	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("invalid config %q: %v", opts.ConfigPath, err)
+	}
 
 	initLogging(config.LogLevel)
 
@@ -37,28 +49,226 @@ func main() {
 		log.Fatalf("unable to create statds client: %v", err)
 	}
 
-	hijacker, err := pkg.NewDockerRegistryHijacker(config)
+	prometheusMetrics, err := pkg.NewPrometheusMetrics(config)
+	if err != nil {
+		log.Fatalf("unable to create Prometheus metrics: %v", err)
+	}
+	if prometheusMetrics != nil {
+		go func() {
+			if err := prometheusMetrics.Start(); err != nil {
+				log.Fatalf("Prometheus metrics server error: %v", err)
+			}
+		}()
+	}
+
+	accessLog, err := pkg.NewAccessLog(config)
+	if err != nil {
+		log.Fatalf("unable to create access log: %v", err)
+	}
+
+	tracing, err := pkg.NewTracing(config)
+	if err != nil {
+		log.Fatalf("unable to set up tracing: %v", err)
+	}
+
+	auditLog, err := pkg.NewAuditLog(config)
+	if err != nil {
+		log.Fatalf("unable to create audit log: %v", err)
+	}
+
+	hijacker, err := pkg.NewDockerRegistryHijacker(config, pkg.WithAuditLog(auditLog))
 	if err != nil {
 		log.Fatalf("unable to create hijacker: %v", err)
 	}
 
-	proxy := pkg.NewMitmProxy(config.ListenAddress, config.CA, hijacker, statdsClient)
+	proxy := pkg.NewMitmProxy(config.ListenAddress, config.CA, hijacker, statdsClient,
+		pkg.WithPrometheusMetrics(prometheusMetrics),
+		pkg.WithAccessLog(accessLog),
+		pkg.WithTracing(tracing),
+		pkg.WithUpstreamProxy(config.UpstreamProxy),
+		pkg.WithUpstreamConnections(config.UpstreamConnections),
+		pkg.WithTransparentListener(config.Transparent),
+		pkg.WithSocks5Listener(config.Socks5),
+		pkg.WithAccessControl(config.AccessControl))
+
+	mirror, err := pkg.NewRegistryMirror(config, hijacker, proxy)
+	if err != nil {
+		log.Fatalf("unable to create registry mirror: %v", err)
+	}
+	if mirror != nil {
+		go func() {
+			if err := mirror.Start(); err != nil {
+				log.Fatalf("registry mirror error: %v", err)
+			}
+		}()
+	}
+
+	reloader := pkg.NewConfigReloader(opts.ConfigPath, config, hijacker, proxy)
+	go reloader.Start()
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			log.Infof("Received SIGHUP, reloading %q", opts.ConfigPath)
+			// errors already get logged
+			_ = reloader.Reload()
+		}
+	}()
+
+	// probing every redirect is too costly to do on every call to /readyz
+	registriesReadiness := pkg.NewBackgroundReadinessChecker(hijacker, config)
+
+	adminOpts := []pkg.AdminServerOption{
+		pkg.WithReadinessCheck("proxy", proxy),
+		pkg.WithReadinessCheck("registries", registriesReadiness),
+		pkg.WithConfigReloader(reloader),
+		pkg.WithRouteExplanations(hijacker),
+	}
+	if mirror != nil {
+		adminOpts = append(adminOpts, pkg.WithReadinessCheck("mirror", mirror))
+	}
+	adminServer := pkg.NewAdminServer(config, adminOpts...)
+	if adminServer != nil {
+		go registriesReadiness.Start()
+		go func() {
+			if err := adminServer.Start(); err != nil {
+				log.Fatalf("admin server error: %v", err)
+			}
+		}()
+	}
+
+	proxyDone := make(chan error, 1)
+	go func() {
+		proxyDone <- proxy.Start()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-proxyDone:
+		if err != nil {
+			log.Fatalf("proxy error: %v", err)
+		}
+	case sig := <-signals:
+		shutdown(proxy, mirror, sig, signals, config.ShutdownGracePeriod)
+		// done draining, further signals get their default behaviour again, i.e. kill the process if
+		// cleaning up hangs
+		signal.Stop(signals)
+		// Start returns once shut down, including if it hadn't started listening yet
+		if err := <-proxyDone; err != nil {
+			log.Errorf("proxy error: %v", err)
+		}
+	}
+
+	reloader.Stop()
+	registriesReadiness.Stop()
+
+	// the admin server keeps reporting the proxy as not ready until it's done draining
+	if adminServer != nil {
+		if err := adminServer.Stop(); err != nil {
+			log.Warnf("unable to stop admin server: %v", err)
+		}
+	}
+	if prometheusMetrics != nil {
+		if err := prometheusMetrics.Stop(); err != nil {
+			log.Warnf("unable to stop Prometheus metrics server: %v", err)
+		}
+	}
+
+	// flushes buffered metrics
+	if closer, ok := statdsClient.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warnf("unable to flush statsd metrics: %v", err)
+		}
+	}
+
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			log.Warnf("unable to close audit log: %v", err)
+		}
+	}
+
+	if tracing != nil {
+		if err := tracing.Shutdown(context.Background()); err != nil {
+			log.Warnf("unable to flush traces: %v", err)
+		}
+	}
+}
+
+// shutdown drains the proxy and the mirror, if any, for up to gracePeriod, or until another signal is received.
+func shutdown(proxy *pkg.MitmProxy, mirror *pkg.RegistryMirror, sig os.Signal, signals chan os.Signal, gracePeriod time.Duration) {
+	if gracePeriod == 0 {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+	log.Infof("Received %v, draining connections for up to %v", sig, gracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("Received %v again, closing all connections", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	if err := proxy.Start(); err != nil {
-		log.Fatalf("proxy error: %v", err)
+	mirrorDone := make(chan interface{})
+	go func() {
+		defer close(mirrorDone)
+		if mirror == nil {
+			return
+		}
+		if err := mirror.Shutdown(ctx); err != nil {
+			log.Warnf("Closed remaining mirror connections after draining: %v", err)
+		}
+	}()
+	defer func() { <-mirrorDone }()
+
+	if err := proxy.Shutdown(ctx); err != nil {
+		log.Warnf("Closed remaining connections after draining: %v", err)
+	} else {
+		log.Infof("Done draining connections")
 	}
 }
 
-func parseArgs() {
+// parseArgs returns true if a subcommand was run, in which case there's nothing more to do.
+func parseArgs() bool {
 	parser := flags.NewParser(&opts, flags.Default)
+	// without a subcommand, we run the proxy
+	parser.SubcommandsOptional = true
+	if _, err := parser.AddCommand("check", "Validate the config",
+		"Validates the config, and exits with a non-zero status if it's not valid.", &checkCommand{}); err != nil {
+		log.Fatalf("Error setting up subcommands: %v", err)
+	}
+	if _, err := parser.AddCommand("convert", "Convert Docker or containerd mirror configs",
+		"Prints the registries derived from a Docker daemon.json file and/or containerd hosts.toml files, as kraken-proxy YAML.",
+		&convertCommand{}); err != nil {
+		log.Fatalf("Error setting up subcommands: %v", err)
+	}
+	if _, err := parser.AddCommand("client-config", "Generate client configs",
+		"Prints the systemd drop-in, NO_PROXY list, and CA cert locations for a container runtime to pull images through the proxy.",
+		&clientConfigCommand{}); err != nil {
+		log.Fatalf("Error setting up subcommands: %v", err)
+	}
+	if _, err := parser.AddCommand("explain", "Explain how an image gets pulled",
+		"Prints which registry matches an image, and which redirects would be tried in what order, optionally probing them.",
+		&explainCommand{}); err != nil {
+		log.Fatalf("Error setting up subcommands: %v", err)
+	}
+
 	if _, err := parser.Parse(); err != nil {
-		// If the error was from the parser, then we can simply return
+		// If the error was from the parser or from a subcommand, then we can simply return
 		// as Parse() prints the error already
-		if _, ok := err.(*flags.Error); ok {
+		if _, ok := err.(*flags.Error); ok || parser.Active != nil {
 			os.Exit(1)
 		}
 		log.Fatalf("Error parsing flags: %v", err)
 	}
+	return parser.Active != nil
 }
 
 func initLogging(fromConfig string) {
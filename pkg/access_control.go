@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	proxyAuthorizationHeader = "Proxy-Authorization"
+	proxyAuthenticateHeader  = "Proxy-Authenticate"
+
+	proxyAuthRealm = "kraken-proxy"
+)
+
+// accessController decides which clients are allowed to use the proxy.
+type accessController struct {
+	// if empty, all client IPs are allowed
+	allowedNets []*net.IPNet
+
+	// username -> password; if nil, clients don't need to authenticate
+	users map[string]string
+}
+
+func newAccessController(config *AccessControlConfig) (*accessController, error) {
+	controller := &accessController{}
+	if config == nil {
+		return controller, nil
+	}
+
+	for _, cidr := range config.AllowedCIDRs {
+		ipNet, err := parseCIDROrIP(cidr)
+		if err != nil {
+			return nil, err
+		}
+		controller.allowedNets = append(controller.allowedNets, ipNet)
+	}
+
+	if config.UsersFile != "" {
+		users, err := loadUsersFile(config.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		controller.users = users
+	}
+
+	return controller, nil
+}
+
+// allowedAddr returns true iff the client at the given address (ip:port) is allowed by the CIDR rules.
+func (c *accessController) allowedAddr(remoteAddr string) bool {
+	if len(c.allowedNets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range c.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticated returns true iff the request carries valid basic auth credentials in its
+// Proxy-Authorization header, or if no users are configured.
+func (c *accessController) authenticated(request *http.Request) bool {
+	if !c.requiresAuthentication() {
+		return true
+	}
+
+	username, password, ok := parseProxyAuthorization(request.Header.Get(proxyAuthorizationHeader))
+	return ok && c.validCredentials(username, password)
+}
+
+// requiresAuthentication returns true iff clients need to authenticate.
+func (c *accessController) requiresAuthentication() bool {
+	return c.users != nil
+}
+
+func (c *accessController) validCredentials(username, password string) bool {
+	expected, found := c.users[username]
+	// always run the comparison, to not leak which users exist through timing
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	return found && match
+}
+
+// parseProxyAuthorization parses a basic auth Proxy-Authorization header, the same
+// way http.Request.BasicAuth does for Authorization headers.
+func parseProxyAuthorization(header string) (username, password string, ok bool) {
+	request := &http.Request{Header: http.Header{"Authorization": []string{header}}}
+	return request.BasicAuth()
+}
+
+// loadUsersFile reads a users file, containing one "username:password" entry per line;
+// empty lines and lines starting with a '#' are ignored.
+func loadUsersFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open users file %q", path)
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid entry on line %d of users file %q, expected username:password", lineNumber, path)
+		}
+		if _, present := users[parts[0]]; present {
+			return nil, errors.Errorf("duplicate user %q on line %d of users file %q", parts[0], lineNumber, path)
+		}
+		users[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "unable to read users file %q", path)
+	}
+
+	return users, nil
+}
+
+func parseCIDROrIP(entry string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, errors.Errorf("invalid CIDR or IP %q", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// listenerTLSConfig builds the tls.Config for the proxy's own listener; if a client CA is
+// configured, clients have to present a certificate signed by it.
+func listenerTLSConfig(config *ListenerTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.ClientCAPath != "" {
+		pemCerts, err := ioutil.ReadFile(config.ClientCAPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read client CA %q", config.ClientCAPath)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, errors.Errorf("no certificate found in client CA %q", config.ClientCAPath)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// a filteringListener closes the connections it accepts from clients that are not allowed.
+type filteringListener struct {
+	net.Listener
+	allowed func(conn net.Conn) bool
+}
+
+func (l *filteringListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.allowed(conn) {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
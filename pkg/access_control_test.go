@@ -0,0 +1,262 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMitmProxyAccessControl(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+	// the proxy rejects requests before even looking at where they're going, so plain HTTP
+	// requests allow looking at its responses, whereas CONNECTs just fail client-side
+	plainBaseURL := "http://" + localhostAddr(upstreamPort)
+
+	hijacker := &testMitmHijacker{
+		DefaultMitmHijacker: &DefaultMitmHijacker{},
+		t:                   t,
+	}
+
+	t.Run("it only lets in clients from allowed CIDRs", func(t *testing.T) {
+		for _, testCase := range []struct {
+			allowedCIDRs []string
+			allowed      bool
+		}{
+			{allowedCIDRs: []string{"10.0.0.0/8", "127.0.0.0/8"}, allowed: true},
+			{allowedCIDRs: []string{"127.0.0.1"}, allowed: true},
+			{allowedCIDRs: []string{"10.0.0.0/8", "192.168.1.12"}, allowed: false},
+		} {
+			upstreamServer.reset()
+			statsdClient := &testStatsdClient{}
+			proxyPort, proxyCleanup := withTestProxy(t, hijacker, statsdClient, WithAccessControl(&AccessControlConfig{
+				AllowedCIDRs: testCase.allowedCIDRs,
+			}))
+			client := newProxyClient(t, "http://"+localhostAddr(proxyPort), tlsClientConfig(t))
+
+			if testCase.allowed {
+				resp, respBody := makeRequest(t, client, baseURL, "/ok")
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, ok, respBody)
+
+				assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+				assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+			} else {
+				resp, _ := makeRequest(t, client, plainBaseURL, "/ok")
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+				_, err := client.Get(baseURL + "/ok")
+				assert.Error(t, err)
+
+				assert.Nil(t, upstreamServer.reset())
+				forbidden := statsdCall{methodName: "Inc", stat: string(ForbiddenRequestCounter), valueInt: 1, valueStr: "", rate: 1}
+				assert.Equal(t, []statsdCall{forbidden, forbidden}, statsdClient.reset())
+			}
+
+			proxyCleanup()
+		}
+	})
+
+	t.Run("it requires clients to authenticate when there's a users file", func(t *testing.T) {
+		usersFile, usersCleanup := withUsersFile(t, "# comment\n\nalice:secret\nbob:s3cr:et\n")
+		defer usersCleanup()
+
+		statsdClient := &testStatsdClient{}
+		proxyPort, proxyCleanup := withTestProxy(t, hijacker, statsdClient, WithAccessControl(&AccessControlConfig{
+			UsersFile: usersFile,
+		}))
+		defer proxyCleanup()
+
+		for _, testCase := range []struct {
+			name     string
+			userInfo string
+		}{
+			{name: "without credentials"},
+			{name: "with an unknown user", userInfo: "eve:secret@"},
+			{name: "with a wrong password", userInfo: "alice:s3cr:et@"},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				upstreamServer.reset()
+				statsdClient.reset()
+
+				client := newProxyClient(t, "http://"+testCase.userInfo+localhostAddr(proxyPort), tlsClientConfig(t))
+
+				resp, _ := makeRequest(t, client, plainBaseURL, "/ok")
+				assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+				assert.Equal(t, `Basic realm="kraken-proxy"`, resp.Header.Get("Proxy-Authenticate"))
+
+				_, err := client.Get(baseURL + "/ok")
+				assert.Error(t, err)
+
+				assert.Nil(t, upstreamServer.reset())
+				unauthenticated := statsdCall{methodName: "Inc", stat: string(UnauthenticatedRequestCounter), valueInt: 1, valueStr: "", rate: 1}
+				assert.Equal(t, []statsdCall{unauthenticated, unauthenticated}, statsdClient.reset())
+			})
+		}
+
+		for _, userInfo := range []string{"alice:secret@", "bob:s3cr:et@"} {
+			t.Run("with valid credentials "+userInfo, func(t *testing.T) {
+				upstreamServer.reset()
+				statsdClient.reset()
+
+				client := newProxyClient(t, "http://"+userInfo+localhostAddr(proxyPort), tlsClientConfig(t))
+
+				resp, respBody := makeRequest(t, client, baseURL, "/ok")
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, ok, respBody)
+
+				assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+				assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+			})
+		}
+	})
+
+	t.Run("it can require clients to present a certificate", func(t *testing.T) {
+		serverTLSInfo, serverCleanup := withTestServerTLSFiles(t)
+		defer serverCleanup()
+		clientCA, clientCACleanup := withTestCAFiles(t)
+		defer clientCACleanup()
+
+		statsdClient := &testStatsdClient{}
+		proxyPort, proxyCleanup := withTestProxy(t, hijacker, statsdClient, WithAccessControl(&AccessControlConfig{
+			TLS: &ListenerTLSConfig{
+				TLSInfo:      *serverTLSInfo,
+				ClientCAPath: clientCA.CertPath,
+			},
+		}))
+		defer proxyCleanup()
+		proxyURL := "https://" + localhostAddr(proxyPort)
+
+		t.Run("with a valid client certificate", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			ca, err := tls.X509KeyPair([]byte(caCert), []byte(caKey))
+			require.NoError(t, err)
+			ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+			require.NoError(t, err)
+			clientCert, err := genCert(&ca, "client")
+			require.NoError(t, err)
+
+			tlsConfig := tlsClientConfig(t)
+			tlsConfig.Certificates = []tls.Certificate{*clientCert}
+			client := newProxyClient(t, proxyURL, tlsConfig)
+
+			resp, respBody := makeRequest(t, client, baseURL, "/ok")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, ok, respBody)
+
+			assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+		})
+
+		t.Run("without a client certificate", func(t *testing.T) {
+			upstreamServer.reset()
+
+			client := newProxyClient(t, proxyURL, tlsClientConfig(t))
+
+			_, err := client.Get(baseURL + "/ok")
+			assert.Error(t, err)
+
+			assert.Nil(t, upstreamServer.reset())
+		})
+	})
+}
+
+func TestAccessControllerAllowedAddr(t *testing.T) {
+	controller, err := newAccessController(&AccessControlConfig{
+		AllowedCIDRs: []string{"10.0.0.0/8", "192.168.1.12", "fd00::/8"},
+	})
+	require.NoError(t, err)
+
+	for remoteAddr, expected := range map[string]bool{
+		"10.1.2.3:4567":     true,
+		"192.168.1.12:80":   true,
+		"192.168.1.13:80":   false,
+		"127.0.0.1:80":      false,
+		"[fd12::1]:443":     true,
+		"[::1]:443":         false,
+		"not-an-ip:443":     false,
+		"10.255.255.255":    true,
+		"[fe80::1%eth0]:80": false,
+	} {
+		assert.Equal(t, expected, controller.allowedAddr(remoteAddr), remoteAddr)
+	}
+
+	t.Run("everyone is allowed when there are no CIDRs", func(t *testing.T) {
+		controller, err := newAccessController(nil)
+		require.NoError(t, err)
+		assert.True(t, controller.allowedAddr("1.2.3.4:5"))
+	})
+
+	t.Run("it rejects invalid CIDRs", func(t *testing.T) {
+		_, err := newAccessController(&AccessControlConfig{AllowedCIDRs: []string{"10.0.0.0/33"}})
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadUsersFile(t *testing.T) {
+	t.Run("with a valid file", func(t *testing.T) {
+		usersFile, cleanup := withUsersFile(t, "alice:secret\n  # comment\nbob:\n")
+		defer cleanup()
+
+		users, err := loadUsersFile(usersFile)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"alice": "secret", "bob": ""}, users)
+	})
+
+	for name, contents := range map[string]string{
+		"with a line without a password": "alice:secret\nbob\n",
+		"with an empty username":         ":secret\n",
+		"with a duplicate user":          "alice:secret\nalice:other\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			usersFile, cleanup := withUsersFile(t, contents)
+			defer cleanup()
+
+			_, err := loadUsersFile(usersFile)
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("with a missing file", func(t *testing.T) {
+		_, err := loadUsersFile("/does/not/exist")
+		assert.Error(t, err)
+	})
+}
+
+/*** Helpers below ***/
+
+func newProxyClient(t *testing.T, proxyURL string, tlsConfig *tls.Config) *http.Client {
+	parsedURL, err := url.Parse(proxyURL)
+	require.NoError(t, err)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           http.ProxyURL(parsedURL),
+		},
+	}
+}
+
+func withUsersFile(t *testing.T, contents string) (string, func()) {
+	tmpFile, err := ioutil.TempFile("", "kraken-proxy-test-users")
+	require.NoError(t, err)
+	_, err = tmpFile.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, tmpFile.Close())
+
+	return tmpFile.Name(), func() {
+		require.NoError(t, os.Remove(tmpFile.Name()))
+	}
+}
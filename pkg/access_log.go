@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const stdoutAccessLogPath = "-"
+
+// The fields hijackers can set on access log entries with SetAccessLogField, on top of the ones
+// MitmProxy sets itself.
+const (
+	// The image repository the request is about.
+	RepositoryField = "repository"
+
+	// The tag or digest the request is about.
+	ReferenceField = "reference"
+
+	// The type of registry query, e.g. manifest or blob.
+	QueryTypeField = "query_type"
+
+	// The address of the redirect registry that served the request.
+	RedirectField = "redirect"
+
+	// How many redirect registries were tried.
+	RedirectsTriedField = "redirects_tried"
+)
+
+// The fields MitmProxy sets on all access log entries.
+const (
+	clientField     = "client"
+	hostField       = "host"
+	methodField     = "method"
+	pathField       = "path"
+	hijackedField   = "hijacked"
+	statusField     = "status"
+	bytesField      = "bytes"
+	durationMsField = "duration_ms"
+	errorField      = "error"
+)
+
+// AccessLog writes one JSON line per request a MitmProxy handles.
+type AccessLog struct {
+	logger *log.Logger
+	// nil when writing to stdout
+	file *os.File
+}
+
+// NewAccessLog returns nil if the access log is not configured.
+func NewAccessLog(config *Config) (*AccessLog, error) {
+	if config == nil || config.AccessLog == nil {
+		return nil, nil
+	}
+
+	accessLog := &AccessLog{}
+
+	var out io.Writer = os.Stdout
+	if path := config.AccessLog.Path; path != "" && path != stdoutAccessLogPath {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to open access log %q", path)
+		}
+		accessLog.file = file
+		out = file
+	}
+
+	accessLog.logger = log.New()
+	accessLog.logger.Out = out
+	accessLog.logger.Formatter = &log.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+	}
+	accessLog.logger.Level = log.InfoLevel
+
+	return accessLog, nil
+}
+
+func (a *AccessLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// accessLogEntry is what MitmProxy knows about a request once it's done handling it.
+type accessLogEntry struct {
+	request  *http.Request
+	hijacked bool
+	status   int
+	bytes    int64
+	duration time.Duration
+	err      error
+}
+
+func (a *AccessLog) log(entry *accessLogEntry) {
+	fields := accessLogFields(entry.request)
+
+	fields[clientField] = entry.request.RemoteAddr
+	fields[hostField] = entry.request.Host
+	fields[methodField] = entry.request.Method
+	fields[pathField] = entry.request.URL.Path
+	fields[hijackedField] = entry.hijacked
+	fields[statusField] = entry.status
+	fields[bytesField] = entry.bytes
+	fields[durationMsField] = float64(entry.duration) / float64(time.Millisecond)
+	if entry.err != nil {
+		fields[errorField] = entry.err.Error()
+	}
+
+	a.logger.WithFields(fields).Info(requestToString(entry.request))
+}
+
+type accessLogFieldsContextKey struct{}
+
+// recordedAccessLogFields holds the fields that hijackers record while handling a request.
+type recordedAccessLogFields struct {
+	fields log.Fields
+	mutex  sync.Mutex
+}
+
+// withAccessLogRecorder returns a copy of the request that SetAccessLogField can record fields on.
+func withAccessLogRecorder(request *http.Request) *http.Request {
+	ctx := context.WithValue(request.Context(), accessLogFieldsContextKey{}, &recordedAccessLogFields{fields: make(log.Fields)})
+	return request.WithContext(ctx)
+}
+
+// SetAccessLogField can be called by hijackers from their RequestHandler, to add a field to the
+// request's access log entry; fields set by the MitmProxy itself take precedence.
+func SetAccessLogField(request *http.Request, name string, value interface{}) {
+	if recorded, ok := request.Context().Value(accessLogFieldsContextKey{}).(*recordedAccessLogFields); ok {
+		recorded.mutex.Lock()
+		defer recorded.mutex.Unlock()
+
+		recorded.fields[name] = value
+	}
+}
+
+// accessLogFields returns a copy of the fields recorded on the request.
+func accessLogFields(request *http.Request) log.Fields {
+	result := make(log.Fields)
+	if recorded, ok := request.Context().Value(accessLogFieldsContextKey{}).(*recordedAccessLogFields); ok {
+		recorded.mutex.Lock()
+		for name, value := range recorded.fields {
+			result[name] = value
+		}
+		recorded.mutex.Unlock()
+	}
+	return result
+}
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	upstreamHost := localhostAddr(upstreamPort)
+	baseURL := "https://" + upstreamHost
+
+	hijacker := &fieldRecordingHijacker{
+		testMitmHijacker: &testMitmHijacker{
+			DefaultMitmHijacker: &DefaultMitmHijacker{},
+			t:                   t,
+			upstreamClient: &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: tlsClientConfig(t),
+				},
+			},
+			baseURL: baseURL,
+		},
+	}
+
+	accessLog, accessLogPath, accessLogCleanup := withTestAccessLog(t)
+	defer accessLogCleanup()
+
+	proxyPort, proxyCleanup := withTestProxy(t, hijacker, nil, WithAccessLog(accessLog))
+	defer proxyCleanup()
+	proxyClient := newProxyClient(t, "http://"+localhostAddr(proxyPort), tlsClientConfig(t))
+
+	for _, testCase := range []struct {
+		route          string
+		expectedStatus int
+	}{
+		{route: "/hijack_me", expectedStatus: http.StatusOK},
+		{route: "/ok", expectedStatus: http.StatusOK},
+		{route: "/direct_reply", expectedStatus: http.StatusAccepted},
+		{route: "/fail", expectedStatus: http.StatusNotFound},
+	} {
+		resp, _ := makeRequest(t, proxyClient, baseURL, testCase.route)
+		require.Equal(t, testCase.expectedStatus, resp.StatusCode, testCase.route)
+	}
+
+	entries := readAccessLog(t, accessLogPath, 4)
+
+	for _, entry := range entries {
+		assert.Equal(t, upstreamHost, entry["host"])
+		assert.Equal(t, "GET", entry["method"])
+		assert.Contains(t, entry["client"], "127.0.0.1:")
+		assert.Contains(t, entry, "duration_ms")
+		assert.Contains(t, entry, "time")
+	}
+
+	// the hijacker's fields are included
+	assert.Equal(t, "/hijack_me", entries[0]["path"])
+	assert.Equal(t, true, entries[0]["hijacked"])
+	assert.Equal(t, float64(http.StatusOK), entries[0]["status"])
+	assert.Equal(t, float64(len(helloWorld)), entries[0]["bytes"])
+	assert.Equal(t, "ubuntu", entries[0][RepositoryField])
+	assert.Nil(t, entries[0]["error"])
+
+	assert.Equal(t, "/ok", entries[1]["path"])
+	assert.Equal(t, false, entries[1]["hijacked"])
+	assert.Equal(t, float64(len(ok)), entries[1]["bytes"])
+
+	assert.Equal(t, "/direct_reply", entries[2]["path"])
+	assert.Equal(t, true, entries[2]["hijacked"])
+	assert.Equal(t, float64(http.StatusAccepted), entries[2]["status"])
+
+	// and errors from the hijacker too, the request then being proxied upstream
+	assert.Equal(t, "/fail", entries[3]["path"])
+	assert.Equal(t, false, entries[3]["hijacked"])
+	assert.Equal(t, float64(http.StatusNotFound), entries[3]["status"])
+	assert.Equal(t, "failed on purpose", entries[3]["error"])
+}
+
+func TestNewAccessLogReturnsNilWhenNotConfigured(t *testing.T) {
+	accessLog, err := NewAccessLog(&Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, accessLog)
+}
+
+/*** Helpers below ***/
+
+// a fieldRecordingHijacker sets a field on the access log entries of the requests it hijacks, and
+// fails to hijack /fail.
+type fieldRecordingHijacker struct {
+	*testMitmHijacker
+}
+
+func (h *fieldRecordingHijacker) RequestHandler(writer http.ResponseWriter, request *http.Request) (bool, *http.Response, error) {
+	if request.URL.Path == "/fail" {
+		return true, nil, errors.New("failed on purpose")
+	}
+
+	hijacked, response, err := h.testMitmHijacker.RequestHandler(writer, request)
+	if hijacked && response != nil {
+		SetAccessLogField(request, RepositoryField, "ubuntu")
+	}
+	return hijacked, response, err
+}
+
+// creates an access log in a temp directory, and returns it along with its path.
+func withTestAccessLog(t *testing.T) (*AccessLog, string, func()) {
+	dir, err := ioutil.TempDir("", "kraken-proxy-access-log")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "access.log")
+
+	accessLog, err := NewAccessLog(&Config{AccessLog: &AccessLogConfig{Path: path}})
+	require.NoError(t, err)
+
+	return accessLog, path, func() {
+		require.NoError(t, accessLog.Close())
+		require.NoError(t, os.RemoveAll(dir))
+	}
+}
+
+// entries get written once the response has been sent to the client, so this waits until
+// there are as many as expected.
+func readAccessLog(t *testing.T, path string, expectedEntries int) []map[string]interface{} {
+	deadline := time.Now().Add(genericTestTimeout)
+	for {
+		entries := readAccessLogEntries(t, path)
+		if len(entries) >= expectedEntries || time.Now().After(deadline) {
+			require.Equal(t, expectedEntries, len(entries))
+			return entries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readAccessLogEntries(t *testing.T, path string) []map[string]interface{} {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), scanner.Text())
+		entries = append(entries, entry)
+	}
+	require.NoError(t, scanner.Err())
+
+	return entries
+}
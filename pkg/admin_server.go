@@ -0,0 +1,363 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// how long readiness checks get to complete, on each call to /readyz
+	readinessCheckTimeout = 5 * time.Second
+	// how often BackgroundReadinessCheckers run their checks, by default
+	defaultReadinessProbeInterval = 10 * time.Second
+	// how long probes get to complete, on each call to /explain
+	explainProbeTimeout = 30 * time.Second
+
+	redactedValue = "<redacted>"
+)
+
+// a ReadinessChecker tells the AdminServer whether a component is ready to serve.
+type ReadinessChecker interface {
+	// CheckReadiness returns whether the component is ready, along with details on its state;
+	// details get reported as JSON on /readyz.
+	CheckReadiness(ctx context.Context) (ready bool, details interface{})
+}
+
+var (
+	_ ReadinessChecker = &MitmProxy{}
+	_ ReadinessChecker = &DockerRegistryHijacker{}
+	_ ReadinessChecker = &BackgroundReadinessChecker{}
+)
+
+// the details reported by BackgroundReadinessCheckers until their first check completes
+const notCheckedYet = "not checked yet"
+
+// a BackgroundReadinessChecker runs a ReadinessChecker in the background, at the admin config's readiness probe
+// interval, and reports the outcome of its last run; for checks too costly to run on every call to /readyz, e.g.
+// the DockerRegistryHijacker's, that probes every redirect.
+type BackgroundReadinessChecker struct {
+	checker  ReadinessChecker
+	interval time.Duration
+
+	ready   bool
+	details interface{}
+	mutex   sync.Mutex
+
+	stop chan interface{}
+}
+
+func NewBackgroundReadinessChecker(checker ReadinessChecker, config *Config) *BackgroundReadinessChecker {
+	interval := defaultReadinessProbeInterval
+	if config != nil && config.Admin != nil && config.Admin.ReadinessProbeInterval != 0 {
+		interval = config.Admin.ReadinessProbeInterval
+	}
+
+	return &BackgroundReadinessChecker{
+		checker:  checker,
+		interval: interval,
+		details:  notCheckedYet,
+		stop:     make(chan interface{}),
+	}
+}
+
+// Start runs the check right away, and then at every interval; it's a blocking call until Stop gets called.
+func (c *BackgroundReadinessChecker) Start() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.check()
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *BackgroundReadinessChecker) Stop() {
+	close(c.stop)
+}
+
+func (c *BackgroundReadinessChecker) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+	defer cancel()
+
+	ready, details := c.checker.CheckReadiness(ctx)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ready, c.details = ready, details
+}
+
+// CheckReadiness reports the outcome of the last check, not ready until the first one completes.
+func (c *BackgroundReadinessChecker) CheckReadiness(context.Context) (bool, interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ready, c.details
+}
+
+// AdminServer serves health checks and runtime introspection endpoints:
+//   - /healthz always replies 200 as long as the process is up
+//   - /readyz replies 200 if all its readiness checks pass, 503 otherwise
+//   - /config replies with the config, with secrets redacted
+//   - /explain?image=<image-ref> describes how pulls of that image get routed, and probes the registries
+//     they'd be tried on if probe=true
+//   - /debug/pprof serves runtime profiling data
+//
+// It's meant to listen on a different address than the proxy, so that it's never exposed to the proxy's clients.
+type AdminServer struct {
+	config *Config
+	checks []namedReadinessChecker
+	// if set, /config serves the config currently in effect
+	reloader *ConfigReloader
+	// if set, /explain is enabled
+	hijacker *DockerRegistryHijacker
+
+	server *http.Server
+}
+
+type namedReadinessChecker struct {
+	name    string
+	checker ReadinessChecker
+}
+
+// AdminServerOption allows customizing an AdminServer's behavior.
+type AdminServerOption func(*AdminServer)
+
+// WithReadinessCheck makes the AdminServer's /readyz endpoint only report ready when checker is ready too.
+func WithReadinessCheck(name string, checker ReadinessChecker) AdminServerOption {
+	return func(a *AdminServer) {
+		a.checks = append(a.checks, namedReadinessChecker{name: name, checker: checker})
+	}
+}
+
+// WithConfigReloader makes the AdminServer's /config endpoint serve the config currently in effect, rather
+// than the one it was created with.
+func WithConfigReloader(reloader *ConfigReloader) AdminServerOption {
+	return func(a *AdminServer) {
+		a.reloader = reloader
+	}
+}
+
+// WithRouteExplanations enables the AdminServer's /explain endpoint, to describe how hijacker routes pulls.
+func WithRouteExplanations(hijacker *DockerRegistryHijacker) AdminServerOption {
+	return func(a *AdminServer) {
+		a.hijacker = hijacker
+	}
+}
+
+// NewAdminServer returns nil if the admin server is not configured.
+func NewAdminServer(config *Config, opts ...AdminServerOption) *AdminServer {
+	if config == nil || config.Admin == nil {
+		return nil
+	}
+
+	server := &AdminServer{
+		config: config,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
+}
+
+// Start is a blocking call.
+func (a *AdminServer) Start() error {
+	return a.start(nil)
+}
+
+// If passed a listeningChan, it will close it when it's started listening.
+func (a *AdminServer) start(listeningChan chan interface{}) error {
+	if a.config.Admin.ListenAddress == "" {
+		return errors.New("no listen address configured for the admin server")
+	}
+	if a.server != nil {
+		return errors.New("admin server already started")
+	}
+
+	a.server = &http.Server{
+		Addr:    a.config.Admin.ListenAddress,
+		Handler: a.handler(),
+	}
+
+	startedLogLine := fmt.Sprintf("Admin server listening on %s", a.config.Admin.ListenAddress)
+	return startHTTPServer(a.server, listeningChan, nil, startedLogLine)
+}
+
+func (a *AdminServer) Stop() error {
+	if a.server == nil {
+		return errors.New("admin server not started yet")
+	}
+	return a.server.Shutdown(context.Background())
+}
+
+func (a *AdminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	mux.HandleFunc("/config", a.configHandler)
+	if a.hijacker != nil {
+		mux.HandleFunc("/explain", a.explain)
+	}
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+func (a *AdminServer) healthz(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+type readinessReport struct {
+	Ready  bool                       `json:"ready"`
+	Checks map[string]readinessDetail `json:"checks"`
+}
+
+type readinessDetail struct {
+	Ready   bool        `json:"ready"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (a *AdminServer) readyz(writer http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	report := a.checkReadiness(ctx)
+
+	statusCode := http.StatusOK
+	if !report.Ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(writer, statusCode, report)
+}
+
+// checkReadiness runs all the readiness checks concurrently.
+func (a *AdminServer) checkReadiness(ctx context.Context) *readinessReport {
+	details := make([]readinessDetail, len(a.checks))
+
+	var wg sync.WaitGroup
+	wg.Add(len(a.checks))
+	for i, check := range a.checks {
+		go func(i int, check namedReadinessChecker) {
+			defer wg.Done()
+			details[i].Ready, details[i].Details = check.checker.CheckReadiness(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := &readinessReport{
+		Ready:  true,
+		Checks: make(map[string]readinessDetail, len(a.checks)),
+	}
+	for i, check := range a.checks {
+		report.Checks[check.name] = details[i]
+		report.Ready = report.Ready && details[i].Ready
+	}
+	return report
+}
+
+func (a *AdminServer) configHandler(writer http.ResponseWriter, _ *http.Request) {
+	current := a.config
+	if a.reloader != nil {
+		current = a.reloader.Current()
+	}
+
+	config, err := redactedConfig(current)
+	if err == nil {
+		var bytes []byte
+		if bytes, err = yaml.Marshal(config); err == nil {
+			writer.Header().Set("Content-Type", "application/x-yaml")
+			writer.WriteHeader(http.StatusOK)
+			_, _ = writer.Write(bytes)
+			return
+		}
+	}
+
+	log.Errorf("Unable to serialize config: %v", err)
+	http.Error(writer, "unable to serialize config", http.StatusInternalServerError)
+}
+
+func (a *AdminServer) explain(writer http.ResponseWriter, request *http.Request) {
+	image := request.URL.Query().Get("image")
+	if image == "" {
+		http.Error(writer, "missing image parameter", http.StatusBadRequest)
+		return
+	}
+	probe, _ := strconv.ParseBool(request.URL.Query().Get("probe"))
+
+	ctx, cancel := context.WithTimeout(request.Context(), explainProbeTimeout)
+	defer cancel()
+
+	explanation, err := a.hijacker.Explain(ctx, image, probe)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(writer, http.StatusOK, explanation)
+}
+
+// redactedConfig returns a copy of config, with all the secrets it contains redacted.
+func redactedConfig(config *Config) (*Config, error) {
+	// simplest way to get a deep copy
+	bytes, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	result := &Config{}
+	if err := yaml.Unmarshal(bytes, result); err != nil {
+		return nil, err
+	}
+
+	// that covers all the fields that can hold secrets read from files
+	walkConfigStrings(reflect.ValueOf(result), "", func(path, value string) string {
+		if value != "" && isSecretConfigField(path) {
+			return redactedValue
+		}
+		return value
+	})
+	// the upstream proxy's URL can also embed credentials
+	if result.UpstreamProxy != nil && result.UpstreamProxy.URL != "" {
+		if proxyURL, err := url.Parse(result.UpstreamProxy.URL); err == nil {
+			result.UpstreamProxy.URL = proxyURL.Redacted()
+		} else {
+			result.UpstreamProxy.URL = redactedValue
+		}
+	}
+
+	return result, nil
+}
+
+func writeJSON(writer http.ResponseWriter, statusCode int, value interface{}) {
+	bytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Errorf("Unable to serialize %v to JSON: %v", value, err)
+		http.Error(writer, "unable to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	_, _ = writer.Write(append(bytes, '\n'))
+}
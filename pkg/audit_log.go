@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	defaultAuditLogMaxSizeMB = 100
+	defaultSyslogTag         = "kraken-proxy"
+)
+
+// the values of auditRecord.Source
+const (
+	redirectAuditSource = "redirect"
+	originAuditSource   = "origin"
+	// served by upstream, after both the redirects and the origin failed
+	upstreamAuditSource = "upstream"
+)
+
+// AuditLog records every image manifest a DockerRegistryHijacker serves, as JSON lines, to either a
+// rotated file or syslog.
+type AuditLog struct {
+	out   io.WriteCloser
+	mutex sync.Mutex
+}
+
+// NewAuditLog returns nil if the audit log is not configured.
+func NewAuditLog(config *Config) (*AuditLog, error) {
+	if config == nil || config.AuditLog == nil {
+		return nil, nil
+	}
+
+	if config.AuditLog.Syslog != nil {
+		if config.AuditLog.Path != "" {
+			return nil, errors.New("the audit log can be written either to a file or to syslog, not both")
+		}
+
+		writer, err := newSyslogWriter(config.AuditLog.Syslog)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to connect to syslog")
+		}
+		return &AuditLog{out: writer}, nil
+	}
+
+	if config.AuditLog.Path == "" {
+		return nil, errors.New("the audit log needs either a path or a syslog config")
+	}
+
+	maxSizeMB := config.AuditLog.MaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultAuditLogMaxSizeMB
+	}
+
+	return &AuditLog{
+		out: &lumberjack.Logger{
+			Filename:   config.AuditLog.Path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: config.AuditLog.MaxBackups,
+			MaxAge:     config.AuditLog.MaxAgeDays,
+			Compress:   config.AuditLog.Compress,
+		},
+	}, nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.out.Close()
+}
+
+// auditRecord is what gets recorded for each image manifest served.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// the IP of the node that pulled the image
+	Client     string `json:"client"`
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	// the tag or digest the image was pulled by
+	Tag    string `json:"tag"`
+	Digest string `json:"digest,omitempty"`
+	// either redirect, origin or upstream
+	Source string `json:"source"`
+	// the redirect that served the manifest, if any
+	Redirect string `json:"redirect,omitempty"`
+}
+
+func (a *AuditLog) record(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "unable to serialize audit record")
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, err := a.out.Write(line); err != nil {
+		return errors.Wrap(err, "unable to write audit record")
+	}
+	return nil
+}
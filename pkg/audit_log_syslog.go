@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package pkg
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter connects to syslog; records are sent with the info severity, and the daemon facility.
+func newSyslogWriter(config *SyslogConfig) (io.WriteCloser, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+	return syslog.Dial(config.Network, config.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package pkg
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// syslog is not available on these platforms.
+func newSyslogWriter(*SyslogConfig) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
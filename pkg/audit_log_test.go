@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
+)
+
+func TestDockerRegistryHijackerAuditLog(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer registryCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 2, "ubuntu:16")
+	defer redirectCleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	dir, err := ioutil.TempDir("", "kraken-proxy-audit-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	auditLog, err := NewAuditLog(&Config{AuditLog: &AuditLogConfig{Path: path}})
+	require.NoError(t, err)
+
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config, WithAuditLog(auditLog))
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	for _, path := range []string{
+		"/v2/ubuntu/manifests/16",
+		// blobs are not audited
+		"/v2/ubuntu/blobs/16",
+		"/v2/ubuntu/manifests/18",
+		// nor are manifests that can't be served
+		"/v2/ubuntu/manifests/20",
+		"/v2/ubuntu/manifests/sha256:abcd",
+	} {
+		request := buildGetRequest(t, "http://"+registryAddress+path)
+		request.RemoteAddr = "10.0.0.12:41234"
+		_, response, _ := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		if response != nil {
+			require.NoError(t, response.Body.Close())
+		}
+	}
+	require.NoError(t, auditLog.Close())
+
+	records := readAuditRecords(t, path)
+	require.Equal(t, 2, len(records))
+
+	for i := range records {
+		assert.WithinDuration(t, time.Now(), records[i].Time, genericTestTimeout)
+		records[i].Time = time.Time{}
+	}
+	assert.Equal(t, auditRecord{
+		Client:     "10.0.0.12",
+		Registry:   registryAddress,
+		Repository: "ubuntu",
+		Tag:        "16",
+		Digest:     dummyManifestDigest(2, "ubuntu:16"),
+		Source:     "redirect",
+		Redirect:   redirectAddress,
+	}, records[0])
+	assert.Equal(t, auditRecord{
+		Client:     "10.0.0.12",
+		Registry:   registryAddress,
+		Repository: "ubuntu",
+		Tag:        "18",
+		Digest:     dummyManifestDigest(1, "ubuntu:18"),
+		Source:     "origin",
+	}, records[1])
+}
+
+func TestDockerRegistryHijackerAuditLogUpstreamFallback(t *testing.T) {
+	// neither the registry nor its redirect are up, so the proxy forwards requests upstream
+	registryAddress := localhostAddr(getAvailablePort(t))
+	redirectAddress := localhostAddr(getAvailablePort(t))
+
+	dir, err := ioutil.TempDir("", "kraken-proxy-audit-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	auditLog, err := NewAuditLog(&Config{AuditLog: &AuditLogConfig{Path: path}})
+	require.NoError(t, err)
+
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config, WithAuditLog(auditLog))
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	proxy := NewMitmProxy(":0", nil, hijacker, nil)
+
+	upstreamDigest := "sha256:" + strings.Repeat("a", 64)
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if strings.HasSuffix(request.URL.Path, "/manifests/22") {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writer.Header().Set(dockerContentDigestHeader, upstreamDigest)
+		_, err := writer.Write([]byte("from upstream"))
+		require.NoError(t, err)
+	})
+
+	for _, path := range []string{
+		"/v2/ubuntu/manifests/20",
+		// blobs are not audited
+		"/v2/ubuntu/blobs/20",
+		// nor are manifests upstream can't serve
+		"/v2/ubuntu/manifests/22",
+	} {
+		request := buildGetRequest(t, "http://"+registryAddress+path)
+		request.RemoteAddr = "10.0.0.12:41234"
+		proxy.RequestHandler(upstream, &dummyResponseWriter{}, request)
+	}
+	// nor are the registries we don't proxy
+	request := buildGetRequest(t, "http://quay.io/v2/ubuntu/manifests/20")
+	proxy.RequestHandler(upstream, &dummyResponseWriter{}, request)
+
+	require.NoError(t, auditLog.Close())
+
+	records := readAuditRecords(t, path)
+	require.Equal(t, 1, len(records))
+
+	assert.WithinDuration(t, time.Now(), records[0].Time, genericTestTimeout)
+	records[0].Time = time.Time{}
+	assert.Equal(t, auditRecord{
+		Client:     "10.0.0.12",
+		Registry:   registryAddress,
+		Repository: "ubuntu",
+		Tag:        "20",
+		Digest:     upstreamDigest,
+		Source:     "upstream",
+	}, records[0])
+}
+
+func TestAuditLogToSyslog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("syslog is not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "kraken-proxy-syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "syslog.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	auditLog, err := NewAuditLog(&Config{AuditLog: &AuditLogConfig{Syslog: &SyslogConfig{
+		Network: "unixgram",
+		Address: socketPath,
+	}}})
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	require.NoError(t, auditLog.record(&auditRecord{
+		Client:     "10.0.0.12",
+		Registry:   "index.docker.io",
+		Repository: "library/ubuntu",
+		Tag:        "latest",
+		Source:     "origin",
+	}))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(genericTestTimeout)))
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	message := string(buffer[:n])
+
+	// priority is daemon.info
+	assert.True(t, strings.HasPrefix(message, "<30>"), message)
+	assert.Contains(t, message, "kraken-proxy[")
+	assert.Contains(t, message, `"repository":"library/ubuntu","tag":"latest","source":"origin"}`)
+}
+
+func TestNewAuditLog(t *testing.T) {
+	t.Run("it returns nil when not configured", func(t *testing.T) {
+		auditLog, err := NewAuditLog(&Config{})
+		assert.NoError(t, err)
+		assert.Nil(t, auditLog)
+	})
+
+	t.Run("it needs somewhere to write to", func(t *testing.T) {
+		_, err := NewAuditLog(&Config{AuditLog: &AuditLogConfig{}})
+		assert.EqualError(t, err, "the audit log needs either a path or a syslog config")
+	})
+
+	t.Run("it can't write both to a file and to syslog", func(t *testing.T) {
+		_, err := NewAuditLog(&Config{AuditLog: &AuditLogConfig{Path: "/tmp/audit.log", Syslog: &SyslogConfig{}}})
+		assert.EqualError(t, err, "the audit log can be written either to a file or to syslog, not both")
+	})
+}
+
+/*** Helpers below ***/
+
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+
+	return records
+}
+
+// the digest the dummy registries return for their manifests.
+func dummyManifestDigest(registryID int, image string) string {
+	response := fmt.Sprintf("from registry %d: manifests for %s", registryID, image)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(response)))
+}
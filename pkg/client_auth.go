@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+const (
+	defaultClientAuthCacheTTL  = 5 * time.Minute
+	defaultClientAuthCacheSize = 10000
+
+	// how long to remember decisions the origin didn't confirm by serving the resource, if less than the TTL:
+	// denials, so that clients can retry soon with other credentials, and e.g. 404s
+	unconfirmedClientAuthCacheTTL = 10 * time.Second
+
+	wwwAuthenticateHeader = "WWW-Authenticate"
+
+	unauthorizedErrorCode = "UNAUTHORIZED"
+)
+
+// the value of the OutcomeLabel for registry queries from clients that aren't allowed to pull from the
+// origin registry
+const unauthorizedOutcome = "unauthorized"
+
+// clientAuthorizer checks that clients are allowed to pull from a registry, by relaying its auth challenges
+// to them, and checking the credentials they come back with against the registry itself.
+type clientAuthorizer struct {
+	origin *registryClient
+	ttl    time.Duration
+	size   int
+
+	// the values are elements of lru, which holds *cachedClientAuthDecisions, the most recently used first
+	decisions map[clientAuthKey]*list.Element
+	lru       *list.List
+	mutex     sync.Mutex
+}
+
+type clientAuthKey struct {
+	// a hash of the client's Authorization header, so that we don't keep credentials around
+	credentials [sha256.Size]byte
+	repository  string
+}
+
+type clientAuthDecision struct {
+	// 0 if the client is allowed to pull, the status the origin replied with otherwise
+	deniedStatus int
+	challenge    string
+	// whether the origin served the resource to the client, see unconfirmedClientAuthCacheTTL
+	confirmed bool
+}
+
+type cachedClientAuthDecision struct {
+	*clientAuthDecision
+	key       clientAuthKey
+	expiresAt time.Time
+}
+
+func newClientAuthorizer(config *ClientAuthConfig, origin *registryClient) *clientAuthorizer {
+	if config == nil {
+		return nil
+	}
+
+	ttl := config.CacheTTL
+	if ttl == 0 {
+		ttl = defaultClientAuthCacheTTL
+	}
+
+	size := config.CacheSize
+	if size == 0 {
+		size = defaultClientAuthCacheSize
+	}
+
+	return &clientAuthorizer{
+		origin:    origin,
+		ttl:       ttl,
+		size:      size,
+		decisions: make(map[clientAuthKey]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// relayHandshake answers a client's initial /v2/ request the way the origin registry answers it, given the
+// client's credentials; so that clients get the origin's auth challenge.
+func (a *clientAuthorizer) relayHandshake(writer http.ResponseWriter, request *http.Request) error {
+	opts := append(a.sendOptions(request.Context(), request.Header.Get("Authorization"), ""),
+		httputil.SendAcceptedCodes(http.StatusOK, http.StatusUnauthorized))
+
+	response, err := httputil.Get(fmt.Sprintf("http://%s/v2/", a.origin.Address), opts...)
+	if err != nil {
+		return errors.Wrapf(err, "unable to relay the auth handshake to %s", a.origin.Address)
+	}
+	defer response.Body.Close()
+
+	for _, header := range []string{wwwAuthenticateHeader, registryAPIVersionHeader, "Content-Type"} {
+		if value := response.Header.Get(header); value != "" {
+			writer.Header().Set(header, value)
+		}
+	}
+	writer.WriteHeader(response.StatusCode)
+	_, err = io.Copy(writer, response.Body)
+	return err
+}
+
+// authorize checks whether the client that sent request is allowed to pull from the origin registry's
+// repository; if it's not, it replies with the origin's challenge, and returns false.
+// path is the path of the resource the client asked for, on the origin registry.
+func (a *clientAuthorizer) authorize(writer http.ResponseWriter, request *http.Request, repository, path string) (bool, error) {
+	authorization := request.Header.Get("Authorization")
+	key := clientAuthKey{
+		credentials: sha256.Sum256([]byte(authorization)),
+		repository:  repository,
+	}
+
+	decision := a.cachedDecision(key)
+	if decision == nil {
+		var err error
+		if decision, err = a.checkWithOrigin(request, authorization, path); err != nil {
+			return false, err
+		}
+		a.cacheDecision(key, decision)
+	}
+
+	if decision.deniedStatus == 0 {
+		return true, nil
+	}
+
+	if decision.challenge != "" {
+		writer.Header().Set(wwwAuthenticateHeader, decision.challenge)
+	}
+	writeRegistryError(writer, &mirrorError{
+		status:  decision.deniedStatus,
+		code:    unauthorizedErrorCode,
+		message: fmt.Sprintf("not allowed to pull from %s/%s", a.origin.Address, repository),
+	})
+	return false, nil
+}
+
+// checkWithOrigin sends a HEAD request for the same resource to the origin registry, with the client's
+// credentials: anything but a 401 or a 403 means the client is allowed to pull from that repository,
+// including a 404, since the redirects might have what the origin doesn't; but only 2xx responses confirm it.
+func (a *clientAuthorizer) checkWithOrigin(request *http.Request, authorization, path string) (*clientAuthDecision, error) {
+	opts := a.sendOptions(request.Context(), authorization, request.Header.Get("Accept"))
+
+	response, err := httputil.Head(fmt.Sprintf("http://%s%s", a.origin.Address, path), opts...)
+	if err == nil {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+		return &clientAuthDecision{confirmed: true}, nil
+	}
+
+	statusErr, ok := err.(httputil.StatusError)
+	if !ok || statusErr.Status >= http.StatusInternalServerError {
+		return nil, errors.Wrapf(err, "unable to check client credentials with %s", a.origin.Address)
+	}
+
+	switch statusErr.Status {
+	case http.StatusUnauthorized:
+		challenge := statusErr.Header.Get(wwwAuthenticateHeader)
+		if challenge == "" {
+			challenge = fmt.Sprintf("Basic realm=%q", a.origin.Address)
+		}
+		return &clientAuthDecision{deniedStatus: http.StatusUnauthorized, challenge: challenge}, nil
+	case http.StatusForbidden:
+		return &clientAuthDecision{deniedStatus: http.StatusForbidden}, nil
+	default:
+		// e.g. a 404, the client is allowed, but the origin doesn't have it; maybe the redirects do
+		return &clientAuthDecision{}, nil
+	}
+}
+
+// sendOptions returns the options to send requests to the origin registry with the client's credentials
+// rather than ours, with the same TLS settings as our own requests.
+func (a *clientAuthorizer) sendOptions(ctx context.Context, authorization, accept string) []httputil.SendOption {
+	opts := unauthenticatedSendOptions(a.origin)
+
+	headers := make(map[string]string)
+	if authorization != "" {
+		headers["Authorization"] = authorization
+	}
+	if accept != "" {
+		headers["Accept"] = accept
+	}
+
+	return append(opts,
+		httputil.SendHeaders(headers),
+		httputil.SendTimeout(a.origin.Config.Timeout),
+		httputil.SendContext(ctx))
+}
+
+func (a *clientAuthorizer) cachedDecision(key clientAuthKey) *clientAuthDecision {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	element, present := a.decisions[key]
+	if !present {
+		return nil
+	}
+
+	cached := element.Value.(*cachedClientAuthDecision)
+	if time.Now().After(cached.expiresAt) {
+		a.lru.Remove(element)
+		delete(a.decisions, key)
+		return nil
+	}
+	a.lru.MoveToFront(element)
+	return cached.clientAuthDecision
+}
+
+func (a *clientAuthorizer) cacheDecision(key clientAuthKey, decision *clientAuthDecision) {
+	ttl := a.ttl
+	if !decision.confirmed && ttl > unconfirmedClientAuthCacheTTL {
+		ttl = unconfirmedClientAuthCacheTTL
+	}
+	cached := &cachedClientAuthDecision{
+		clientAuthDecision: decision,
+		key:                key,
+		expiresAt:          time.Now().Add(ttl),
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if element, present := a.decisions[key]; present {
+		element.Value = cached
+		a.lru.MoveToFront(element)
+		return
+	}
+
+	if a.lru.Len() >= a.size {
+		// evict the least recently used decision
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.decisions, oldest.Value.(*cachedClientAuthDecision).key)
+	}
+	a.decisions[key] = a.lru.PushFront(cached)
+}
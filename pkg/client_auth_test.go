@@ -0,0 +1,281 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerRegistryHijackerClientAuth(t *testing.T) {
+	origin := &protectedRegistry{token: "s3cr3t"}
+	originAddress, originCleanup := origin.start(t)
+	defer originCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 1, "private:1", "forbidden:1")
+	defer redirectCleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	registry := Registry{
+		Config:     krakenConfig(originAddress),
+		Redirects:  []RedirectRegistry{{Config: krakenConfig(redirectAddress)}},
+		ClientAuth: &ClientAuthConfig{},
+	}
+	registry.Security.EnableHTTPFallback = true
+	registry.Redirects[0].Security.EnableHTTPFallback = true
+
+	hijacker, err := NewDockerRegistryHijacker(&Config{Registries: []Registry{registry}})
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	request := func(path, token string) *http.Request {
+		request := buildGetRequest(t, "https://"+originAddress+path)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		return request
+	}
+
+	t.Run("it relays the registry's handshake", func(t *testing.T) {
+		writer := &dummyResponseWriter{}
+		hijacked, response, err := hijacker.RequestHandler(writer, request("/v2/", ""))
+		require.NoError(t, err)
+		assert.True(t, hijacked)
+		assert.Nil(t, response)
+		assert.Equal(t, http.StatusUnauthorized, writer.statusCode)
+		assert.Equal(t, origin.challenge(""), writer.header.Get(wwwAuthenticateHeader))
+
+		writer = &dummyResponseWriter{}
+		hijacked, _, err = hijacker.RequestHandler(writer, request("/v2/", origin.token))
+		require.NoError(t, err)
+		assert.True(t, hijacked)
+		assert.Equal(t, http.StatusOK, writer.statusCode)
+		assert.Equal(t, "{}", string(writer.body))
+	})
+
+	t.Run("it challenges clients without credentials", func(t *testing.T) {
+		writer := &dummyResponseWriter{}
+		hijacked, response, err := hijacker.RequestHandler(writer, request("/v2/private/manifests/1", ""))
+		require.NoError(t, err)
+		assert.True(t, hijacked)
+		assert.Nil(t, response)
+		assert.Equal(t, http.StatusUnauthorized, writer.statusCode)
+		assert.Equal(t, origin.challenge("private"), writer.header.Get(wwwAuthenticateHeader))
+		assert.Contains(t, string(writer.body), unauthorizedErrorCode)
+	})
+
+	t.Run("it serves clients allowed by the registry from redirects, and caches that", func(t *testing.T) {
+		checksBefore := atomic.LoadInt32(&origin.checks)
+
+		for i := 0; i < 3; i++ {
+			writer := &dummyResponseWriter{}
+			hijacked, response, err := hijacker.RequestHandler(writer, request("/v2/private/manifests/1", origin.token))
+			require.NoError(t, err)
+			assert.True(t, hijacked)
+			if assert.NotNil(t, response) {
+				assert.Equal(t, "from registry 1: manifests for private:1", string(readResponseBody(t, response)))
+			}
+			assert.False(t, writer.touched)
+		}
+
+		assert.Equal(t, checksBefore+1, atomic.LoadInt32(&origin.checks))
+	})
+
+	t.Run("it doesn't serve clients the registry forbids", func(t *testing.T) {
+		writer := &dummyResponseWriter{}
+		hijacked, response, err := hijacker.RequestHandler(writer, request("/v2/forbidden/manifests/1", origin.token))
+		require.NoError(t, err)
+		assert.True(t, hijacked)
+		assert.Nil(t, response)
+		assert.Equal(t, http.StatusForbidden, writer.statusCode)
+	})
+
+	t.Run("it lets clients pull what the registry doesn't have, but that's not confirmed", func(t *testing.T) {
+		authorizer := hijacker.findRegistry(originAddress).clientAuth
+		missing := request("/v2/missing/manifests/1", origin.token)
+
+		decision, err := authorizer.checkWithOrigin(missing, missing.Header.Get("Authorization"), missing.URL.Path)
+		require.NoError(t, err)
+		assert.Equal(t, &clientAuthDecision{}, decision)
+	})
+
+	t.Run("cached decisions expire", func(t *testing.T) {
+		authorizer := newClientAuthorizer(&ClientAuthConfig{CacheTTL: time.Millisecond}, nil)
+		key := clientAuthKey{repository: "private"}
+		authorizer.cacheDecision(key, &clientAuthDecision{confirmed: true})
+		assert.NotNil(t, authorizer.cachedDecision(key))
+
+		time.Sleep(5 * time.Millisecond)
+		assert.Nil(t, authorizer.cachedDecision(key))
+		assert.Equal(t, 0, authorizer.lru.Len())
+	})
+
+	t.Run("only confirmed decisions get cached for the whole TTL", func(t *testing.T) {
+		authorizer := newClientAuthorizer(&ClientAuthConfig{}, nil)
+		expiresIn := func(key clientAuthKey) time.Duration {
+			return time.Until(authorizer.decisions[key].Value.(*cachedClientAuthDecision).expiresAt)
+		}
+
+		confirmed := clientAuthKey{repository: "private"}
+		authorizer.cacheDecision(confirmed, &clientAuthDecision{confirmed: true})
+		assert.InDelta(t, defaultClientAuthCacheTTL, expiresIn(confirmed), float64(genericTestTimeout))
+
+		denied := clientAuthKey{repository: "forbidden"}
+		authorizer.cacheDecision(denied, &clientAuthDecision{deniedStatus: http.StatusForbidden})
+		assert.InDelta(t, unconfirmedClientAuthCacheTTL, expiresIn(denied), float64(genericTestTimeout))
+
+		missing := clientAuthKey{repository: "missing"}
+		authorizer.cacheDecision(missing, &clientAuthDecision{})
+		assert.InDelta(t, unconfirmedClientAuthCacheTTL, expiresIn(missing), float64(genericTestTimeout))
+	})
+
+	t.Run("it forgets the least recently used decisions past its size", func(t *testing.T) {
+		authorizer := newClientAuthorizer(&ClientAuthConfig{CacheSize: 2}, nil)
+		keys := []clientAuthKey{{repository: "a"}, {repository: "b"}, {repository: "c"}}
+
+		authorizer.cacheDecision(keys[0], &clientAuthDecision{confirmed: true})
+		authorizer.cacheDecision(keys[1], &clientAuthDecision{confirmed: true})
+		require.NotNil(t, authorizer.cachedDecision(keys[0]))
+		authorizer.cacheDecision(keys[2], &clientAuthDecision{confirmed: true})
+
+		assert.NotNil(t, authorizer.cachedDecision(keys[0]))
+		assert.Nil(t, authorizer.cachedDecision(keys[1]))
+		assert.NotNil(t, authorizer.cachedDecision(keys[2]))
+		assert.Equal(t, 2, len(authorizer.decisions))
+		assert.Equal(t, 2, authorizer.lru.Len())
+	})
+
+	t.Run("it's disabled by default", func(t *testing.T) {
+		assert.Nil(t, newClientAuthorizer(nil, nil))
+	})
+}
+
+func TestDockerRegistryHijackerMappedClientCredentials(t *testing.T) {
+	origin := &protectedRegistry{token: "s3cr3t"}
+	originAddress, originCleanup := origin.start(t)
+	defer originCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 1, "private:1")
+	defer redirectCleanup()
+
+	authRequests, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	registry := Registry{
+		Config:     krakenConfig(originAddress),
+		Redirects:  []RedirectRegistry{{Config: krakenConfig(redirectAddress), ClientCredentials: MapClientCredentials}},
+		ClientAuth: &ClientAuthConfig{},
+	}
+	registry.Security.EnableHTTPFallback = true
+	registry.Redirects[0].Security.EnableHTTPFallback = true
+	config := &Config{Registries: []Registry{registry}}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	pull := func(token string) (*dummyResponseWriter, *http.Response) {
+		request := buildGetRequest(t, "https://"+originAddress+"/v2/private/manifests/1")
+		request.Header.Set("Authorization", "Bearer "+token)
+
+		writer := &dummyResponseWriter{}
+		hijacked, response, err := hijacker.RequestHandler(writer, request)
+		require.NoError(t, err)
+		require.True(t, hijacked)
+		return writer, response
+	}
+
+	t.Run("clients with bogus credentials don't get ours", func(t *testing.T) {
+		writer, response := pull("bogus")
+		assert.Nil(t, response)
+		assert.Equal(t, http.StatusUnauthorized, writer.statusCode)
+		assert.Empty(t, authRequests.requests)
+	})
+
+	t.Run("clients the registry lets pull get them", func(t *testing.T) {
+		_, response := pull(origin.token)
+		if assert.NotNil(t, response) {
+			assert.Empty(t, response.Header.Get("echoed-Authorization"))
+			readResponseBody(t, response)
+		}
+		assert.Len(t, authRequests.requests, 1)
+	})
+
+	t.Run("it can't be configured without client auth", func(t *testing.T) {
+		config.Registries[0].ClientAuth = nil
+		assert.Contains(t, config.Validate().Error(), "map requires client_auth")
+	})
+}
+
+/*** Helpers below ***/
+
+// a protectedRegistry only lets through requests with the right bearer token; it has no images, but
+// forbids pulling from the "forbidden" repository.
+type protectedRegistry struct {
+	token string
+	// how many registry queries it's received
+	checks int32
+}
+
+func (r *protectedRegistry) challenge(repository string) string {
+	challenge := `Bearer realm="https://auth.example.com/token",service="test"`
+	if repository != "" {
+		challenge += fmt.Sprintf(`,scope="repository:%s:pull"`, repository)
+	}
+	return challenge
+}
+
+func (r *protectedRegistry) start(t *testing.T) (address string, cleanup func()) {
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		authorized := request.Header.Get("Authorization") == "Bearer "+r.token
+
+		if strings.TrimRight(request.URL.Path, "/") == "/v2" {
+			if !authorized {
+				writer.Header().Set(wwwAuthenticateHeader, r.challenge(""))
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, err := writer.Write([]byte("{}"))
+			require.NoError(t, err)
+			return
+		}
+
+		atomic.AddInt32(&r.checks, 1)
+		_, _, repository, _ := parseRegistryURLPath(request.URL.Path)
+		switch {
+		case !authorized:
+			writer.Header().Set(wwwAuthenticateHeader, r.challenge(repository))
+			writer.WriteHeader(http.StatusUnauthorized)
+		case repository == "forbidden":
+			writer.WriteHeader(http.StatusForbidden)
+		case repository == "missing":
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	address = localhostAddr(getAvailablePort(t))
+	server := &http.Server{
+		Addr:    address,
+		Handler: http.HandlerFunc(handler),
+	}
+
+	listeningChan := make(chan interface{})
+	go func() {
+		require.NoError(t, startHTTPServer(server, listeningChan, nil, ""))
+	}()
+
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for protected registry to start listening")
+	}
+
+	return address, func() {
+		require.NoError(t, server.Close())
+	}
+}
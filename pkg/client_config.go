@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ContainerRuntime is a container runtime that can be set up to pull images through the proxy.
+type ContainerRuntime string
+
+const (
+	Dockerd    ContainerRuntime = "dockerd"
+	Containerd ContainerRuntime = "containerd"
+	CRIO       ContainerRuntime = "cri-o"
+)
+
+// ContainerRuntimes lists all supported container runtimes.
+var ContainerRuntimes = []ContainerRuntime{Dockerd, Containerd, CRIO}
+
+// always excluded from proxying
+var defaultNoProxy = []string{"localhost", "127.0.0.1", "::1"}
+
+type containerRuntimeSettings struct {
+	systemdService string
+	// where the runtime looks for per-registry CA certs, as <dir>/<registry>/ca.crt
+	certsDir string
+	notes    []string
+}
+
+var containerRuntimesSettings = map[ContainerRuntime]containerRuntimeSettings{
+	Dockerd: {
+		systemdService: "docker.service",
+		certsDir:       "/etc/docker/certs.d",
+	},
+	Containerd: {
+		systemdService: "containerd.service",
+		certsDir:       "/etc/containerd/certs.d",
+		notes: []string{
+			`containerd only looks up CA certs in /etc/containerd/certs.d if its CRI plugin's registry config_path is set to that directory`,
+		},
+	},
+	CRIO: {
+		systemdService: "crio.service",
+		certsDir:       "/etc/containers/certs.d",
+	},
+}
+
+// ClientConfig is what a node's container runtime needs to pull images through the proxy.
+type ClientConfig struct {
+	Runtime ContainerRuntime
+
+	// a systemd drop-in setting the proxy environment variables for the runtime's service
+	SystemdDropInPath string
+	SystemdDropIn     string
+
+	// what not to proxy, including the redirects so that pulls from them don't go back through the proxy
+	NoProxy []string
+
+	// the proxy's CA cert, and where to install it for the runtime to trust it for each registry
+	CACertPath     string
+	CAInstallPaths []string
+
+	Notes []string
+}
+
+// NewClientConfig generates the client config for runtime; proxyURL is how clients can reach the proxy,
+// it's derived from the config if empty. extraNoProxy gets appended to the NO_PROXY list.
+func NewClientConfig(config *Config, runtime ContainerRuntime, proxyURL string, extraNoProxy ...string) (*ClientConfig, error) {
+	settings, ok := containerRuntimesSettings[runtime]
+	if !ok {
+		return nil, errors.Errorf("unknown container runtime %q, supported ones are %v", runtime, ContainerRuntimes)
+	}
+
+	if proxyURL == "" {
+		var err error
+		if proxyURL, err = defaultProxyURL(config); err != nil {
+			return nil, err
+		}
+	}
+
+	clientConfig := &ClientConfig{
+		Runtime:           runtime,
+		SystemdDropInPath: filepath.Join("/etc/systemd/system", settings.systemdService+".d", "kraken-proxy.conf"),
+		NoProxy:           clientNoProxy(config, extraNoProxy),
+		Notes:             append([]string(nil), settings.notes...),
+	}
+
+	environment := []string{
+		"HTTP_PROXY=" + proxyURL,
+		"HTTPS_PROXY=" + proxyURL,
+		"NO_PROXY=" + strings.Join(clientConfig.NoProxy, ","),
+	}
+	var dropIn strings.Builder
+	dropIn.WriteString("[Service]\n")
+	for _, variable := range environment {
+		fmt.Fprintf(&dropIn, "Environment=%q\n", variable)
+	}
+	clientConfig.SystemdDropIn = dropIn.String()
+
+	if config.CA != nil {
+		clientConfig.CACertPath = config.CA.CertPath
+	}
+	for i := range config.Registries {
+		clientConfig.CAInstallPaths = append(clientConfig.CAInstallPaths,
+			filepath.Join(settings.certsDir, config.Registries[i].Address, "ca.crt"))
+		if config.Registries[i].MatchingRegex != "" {
+			clientConfig.Notes = append(clientConfig.Notes, fmt.Sprintf("%s uses a matching regex, the CA cert "+
+				"needs to be installed for every host it matches", config.Registries[i].Address))
+		}
+	}
+
+	if config.AccessControl != nil && config.AccessControl.UsersFile != "" && !strings.Contains(proxyURL, "@") {
+		clientConfig.Notes = append(clientConfig.Notes,
+			"the proxy requires authentication, the proxy URL needs to include credentials")
+	}
+
+	return clientConfig, nil
+}
+
+// String renders the client config as annotated files and lists.
+func (c *ClientConfig) String() string {
+	var result strings.Builder
+
+	fmt.Fprintf(&result, "# systemd drop-in for %s, at %s\n", c.Runtime, c.SystemdDropInPath)
+	result.WriteString(c.SystemdDropIn)
+
+	fmt.Fprintf(&result, "\n# NO_PROXY\n%s\n", strings.Join(c.NoProxy, ","))
+
+	fmt.Fprintf(&result, "\n# CA cert at %s, to install as\n", c.CACertPath)
+	for _, path := range c.CAInstallPaths {
+		result.WriteString(path + "\n")
+	}
+
+	if len(c.Notes) != 0 {
+		result.WriteString("\n# Notes\n")
+		for _, note := range c.Notes {
+			fmt.Fprintf(&result, "* %s\n", note)
+		}
+	}
+
+	return result.String()
+}
+
+// defaultProxyURL uses the listen address, replacing unspecified hosts with the machine's hostname.
+func defaultProxyURL(config *Config) (string, error) {
+	host, port, err := net.SplitHostPort(config.ListenAddress)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid listen address %q", config.ListenAddress)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if host, err = os.Hostname(); err != nil {
+			return "", errors.Wrap(err, "unable to get hostname")
+		}
+	}
+
+	scheme := "http"
+	if config.AccessControl != nil && config.AccessControl.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port)), nil
+}
+
+// clientNoProxy returns the default exclusions, then the redirects, then extra, without duplicates.
+func clientNoProxy(config *Config, extra []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(entry string) {
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			result = append(result, entry)
+		}
+	}
+
+	for _, entry := range defaultNoProxy {
+		add(entry)
+	}
+	for i := range config.Registries {
+		for _, redirect := range config.Registries[i].Redirects {
+			add(redirect.Address)
+		}
+	}
+	for _, entry := range extra {
+		add(entry)
+	}
+
+	return result
+}
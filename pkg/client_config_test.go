@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClientConfig(t *testing.T) {
+	config := &Config{
+		ListenAddress: "proxy.internal:8080",
+		CA:            &TLSInfo{CertPath: "/etc/kraken-proxy/ca.pem"},
+		Registries: []Registry{
+			{
+				Config: krakenConfig("registry-1.docker.io"),
+				Redirects: []RedirectRegistry{
+					{Config: krakenConfig("kraken.internal:5000")},
+					{Config: krakenConfig("mirror.gcr.io")},
+				},
+			},
+			{
+				Config:    krakenConfig("quay.io"),
+				Redirects: []RedirectRegistry{{Config: krakenConfig("kraken.internal:5000")}},
+			},
+		},
+	}
+
+	t.Run("for dockerd", func(t *testing.T) {
+		clientConfig, err := NewClientConfig(config, Dockerd, "", ".svc.cluster.local")
+		require.NoError(t, err)
+
+		assert.Equal(t, `# systemd drop-in for dockerd, at /etc/systemd/system/docker.service.d/kraken-proxy.conf
+[Service]
+Environment="HTTP_PROXY=http://proxy.internal:8080"
+Environment="HTTPS_PROXY=http://proxy.internal:8080"
+Environment="NO_PROXY=localhost,127.0.0.1,::1,kraken.internal:5000,mirror.gcr.io,.svc.cluster.local"
+
+# NO_PROXY
+localhost,127.0.0.1,::1,kraken.internal:5000,mirror.gcr.io,.svc.cluster.local
+
+# CA cert at /etc/kraken-proxy/ca.pem, to install as
+/etc/docker/certs.d/registry-1.docker.io/ca.crt
+/etc/docker/certs.d/quay.io/ca.crt
+`, clientConfig.String())
+	})
+
+	t.Run("for CRI-O, with an explicit proxy URL", func(t *testing.T) {
+		clientConfig, err := NewClientConfig(config, CRIO, "http://10.0.0.1:3128")
+		require.NoError(t, err)
+
+		assert.Equal(t, "/etc/systemd/system/crio.service.d/kraken-proxy.conf", clientConfig.SystemdDropInPath)
+		assert.Contains(t, clientConfig.SystemdDropIn, `Environment="HTTPS_PROXY=http://10.0.0.1:3128"`)
+		assert.Equal(t, []string{
+			"/etc/containers/certs.d/registry-1.docker.io/ca.crt",
+			"/etc/containers/certs.d/quay.io/ca.crt",
+		}, clientConfig.CAInstallPaths)
+		assert.Empty(t, clientConfig.Notes)
+	})
+
+	t.Run("for containerd, with an unspecified listen host and access control", func(t *testing.T) {
+		tlsConfig := *config
+		tlsConfig.ListenAddress = ":8443"
+		tlsConfig.AccessControl = &AccessControlConfig{UsersFile: "/etc/kraken-proxy/users", TLS: &ListenerTLSConfig{}}
+
+		clientConfig, err := NewClientConfig(&tlsConfig, Containerd, "")
+		require.NoError(t, err)
+
+		hostname, err := os.Hostname()
+		require.NoError(t, err)
+		assert.Contains(t, clientConfig.SystemdDropIn, `Environment="HTTPS_PROXY=https://`+hostname+`:8443"`)
+		assert.Equal(t, "/etc/containerd/certs.d/quay.io/ca.crt", clientConfig.CAInstallPaths[1])
+		require.Len(t, clientConfig.Notes, 2)
+		assert.Contains(t, clientConfig.Notes[1], "needs to include credentials")
+	})
+
+	t.Run("unknown runtimes are rejected", func(t *testing.T) {
+		_, err := NewClientConfig(config, "rkt", "")
+		assert.Error(t, err)
+	})
+}
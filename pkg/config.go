@@ -15,6 +15,62 @@ type Config struct {
 	LogLevel      string        `yaml:"log_level"`
 	Statsd        *StatsdConfig `yaml:"statsd"`
 
+	// if set, files matching that glob (relative to this file's directory, e.g. conf.d/*.yml) can define
+	// more registries, under a registries key; they're appended to this file's, in lexical order of the
+	// files' paths
+	Include string `yaml:"include"`
+	// more registries can also be imported from Docker's and containerd's mirror configs, after the
+	// included ones
+	Import *ImportConfig `yaml:"import"`
+
+	// if set, the config file gets checked for changes at that interval, and reloaded when it's changed;
+	// it's always reloaded on SIGHUP. Only the registries get reloaded, other changes require a restart,
+	// including to the upstream proxy and connections settings, which the registries keep using too.
+	ConfigWatchInterval time.Duration `yaml:"config_watch_interval"`
+	// string values can reference environment variables with ${VAR}, and secret fields, i.e. passwords, tokens
+	// and tracing headers, secret files with ${file:/path} or file:/path; if set, the secret files get re-read
+	// at that interval, and the registries reloaded if any of them has changed, e.g. to pick up rotated
+	// credentials. They're also re-read on every reload.
+	// Secrets used outside of registries, e.g. the upstream proxy's password, only take effect after a restart.
+	SecretsRefreshInterval time.Duration `yaml:"secrets_refresh_interval"`
+
+	// how long to wait for in-flight requests and tunnels when shutting down, before closing them;
+	// defaults to 30s
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+
+	// if set, the proxy also serves as a plain registry mirror, for clients that can be pointed at one
+	Mirror *MirrorConfig `yaml:"mirror"`
+
+	// metrics can be reported to statsd, Prometheus, or both
+	Prometheus *PrometheusConfig `yaml:"prometheus"`
+
+	// if set, all upstream connections go through that proxy
+	UpstreamProxy *UpstreamProxyConfig `yaml:"upstream_proxy"`
+
+	// tunes the proxy's connections to upstream servers, including registries
+	UpstreamConnections *UpstreamConnectionsConfig `yaml:"upstream_connections"`
+
+	// if set, the proxy also accepts TLS connections redirected to it with iptables
+	Transparent *TransparentProxyConfig `yaml:"transparent"`
+
+	// if set, the proxy also accepts SOCKS5 connections
+	Socks5 *Socks5ProxyConfig `yaml:"socks5"`
+
+	// if set, restricts who can use the proxy
+	AccessControl *AccessControlConfig `yaml:"access_control"`
+
+	// if set, traces get exported to an OTLP collector
+	Tracing *TracingConfig `yaml:"tracing"`
+
+	// if set, every request gets logged there as a JSON line
+	AccessLog *AccessLogConfig `yaml:"access_log"`
+
+	// if set, every image manifest served gets recorded there, for auditing purposes
+	AuditLog *AuditLogConfig `yaml:"audit_log"`
+
+	// if set, serves health checks and runtime introspection endpoints on a separate listener
+	Admin *AdminConfig `yaml:"admin"`
+
 	Registries []Registry `yaml:"registries"`
 }
 
@@ -23,11 +79,167 @@ type TLSInfo struct {
 	KeyPath  string `yaml:"key_path"`
 }
 
+type ImportConfig struct {
+	// path to a Docker daemon.json file, whose registry-mirrors become redirects for Docker Hub
+	DockerDaemon string `yaml:"docker_daemon"`
+	// path to a containerd registry config directory, e.g. /etc/containerd/certs.d, with a hosts.toml
+	// file per registry in sub-directories named after them
+	ContainerdHosts string `yaml:"containerd_hosts"`
+}
+
+// the access control settings apply to the mirror too, including the users file, with the same
+// Proxy-Authorization header, and the client CA, which requires the mirror to serve HTTPS.
+type MirrorConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	// if set, the mirror serves HTTPS
+	TLS *TLSInfo `yaml:"tls"`
+	// the registry requests are for when they say neither with an ns query parameter, nor with a path
+	// prefix; e.g. docker.io
+	DefaultRegistry string `yaml:"default_registry"`
+}
+
 type StatsdConfig struct {
 	Address       string        `yaml:"address"`
 	Prefix        string        `yaml:"prefix"`
 	FlushInterval time.Duration `yaml:"flush_interval"`
 	FlushBytes    int           `yaml:"flush_bytes"`
+	// if true, metrics are sent with DogStatsD tags (registry, query type, outcome...) and stable
+	// names, instead of encoding those in the metric names
+	DogStatsD bool `yaml:"dogstatsd"`
+}
+
+type PrometheusConfig struct {
+	// where to serve metrics
+	ListenAddress string `yaml:"listen_address"`
+	// defaults to /metrics
+	Path string `yaml:"path"`
+	// prefixes all metric names; defaults to kraken_proxy
+	Namespace string `yaml:"namespace"`
+}
+
+type TracingConfig struct {
+	// the OTLP/HTTP collector's address (host:port), e.g. localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// defaults to /v1/traces
+	URLPath string `yaml:"url_path"`
+	// sends traces over plain HTTP instead of HTTPS
+	Insecure bool `yaml:"insecure"`
+	// extra headers to send to the collector, e.g. for authentication
+	Headers map[string]string `yaml:"headers"`
+
+	// defaults to kraken-proxy
+	ServiceName string `yaml:"service_name"`
+	// the fraction of requests to trace, between 0 and 1; defaults to 1
+	// requests that are part of a trace sampled by the client are always traced
+	SampleRatio *float64 `yaml:"sample_ratio"`
+}
+
+type AccessLogConfig struct {
+	// the file to append to; defaults to stdout, which can also be made explicit with "-"
+	Path string `yaml:"path"`
+}
+
+type AuditLogConfig struct {
+	// the file to write audit records to; exclusive with syslog
+	Path string `yaml:"path"`
+	// the size at which the file gets rotated, in megabytes; defaults to 100
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// how many rotated files to keep; defaults to keeping all of them
+	MaxBackups int `yaml:"max_backups"`
+	// how many days to keep rotated files for; defaults to keeping them forever
+	MaxAgeDays int `yaml:"max_age_days"`
+	// whether to gzip rotated files
+	Compress bool `yaml:"compress"`
+
+	// if set, audit records get sent to syslog instead of to a file
+	Syslog *SyslogConfig `yaml:"syslog"`
+}
+
+type SyslogConfig struct {
+	// e.g. udp or unixgram; if both this and the address are left empty, records go to the
+	// local syslog socket
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	// defaults to kraken-proxy
+	Tag string `yaml:"tag"`
+}
+
+type AdminConfig struct {
+	// where to serve /healthz, /readyz, /config and /debug/pprof; this should not be reachable
+	// by the proxy's clients
+	ListenAddress string `yaml:"listen_address"`
+
+	// how often to check that the registries' redirects are reachable, for /readyz; defaults to 10s
+	ReadinessProbeInterval time.Duration `yaml:"readiness_probe_interval"`
+}
+
+type UpstreamProxyConfig struct {
+	// the upstream proxy's URL, e.g. http://proxy.corp:3128
+	// both http and https proxies are supported
+	URL string `yaml:"url"`
+
+	// hosts that should be dialed directly, with the same semantics as the NO_PROXY env variable:
+	// domain names (matching sub-domains too), IPs or CIDRs, optionally with a port, or "*"
+	NoProxy []string `yaml:"no_proxy"`
+
+	// optional credentials to authenticate to the upstream proxy; changes, including rotated secrets,
+	// require a restart
+	BasicAuth *BasicAuthCredentials `yaml:"basic_auth"`
+}
+
+type BasicAuthCredentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type UpstreamConnectionsConfig struct {
+	// limits the number of connections to each upstream host, 0 means no limit
+	// requests to upstream hosts speaking HTTP/2 get multiplexed over these connections
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+
+	// the number of idle connections to keep around for each upstream host; defaults to 2
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+
+	// how long idle connections are kept around; defaults to 90s
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+
+	// disables HTTP/2, both with clients on intercepted connections and with upstream hosts
+	DisableHTTP2 bool `yaml:"disable_http2"`
+}
+
+type TransparentProxyConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+
+	// the port to connect to upstream when the original destination can't be read from
+	// the socket (e.g. when not running on Linux) and only the SNI is known; defaults to 443
+	DefaultUpstreamPort int `yaml:"default_upstream_port"`
+}
+
+type Socks5ProxyConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+}
+
+type AccessControlConfig struct {
+	// if not empty, only clients whose IP belongs to one of these CIDRs (or is one of these IPs)
+	// can use the proxy; others get a 403
+	// also applies to the transparent listener, where denied connections simply get closed
+	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+
+	// if set, clients need to authenticate with basic auth through the Proxy-Authorization header,
+	// or get a 407; the file should contain one "username:password" entry per line
+	// SOCKS5 clients need to authenticate with the same credentials
+	// does not apply to the transparent listener, since transparent clients don't know they're being proxied
+	UsersFile string `yaml:"users_file"`
+
+	// if set, the proxy listener serves TLS (i.e. it's an HTTPS proxy)
+	TLS *ListenerTLSConfig `yaml:"tls"`
+}
+
+type ListenerTLSConfig struct {
+	TLSInfo `yaml:",inline"`
+
+	// if set, clients need to present a certificate signed by that CA (mTLS)
+	ClientCAPath string `yaml:"client_ca_path"`
 }
 
 type Registry struct {
@@ -37,8 +249,51 @@ type Registry struct {
 	// if a given request is addressed to this registry
 	MatchingRegex string `yaml:"matching_regex"`
 
+	// if set, the proxy's credentials for the registry come from there rather than from the security block
+	Credentials *CredentialsConfig `yaml:"credentials"`
+
 	// which registries to try & redirect to, in order
 	Redirects []RedirectRegistry `yaml:"redirects"`
+
+	// by default, clients can pull anything the proxy's own credentials allow; if set, clients need to
+	// authenticate to the registry themselves, as if they were pulling from it directly
+	ClientAuth *ClientAuthConfig `yaml:"client_auth"`
+
+	// the included file this registry was defined in, empty for the main config file
+	source string
+}
+
+// Source returns the included file this registry was defined in, or an empty string if it was defined
+// in the main config file.
+func (r *Registry) Source() string {
+	return r.source
+}
+
+// CredentialsConfig gets credentials the same way the Docker CLI does, e.g. short-lived ECR or GCR tokens
+// from their credential helpers; they get fetched again before they expire. Exclusive with the security
+// block's basic and credsStore settings.
+type CredentialsConfig struct {
+	// path to a Docker config.json file, e.g. ~/.docker/config.json, whose credHelpers, credsStore and auths
+	// get looked up for the registry, in that order
+	DockerConfig string `yaml:"docker_config"`
+	// or, the name of a docker-credential-<helper> binary, e.g. ecr-login or gcr
+	Helper string `yaml:"helper"`
+	// how long credentials are valid for; they get fetched again in the background shortly before that.
+	// Defaults to 1h, which suits GCR; ECR tokens are valid for 12h
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// ClientAuthConfig makes the proxy relay the registry's auth challenges to clients, and check the credentials
+// they come back with against the registry before serving them anything, even from redirects. Set it to {}
+// to use the defaults.
+type ClientAuthConfig struct {
+	// how long to remember whether a client's credentials allow pulling from a repository; defaults to 5m.
+	// Only decisions confirmed by the registry serving the resource are remembered that long, others (denials,
+	// but also e.g. 404s, that let clients pull from the redirects) for at most 10s
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// how many of these decisions to remember at most, the least recently used ones get forgotten first;
+	// defaults to 10000
+	CacheSize int `yaml:"cache_size"`
 }
 
 type RedirectRegistry struct {
@@ -48,6 +303,17 @@ type RedirectRegistry struct {
 	// à la SSH config, %r will be replaced by the original repository name,
 	// and %t by the original tag name
 	RewriteRepositories string `yaml:"rewrite_repositories"`
+
+	// same as for registries
+	Credentials *CredentialsConfig `yaml:"credentials"`
+
+	// what to do with the client's credentials: strip (the default), passthrough, or map them to the ones
+	// configured for this redirect, only for clients that send some; map requires client_auth on the
+	// registry, so that only clients the registry lets pull get mapped
+	ClientCredentials ClientCredentialsPolicy `yaml:"client_credentials"`
+	// more of the client's headers never to forward to this redirect; on top of hop-by-hop headers,
+	// Authorization (see client_credentials) and Cookie, which never are
+	StripHeaders []string `yaml:"strip_headers"`
 }
 
 func NewConfig(configPath string) (*Config, error) {
@@ -56,10 +322,38 @@ func NewConfig(configPath string) (*Config, error) {
 		return nil, errors.Wrapf(err, "unable to read file %q", configPath)
 	}
 
+	return parseConfig(bytes, configPath)
+}
+
+func parseConfig(bytes []byte, configPath string) (*Config, error) {
 	config := &Config{}
-	if err := yaml.Unmarshal(bytes, config); err != nil {
-		return nil, errors.Wrapf(err, "%q is not a YAML file", configPath)
+	// unknown fields are most likely typos, better to fail early than to silently ignore them
+	if err := yaml.UnmarshalStrict(bytes, config); err != nil {
+		return nil, errors.Wrapf(err, "%q is not a valid config file", configPath)
+	}
+	if err := config.loadIncludes(configPath); err != nil {
+		return nil, err
+	}
+	if err := config.loadImports(configPath); err != nil {
+		return nil, err
+	}
+	if err := interpolate(config); err != nil {
+		return nil, errors.Wrapf(err, "unable to expand references in %q", configPath)
 	}
 
 	return config, nil
 }
+
+// sourceFiles returns all the files, other than the main config file at configPath, that the config gets
+// registries from.
+func (c *Config) sourceFiles(configPath string) ([]string, error) {
+	included, err := c.includedFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+	imported, err := c.importedFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return append(included, imported...), nil
+}
@@ -0,0 +1,407 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/uber/kraken/utils/httputil"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// where Docker and containerd actually pull Docker Hub images from
+	dockerHubRegistryAddress = "registry-1.docker.io"
+	// the name under which containerd looks up Docker Hub's hosts.toml
+	dockerHubNamespace = "docker.io"
+
+	containerdHostsFile = "hosts.toml"
+	// containerd's fallback for registries without their own directory; we need explicit addresses
+	containerdDefaultNamespace = "_default"
+	containerdPullCapability   = "pull"
+)
+
+// dockerDaemonConfig is the part of Docker's daemon.json we care about.
+type dockerDaemonConfig struct {
+	RegistryMirrors    []string `json:"registry-mirrors"`
+	InsecureRegistries []string `json:"insecure-registries"`
+}
+
+// containerdHostsConfig is the part of a containerd hosts.toml file we care about, see
+// https://github.com/containerd/containerd/blob/main/docs/hosts.md
+type containerdHostsConfig struct {
+	Server string                          `toml:"server"`
+	Host   map[string]containerdHostConfig `toml:"host"`
+}
+
+type containerdHostConfig struct {
+	Capabilities []string `toml:"capabilities"`
+	SkipVerify   bool     `toml:"skip_verify"`
+	// either a path, or a list of paths
+	CA interface{} `toml:"ca"`
+	// either a path to a file containing both the cert and the key, a list of those, or a list of
+	// [cert, key] pairs
+	Client       interface{}            `toml:"client"`
+	Header       map[string]interface{} `toml:"header"`
+	OverridePath bool                   `toml:"override_path"`
+}
+
+// importedFiles returns the files registries get imported from.
+func (c *Config) importedFiles(configPath string) ([]string, error) {
+	if c.Import == nil {
+		return nil, nil
+	}
+
+	var paths []string
+	if c.Import.DockerDaemon != "" {
+		paths = append(paths, relativeToConfig(configPath, c.Import.DockerDaemon))
+	}
+	if c.Import.ContainerdHosts != "" {
+		hostsFiles, err := containerdHostsFiles(relativeToConfig(configPath, c.Import.ContainerdHosts))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, hostsFiles...)
+	}
+	return paths, nil
+}
+
+// loadImports appends the registries imported from Docker's and containerd's configs to the config's own,
+// after the included ones.
+func (c *Config) loadImports(configPath string) error {
+	if c.Import == nil {
+		return nil
+	}
+
+	if c.Import.DockerDaemon != "" {
+		registries, err := ImportDockerDaemonConfig(relativeToConfig(configPath, c.Import.DockerDaemon))
+		if err != nil {
+			return err
+		}
+		c.Registries = append(c.Registries, registries...)
+	}
+
+	if c.Import.ContainerdHosts != "" {
+		registries, err := ImportContainerdHosts(relativeToConfig(configPath, c.Import.ContainerdHosts))
+		if err != nil {
+			return err
+		}
+		c.Registries = append(c.Registries, registries...)
+	}
+
+	return nil
+}
+
+// ImportDockerDaemonConfig derives registries from the Docker daemon.json file at path: Docker only
+// uses its registry-mirrors for Docker Hub, so that yields at most one registry.
+func ImportDockerDaemonConfig(path string) ([]Registry, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read Docker daemon config %q", path)
+	}
+
+	daemonConfig := &dockerDaemonConfig{}
+	if err := json.Unmarshal(bytes, daemonConfig); err != nil {
+		return nil, errors.Wrapf(err, "%q is not a valid Docker daemon config", path)
+	}
+
+	insecure := make(map[string]bool, len(daemonConfig.InsecureRegistries))
+	for _, address := range daemonConfig.InsecureRegistries {
+		insecure[address] = true
+	}
+
+	var redirects []RedirectRegistry
+	for _, mirror := range daemonConfig.RegistryMirrors {
+		mirrorURL, err := parseMirrorURL(mirror)
+		if err != nil {
+			log.Warnf("%s: ignoring registry mirror %q: %v", path, mirror, err)
+			continue
+		}
+
+		redirect := RedirectRegistry{}
+		redirect.Address = mirrorURL.Host
+		redirect.Security.EnableHTTPFallback = mirrorURL.Scheme == "http" || insecure[mirrorURL.Host]
+		redirects = append(redirects, redirect)
+	}
+
+	if len(redirects) == 0 {
+		return nil, nil
+	}
+
+	registry := Registry{Redirects: redirects, source: path}
+	registry.Address = dockerHubRegistryAddress
+	return []Registry{registry}, nil
+}
+
+// ImportContainerdHosts derives registries from the hosts.toml files in dir, e.g. /etc/containerd/certs.d,
+// one per registry in sub-directories named after them; their hosts become redirects, in order.
+func ImportContainerdHosts(dir string) ([]Registry, error) {
+	paths, err := containerdHostsFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	registries := make([]Registry, 0, len(paths))
+	for _, path := range paths {
+		namespace := filepath.Base(filepath.Dir(path))
+		if namespace == containerdDefaultNamespace {
+			log.Warnf("%s: ignoring, default hosts are not supported, registries need to be listed explicitly", path)
+			continue
+		}
+
+		registry, err := importContainerdHostsFile(path, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if len(registry.Redirects) != 0 {
+			registries = append(registries, registry)
+		}
+	}
+
+	return registries, nil
+}
+
+// containerdHostsFiles returns the hosts.toml files in dir's sub-directories, sorted.
+func containerdHostsFiles(dir string) ([]string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.Wrap(err, "invalid containerd hosts directory")
+	}
+
+	// sorted already
+	paths, err := filepath.Glob(filepath.Join(dir, "*", containerdHostsFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid containerd hosts directory %q", dir)
+	}
+	return paths, nil
+}
+
+func importContainerdHostsFile(path, namespace string) (Registry, error) {
+	hostsConfig := &containerdHostsConfig{}
+	metadata, err := toml.DecodeFile(path, hostsConfig)
+	if err != nil {
+		return Registry{}, errors.Wrapf(err, "%q is not a valid containerd hosts file", path)
+	}
+
+	registry := Registry{source: path}
+	registry.Address = namespace
+	if namespace == dockerHubNamespace {
+		registry.Address = dockerHubRegistryAddress
+	}
+	if hostsConfig.Server != "" {
+		serverURL, err := parseMirrorURL(hostsConfig.Server)
+		if err != nil {
+			return Registry{}, errors.Wrapf(err, "%s: invalid server", path)
+		}
+		registry.Address = serverURL.Host
+	}
+
+	// hosts are tried in the order they're listed in, which a map doesn't preserve
+	for _, key := range metadata.Keys() {
+		if len(key) != 2 || key[0] != "host" {
+			continue
+		}
+		host := key[1]
+
+		redirect, err := containerdHostRedirect(host, hostsConfig.Host[host], path)
+		if err != nil {
+			log.Warnf("%s: ignoring host %q: %v", path, host, err)
+			continue
+		}
+		registry.Redirects = append(registry.Redirects, redirect)
+	}
+
+	return registry, nil
+}
+
+// containerdHostRedirect converts the config for host from the hosts.toml file at path.
+func containerdHostRedirect(host string, hostConfig containerdHostConfig, path string) (RedirectRegistry, error) {
+	redirect := RedirectRegistry{}
+
+	if hostConfig.Capabilities != nil && !containsString(hostConfig.Capabilities, containerdPullCapability) {
+		return redirect, errors.New("can't be pulled from")
+	}
+	if hostConfig.OverridePath {
+		return redirect, errors.New("override_path is not supported")
+	}
+
+	hostURL, err := parseMirrorURL(host)
+	if err != nil {
+		return redirect, err
+	}
+	redirect.Address = hostURL.Host
+	redirect.Security.EnableHTTPFallback = hostURL.Scheme == "http"
+
+	if hostConfig.SkipVerify {
+		log.Warnf("%s: host %q: skip_verify is not supported, its certificate will be verified", path, host)
+	}
+	if len(hostConfig.Header) != 0 {
+		log.Warnf("%s: host %q: custom headers are not supported, ignoring them", path, host)
+	}
+
+	cas, err := stringOrStrings(hostConfig.CA)
+	if err != nil {
+		return redirect, errors.Wrap(err, "invalid ca")
+	}
+	for _, ca := range cas {
+		redirect.Security.TLS.CAs = append(redirect.Security.TLS.CAs, httputil.Secret{Path: relativeToConfig(path, ca)})
+	}
+
+	client, err := containerdClientPair(hostConfig.Client, path, host)
+	if err != nil {
+		return redirect, errors.Wrap(err, "invalid client")
+	}
+	if client != nil {
+		redirect.Security.TLS.Client.Cert.Path = relativeToConfig(path, client[0])
+		redirect.Security.TLS.Client.Key.Path = relativeToConfig(path, client[1])
+	}
+
+	return redirect, nil
+}
+
+// containerdClientPair returns the first client [cert, key] pair, if any; we only support one.
+func containerdClientPair(client interface{}, path, host string) ([]string, error) {
+	if list, ok := client.([]interface{}); ok && len(list) != 0 {
+		if pair, ok := list[0].([]interface{}); ok {
+			if len(list) > 1 {
+				log.Warnf("%s: host %q: only one client certificate is supported, using the first one", path, host)
+			}
+			paths, err := stringOrStrings(pair)
+			if err != nil || len(paths) != 2 {
+				return nil, errors.Errorf("expected [cert, key] pairs, got %v", client)
+			}
+			return paths, nil
+		}
+	}
+
+	paths, err := stringOrStrings(client)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	if len(paths) > 1 {
+		log.Warnf("%s: host %q: only one client certificate is supported, using the first one", path, host)
+	}
+	// a single file containing both the cert and the key
+	return []string{paths[0], paths[0]}, nil
+}
+
+func stringOrStrings(value interface{}) ([]string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{typed}, nil
+	case []interface{}:
+		result := make([]string, 0, len(typed))
+		for _, item := range typed {
+			str, ok := item.(string)
+			if !ok {
+				return nil, errors.Errorf("expected a string, got %v", item)
+			}
+			result = append(result, str)
+		}
+		return result, nil
+	default:
+		return nil, errors.Errorf("expected a string or a list of strings, got %v", value)
+	}
+}
+
+// parseMirrorURL parses mirror URLs, which default to HTTPS, and can't have a path other than /v2
+// since redirects can only point at registries' roots.
+func parseMirrorURL(mirror string) (*url.URL, error) {
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+	mirrorURL, err := url.Parse(mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	if mirrorURL.Host == "" {
+		return nil, errors.Errorf("no host in %q", mirror)
+	}
+	if path := strings.TrimSuffix(mirrorURL.Path, "/"); path != "" && path != "/v2" {
+		return nil, errors.Errorf("paths are not supported, in %q", mirror)
+	}
+	return mirrorURL, nil
+}
+
+// relativeToConfig resolves relative paths from the directory of the file at configPath.
+func relativeToConfig(configPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalRegistries returns the YAML for registries, as found in included files, leaving out empty values.
+func MarshalRegistries(registries []Registry) ([]byte, error) {
+	bytes, err := yaml.Marshal(&includedConfig{Registries: registries})
+	if err != nil {
+		return nil, err
+	}
+
+	// round-trip through a generic structure to prune all the zero values from kraken's configs
+	var generic yaml.MapSlice
+	if err := yaml.Unmarshal(bytes, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(pruneEmptyYAML(generic))
+}
+
+func pruneEmptyYAML(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case yaml.MapSlice:
+		result := make(yaml.MapSlice, 0, len(typed))
+		for _, item := range typed {
+			if pruned := pruneEmptyYAML(item.Value); pruned != nil {
+				result = append(result, yaml.MapItem{Key: item.Key, Value: pruned})
+			}
+		}
+		if len(result) == 0 {
+			return nil
+		}
+		return result
+
+	case []interface{}:
+		result := make([]interface{}, 0, len(typed))
+		for _, item := range typed {
+			if pruned := pruneEmptyYAML(item); pruned != nil {
+				result = append(result, pruned)
+			}
+		}
+		if len(result) == 0 {
+			return nil
+		}
+		return result
+
+	case string:
+		// durations get serialized as strings
+		if typed == "" || typed == "0s" {
+			return nil
+		}
+	case bool:
+		if !typed {
+			return nil
+		}
+	case int:
+		if typed == 0 {
+			return nil
+		}
+	}
+	return value
+}
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/kraken/utils/httputil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestImportDockerDaemonConfig(t *testing.T) {
+	dir, cleanup := withTestImportFiles(t)
+	defer cleanup()
+	path := filepath.Join(dir, "daemon.json")
+
+	registries, err := ImportDockerDaemonConfig(path)
+	require.NoError(t, err)
+
+	require.Len(t, registries, 1)
+	registry := registries[0]
+	assert.Equal(t, "registry-1.docker.io", registry.Address)
+	assert.Equal(t, path, registry.Source())
+
+	// the mirror with a path gets ignored
+	require.Len(t, registry.Redirects, 3)
+	assert.Equal(t, "mirror.gcr.io", registry.Redirects[0].Address)
+	assert.False(t, registry.Redirects[0].Security.EnableHTTPFallback)
+	// insecure registries and HTTP mirrors allow falling back to HTTP
+	assert.Equal(t, "insecure.example.com", registry.Redirects[1].Address)
+	assert.True(t, registry.Redirects[1].Security.EnableHTTPFallback)
+	assert.Equal(t, "localhost:5000", registry.Redirects[2].Address)
+	assert.True(t, registry.Redirects[2].Security.EnableHTTPFallback)
+}
+
+func TestImportContainerdHosts(t *testing.T) {
+	dir, cleanup := withTestImportFiles(t)
+	defer cleanup()
+	certsDir := filepath.Join(dir, "certs.d")
+
+	registries, err := ImportContainerdHosts(certsDir)
+	require.NoError(t, err)
+
+	// _default gets ignored
+	require.Len(t, registries, 2)
+
+	dockerHub := registries[0]
+	assert.Equal(t, "registry-1.docker.io", dockerHub.Address)
+	assert.Equal(t, filepath.Join(certsDir, "docker.io", "hosts.toml"), dockerHub.Source())
+	// in the order they're listed in, without the push-only host
+	require.Len(t, dockerHub.Redirects, 2)
+	zMirror := dockerHub.Redirects[0]
+	assert.Equal(t, "z-mirror.example.com", zMirror.Address)
+	assert.False(t, zMirror.Security.EnableHTTPFallback)
+	assert.Equal(t, []httputil.Secret{{Path: filepath.Join(certsDir, "docker.io", "ca.crt")}}, zMirror.Security.TLS.CAs)
+	aMirror := dockerHub.Redirects[1]
+	assert.Equal(t, "a-mirror.example.com:5000", aMirror.Address)
+	assert.True(t, aMirror.Security.EnableHTTPFallback)
+	assert.Equal(t, "/certs/client.crt", aMirror.Security.TLS.Client.Cert.Path)
+	assert.Equal(t, "/certs/client.key", aMirror.Security.TLS.Client.Key.Path)
+
+	ghcr := registries[1]
+	assert.Equal(t, "ghcr.io", ghcr.Address)
+	require.Len(t, ghcr.Redirects, 1)
+	assert.Equal(t, "mirror.internal:5000", ghcr.Redirects[0].Address)
+}
+
+func TestConfigImport(t *testing.T) {
+	dir, cleanup := withTestImportFiles(t)
+	defer cleanup()
+	ca, caCleanup := withTestCAFiles(t)
+	defer caCleanup()
+
+	configPath := filepath.Join(dir, "config.yml")
+	writeTestConfigFile(t, configPath, testConfig(ca, "quay.io", "localhost:5000")+`import:
+  docker_daemon: daemon.json
+  containerd_hosts: certs.d
+`)
+
+	config, err := NewConfig(configPath)
+	require.NoError(t, err)
+
+	addresses := make([]string, 0, len(config.Registries))
+	for i := range config.Registries {
+		addresses = append(addresses, config.Registries[i].Address)
+	}
+	assert.Equal(t, []string{"quay.io", "registry-1.docker.io", "registry-1.docker.io", "ghcr.io"}, addresses)
+
+	err = config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `registries[2] (from "`+filepath.Join(dir, "certs.d", "docker.io", "hosts.toml")+
+		`").address: duplicate registry "registry-1.docker.io", already defined in "`+filepath.Join(dir, "daemon.json")+`"`)
+}
+
+func TestMarshalRegistries(t *testing.T) {
+	dir, cleanup := withTestImportFiles(t)
+	defer cleanup()
+
+	registries, err := ImportContainerdHosts(filepath.Join(dir, "certs.d"))
+	require.NoError(t, err)
+
+	bytes, err := MarshalRegistries(registries)
+	require.NoError(t, err)
+
+	assert.NotContains(t, string(bytes), "timeout")
+	assert.NotContains(t, string(bytes), `""`)
+
+	// round-trips, save for where registries come from
+	parsed := &includedConfig{}
+	require.NoError(t, yaml.UnmarshalStrict(bytes, parsed))
+	for i := range registries {
+		registries[i].source = ""
+	}
+	assert.Equal(t, registries, parsed.Registries)
+}
+
+/*** Helpers below ***/
+
+// withTestImportFiles creates a Docker daemon.json file and a containerd certs.d directory, and returns
+// the directory containing both.
+func withTestImportFiles(t *testing.T) (string, func()) {
+	path, cleanup := withTestConfigFile(t, "")
+	dir := filepath.Dir(path)
+
+	writeTestConfigFile(t, filepath.Join(dir, "daemon.json"), `{
+  "log-driver": "json-file",
+  "registry-mirrors": [
+    "https://mirror.gcr.io",
+    "https://insecure.example.com/",
+    "http://localhost:5000",
+    "https://with-path.example.com/mirror"
+  ],
+  "insecure-registries": ["insecure.example.com"]
+}`)
+
+	hostsFiles := map[string]string{
+		"docker.io": `server = "https://registry-1.docker.io"
+
+[host."https://z-mirror.example.com"]
+  capabilities = ["pull", "resolve"]
+  ca = "ca.crt"
+
+[host."http://a-mirror.example.com:5000"]
+  client = [["/certs/client.crt", "/certs/client.key"]]
+
+[host."https://push.example.com"]
+  capabilities = ["push"]
+`,
+		"ghcr.io": `[host."mirror.internal:5000/v2"]
+`,
+		"_default": `[host."https://default.example.com"]
+`,
+	}
+	for namespace, contents := range hostsFiles {
+		namespaceDir := filepath.Join(dir, "certs.d", namespace)
+		require.NoError(t, os.MkdirAll(namespaceDir, 0755))
+		writeTestConfigFile(t, filepath.Join(namespaceDir, "hosts.toml"), contents)
+	}
+
+	return dir, cleanup
+}
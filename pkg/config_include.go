@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// includedConfig is what config files matching the include glob can contain.
+type includedConfig struct {
+	Registries []Registry `yaml:"registries"`
+}
+
+// includedFiles returns the files matching the include glob, in lexical order; relative globs are relative
+// to the directory of the main config file at configPath.
+func (c *Config) includedFiles(configPath string) ([]string, error) {
+	if c.Include == "" {
+		return nil, nil
+	}
+
+	// sorted already
+	paths, err := filepath.Glob(relativeToConfig(configPath, c.Include))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid include glob %q", c.Include)
+	}
+	return paths, nil
+}
+
+// loadIncludes appends the registries from included files to the config's own, in the order of
+// includedFiles; conflicts are reported by Validate, along with the file each registry comes from.
+func (c *Config) loadIncludes(configPath string) error {
+	paths, err := c.includedFiles(configPath)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read included file %q", path)
+		}
+
+		included := &includedConfig{}
+		if err := yaml.UnmarshalStrict(bytes, included); err != nil {
+			return errors.Wrapf(err, "%q is not a valid included config file, which may only define registries", path)
+		}
+
+		for _, registry := range included.Registries {
+			registry.source = path
+			c.Registries = append(c.Registries, registry)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigInclude(t *testing.T) {
+	ca, caCleanup := withTestCAFiles(t)
+	defer caCleanup()
+
+	configPath, configCleanup := withTestConfigFile(t, testConfig(ca, "docker.io", "localhost:5000")+"include: conf.d/*.yml\n")
+	defer configCleanup()
+	confDir := filepath.Join(filepath.Dir(configPath), "conf.d")
+	require.NoError(t, os.Mkdir(confDir, 0755))
+
+	writeIncludedFile := func(t *testing.T, name string, addresses ...string) string {
+		contents := "registries:\n"
+		for _, address := range addresses {
+			contents += fmt.Sprintf("  - address: %s\n    redirects:\n      - address: localhost:5001\n", address)
+		}
+		path := filepath.Join(confDir, name)
+		writeTestConfigFile(t, path, contents)
+		return path
+	}
+
+	quayPath := writeIncludedFile(t, "quay.yml", "quay.io")
+	gcrPath := writeIncludedFile(t, "gcr.yml", "gcr.io", "us.gcr.io")
+	// doesn't match the glob
+	writeIncludedFile(t, "ignored.txt", "ignored.io")
+
+	t.Run("it appends included registries in lexical order of their files", func(t *testing.T) {
+		config, err := NewConfig(configPath)
+		require.NoError(t, err)
+		require.NoError(t, config.Validate())
+
+		addresses := make([]string, 0, len(config.Registries))
+		sources := make([]string, 0, len(config.Registries))
+		for i := range config.Registries {
+			addresses = append(addresses, config.Registries[i].Address)
+			sources = append(sources, config.Registries[i].Source())
+		}
+		assert.Equal(t, []string{"docker.io", "gcr.io", "us.gcr.io", "quay.io"}, addresses)
+		assert.Equal(t, []string{"", gcrPath, gcrPath, quayPath}, sources)
+	})
+
+	t.Run("it reports conflicts along with the files they come from", func(t *testing.T) {
+		conflictPath := writeIncludedFile(t, "zz-conflict.yml", "docker.io", "quay.io")
+		defer func() { require.NoError(t, os.Remove(conflictPath)) }()
+
+		config, err := NewConfig(configPath)
+		require.NoError(t, err)
+
+		err = config.Validate()
+		require.Error(t, err)
+		assert.Equal(t, fmt.Sprintf(`registries[4] (from %q).address: duplicate registry "docker.io", already defined in the main config file; `, conflictPath)+
+			fmt.Sprintf(`registries[5] (from %q).address: duplicate registry "quay.io", already defined in %q`, conflictPath, quayPath),
+			err.Error())
+	})
+
+	t.Run("included files may only define registries", func(t *testing.T) {
+		invalidPath := filepath.Join(confDir, "invalid.yml")
+		writeTestConfigFile(t, invalidPath, "log_level: debug\n")
+		defer func() { require.NoError(t, os.Remove(invalidPath)) }()
+
+		_, err := NewConfig(configPath)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), fmt.Sprintf("%q is not a valid included config file", invalidPath))
+	})
+
+	t.Run("the reloader picks up changes to included files", func(t *testing.T) {
+		config, err := NewConfig(configPath)
+		require.NoError(t, err)
+		hijacker, err := NewDockerRegistryHijacker(config)
+		require.NoError(t, err)
+		defer hijacker.closeIdleConnections()
+
+		reloader := NewConfigReloader(configPath, config, hijacker, nil)
+
+		newPath := writeIncludedFile(t, "new.yml", "ghcr.io")
+		defer func() { require.NoError(t, os.Remove(newPath)) }()
+
+		reloader.reloadIfChanged()
+
+		registries := reloader.Current().Registries
+		require.Len(t, registries, 5)
+		assert.Equal(t, "ghcr.io", registries[3].Address)
+		assert.Equal(t, newPath, registries[3].Source())
+	})
+}
@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// secret values starting with that prefix get replaced by the contents of the file at the path that follows
+	fileReferencePrefix = "file:"
+
+	referenceStart = "${"
+	referenceEnd   = "}"
+	// escapes a literal ${
+	escapedReferenceStart = "$${"
+)
+
+// the paths of the config fields that hold secrets: only those can reference secret files, and they're
+// redacted when serving the config.
+var secretConfigFieldRegex = regexp.MustCompile(`^(` +
+	`upstream_proxy\.basic_auth\.password` +
+	`|tracing\.headers\..+` +
+	`|registries\[\d+\](\.redirects\[\d+\])?\.security\.basic\.(password|auth|identitytoken|registrytoken)` +
+	`)$`)
+
+func isSecretConfigField(path string) bool {
+	return secretConfigFieldRegex.MatchString(path)
+}
+
+// interpolate expands references in all the string values of config, e.g. to keep secrets out of config files:
+//   - ${VAR} gets replaced by the value of the VAR environment variable, which must be set
+//   - in secret fields only, ${file:/path} gets replaced by the contents of the file at /path, without trailing
+//     newlines; as does a whole value of file:/path
+//   - $${ is a literal ${
+//
+// It returns ConfigErrors listing all the references that can't be expanded.
+func interpolate(config *Config) error {
+	var errs ConfigErrors
+	walkConfigStrings(reflect.ValueOf(config), "", func(path, value string) string {
+		expanded, err := interpolateString(value, isSecretConfigField(path))
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, path))
+			return value
+		}
+		return expanded
+	})
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// walkConfigStrings calls visit for each settable string in value, with its path in the config, and replaces
+// it with what visit returns.
+func walkConfigStrings(value reflect.Value, path string, visit func(path, value string) string) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			walkConfigStrings(value.Elem(), path, visit)
+		}
+
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			if field := value.Field(i); field.CanSet() {
+				walkConfigStrings(field, joinConfigPath(path, yamlFieldName(valueType.Field(i))), visit)
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			walkConfigStrings(value.Index(i), fmt.Sprintf("%s[%d]", path, i), visit)
+		}
+
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			// map values are not addressable, so we work on a copy
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			walkConfigStrings(elem, joinConfigPath(path, fmt.Sprint(iter.Key().Interface())), visit)
+			value.SetMapIndex(iter.Key(), elem)
+		}
+
+	case reflect.String:
+		if value.CanSet() {
+			value.SetString(visit(path, value.String()))
+		}
+	}
+}
+
+// interpolateString expands the references in value; file references only if secret is true, bare ones are
+// left as is otherwise, e.g. so that regexes can match file: URLs.
+func interpolateString(value string, secret bool) (string, error) {
+	if secret && strings.HasPrefix(value, fileReferencePrefix) {
+		return readSecretFile(strings.TrimPrefix(value, fileReferencePrefix))
+	}
+	if !strings.Contains(value, referenceStart) {
+		return value, nil
+	}
+
+	var result strings.Builder
+	for len(value) != 0 {
+		if strings.HasPrefix(value, escapedReferenceStart) {
+			result.WriteString(referenceStart)
+			value = value[len(escapedReferenceStart):]
+			continue
+		}
+		if !strings.HasPrefix(value, referenceStart) {
+			result.WriteByte(value[0])
+			value = value[1:]
+			continue
+		}
+
+		end := strings.Index(value, referenceEnd)
+		if end == -1 {
+			return "", errors.Errorf("unterminated reference in %q", value)
+		}
+		expanded, err := expandReference(value[len(referenceStart):end], secret)
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(expanded)
+		value = value[end+len(referenceEnd):]
+	}
+	return result.String(), nil
+}
+
+func expandReference(reference string, secret bool) (string, error) {
+	if strings.HasPrefix(reference, fileReferencePrefix) {
+		if !secret {
+			return "", errors.New("secret files can only be referenced from secret fields, i.e. passwords, tokens and tracing headers")
+		}
+		return readSecretFile(strings.TrimPrefix(reference, fileReferencePrefix))
+	}
+
+	if value, present := os.LookupEnv(reference); present {
+		return value, nil
+	}
+	return "", errors.Errorf("environment variable %q is not set", reference)
+}
+
+// readSecretFile returns the contents of the file at path, without trailing newlines.
+func readSecretFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read secret file")
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// yamlFieldName returns the name of the field in YAML files, or an empty string for inlined fields.
+func yamlFieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("yaml")
+	name := strings.Split(tag, ",")[0]
+	if name == "" && strings.Contains(tag, "inline") {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" || name == "" {
+		return path + name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolate(t *testing.T) {
+	secretPath, secretCleanup := withTestConfigFile(t, "hunter2\n")
+	defer secretCleanup()
+
+	require.NoError(t, os.Setenv("KRAKEN_PROXY_TEST_USER", "alice"))
+	defer os.Unsetenv("KRAKEN_PROXY_TEST_USER")
+
+	t.Run("it expands environment variables and secret files", func(t *testing.T) {
+		config, err := parseConfig([]byte(`
+listen_address: localhost:${KRAKEN_PROXY_TEST_USER}
+upstream_proxy:
+  url: http://proxy.example.com:3128
+  basic_auth:
+    username: ${KRAKEN_PROXY_TEST_USER}
+    password: file:`+secretPath+`
+registries:
+  - address: registry.example.com
+    security:
+      basic:
+        identitytoken: ${file:`+secretPath+`}
+    redirects:
+      - address: mirror.example.com
+        security:
+          basic:
+            username: ${KRAKEN_PROXY_TEST_USER}
+            password: file:`+secretPath+`
+tracing:
+  headers:
+    authorization: Basic ${KRAKEN_PROXY_TEST_USER}:${file:`+secretPath+`}
+    x-literal: $${KRAKEN_PROXY_TEST_USER}
+`), "config.yml")
+		require.NoError(t, err)
+
+		assert.Equal(t, "localhost:alice", config.ListenAddress)
+		assert.Equal(t, "hunter2", config.UpstreamProxy.BasicAuth.Password)
+		assert.Equal(t, "hunter2", config.Registries[0].Security.BasicAuth.IdentityToken)
+		basic := config.Registries[0].Redirects[0].Security.BasicAuth
+		assert.Equal(t, "alice", basic.Username)
+		assert.Equal(t, "hunter2", basic.Password)
+		assert.Equal(t, map[string]string{
+			"authorization": "Basic alice:hunter2",
+			"x-literal":     "${KRAKEN_PROXY_TEST_USER}",
+		}, config.Tracing.Headers)
+	})
+
+	t.Run("it only reads secret files from secret fields", func(t *testing.T) {
+		config, err := parseConfig([]byte(`
+listen_address: localhost:8080
+registries:
+  - address: registry.example.com
+    matching_regex: file:`+secretPath+`
+    redirects:
+      - address: mirror.example.com
+`), "config.yml")
+		require.NoError(t, err)
+		assert.Equal(t, "file:"+secretPath, config.Registries[0].MatchingRegex)
+
+		_, err = parseConfig([]byte(`
+listen_address: localhost:8080
+include: ${file:`+secretPath+`}
+`), "config.yml")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "include: secret files can only be referenced from secret fields")
+	})
+
+	t.Run("it reports all the references it can't expand", func(t *testing.T) {
+		missingPath := filepath.Join(filepath.Dir(secretPath), "missing")
+
+		_, err := parseConfig([]byte(`
+listen_address: ${KRAKEN_PROXY_TEST_UNSET}
+registries:
+  - address: registry.example.com
+    redirects:
+      - address: mirror.example.com
+        security:
+          basic:
+            password: ${file:`+missingPath+`}
+log_level: ${KRAKEN_PROXY_TEST_USER
+`), "config.yml")
+		require.Error(t, err)
+
+		errs, ok := errors.Cause(err).(ConfigErrors)
+		require.True(t, ok)
+		require.Len(t, errs, 3)
+		assert.Contains(t, errs[0].Error(), `listen_address: environment variable "KRAKEN_PROXY_TEST_UNSET" is not set`)
+		assert.Contains(t, errs[1].Error(), "log_level: unterminated reference")
+		assert.Contains(t, errs[2].Error(), "registries[0].redirects[0].security.basic.password: unable to read secret file")
+	})
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigReloader reloads the config file when asked to with Reload, e.g. on SIGHUP, and when it or the
+// files it includes or imports change on disk if the config sets a watch interval.
+// New configs are swapped into the DockerRegistryHijacker if they're valid, and rejected otherwise, in which
+// case the current config stays in effect.
+type ConfigReloader struct {
+	path     string
+	hijacker *DockerRegistryHijacker
+	// used to report reloads, can be nil
+	proxy *MitmProxy
+	// from the initial config, like all settings other than the registries
+	watchInterval          time.Duration
+	secretsRefreshInterval time.Duration
+
+	current *Config
+	// the last config successfully parsed from the file, whether it was then accepted or not
+	lastParsed *Config
+	// of the last contents of the config file and the files it gets registries from we've tried to load
+	checksum [sha256.Size]byte
+	mutex    sync.Mutex
+
+	stop chan interface{}
+}
+
+// NewConfigReloader expects config to be what's currently loaded from path.
+func NewConfigReloader(path string, config *Config, hijacker *DockerRegistryHijacker, proxy *MitmProxy) *ConfigReloader {
+	reloader := &ConfigReloader{
+		path:                   path,
+		hijacker:               hijacker,
+		proxy:                  proxy,
+		watchInterval:          config.ConfigWatchInterval,
+		secretsRefreshInterval: config.SecretsRefreshInterval,
+		current:                config,
+		lastParsed:             config,
+		stop:                   make(chan interface{}),
+	}
+
+	if bytes, err := ioutil.ReadFile(path); err == nil {
+		reloader.checksum = reloader.sourcesChecksum(bytes)
+	}
+
+	return reloader
+}
+
+// Start watches the config file for changes, and re-reads the secret files it references, if the config
+// sets intervals for those; it's a blocking call until Stop gets called, but returns right away if there's
+// nothing to watch.
+func (r *ConfigReloader) Start() {
+	if r.watchInterval == 0 && r.secretsRefreshInterval == 0 {
+		return
+	}
+
+	// a nil channel never fires
+	var watchTicks, secretsTicks <-chan time.Time
+	if r.watchInterval != 0 {
+		log.Infof("Watching %q for changes every %v", r.path, r.watchInterval)
+		ticker := time.NewTicker(r.watchInterval)
+		defer ticker.Stop()
+		watchTicks = ticker.C
+	}
+	if r.secretsRefreshInterval != 0 {
+		log.Infof("Refreshing secrets referenced in %q every %v", r.path, r.secretsRefreshInterval)
+		ticker := time.NewTicker(r.secretsRefreshInterval)
+		defer ticker.Stop()
+		secretsTicks = ticker.C
+	}
+
+	for {
+		select {
+		case <-watchTicks:
+			r.reloadIfChanged()
+		case <-secretsTicks:
+			r.refreshSecrets()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *ConfigReloader) Stop() {
+	close(r.stop)
+}
+
+// Reload reloads the config file, whether it's changed or not.
+func (r *ConfigReloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bytes, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		err = errors.Wrapf(err, "unable to read file %q", r.path)
+	}
+	return r.reload(bytes, err)
+}
+
+// Current returns the config currently in effect.
+func (r *ConfigReloader) Current() *Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.current
+}
+
+func (r *ConfigReloader) reloadIfChanged() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bytes, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		log.Warnf("Unable to check %q for changes: %v", r.path, err)
+		return
+	}
+	if r.sourcesChecksum(bytes) == r.checksum {
+		return
+	}
+
+	log.Infof("%q has changed, reloading it", r.path)
+	// errors already get logged
+	_ = r.reload(bytes, nil)
+}
+
+// refreshSecrets re-expands the config file as it was last loaded, and reloads it if that yields a different
+// config, i.e. if any of the secret files it references has changed.
+func (r *ConfigReloader) refreshSecrets() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bytes, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		log.Warnf("Unable to refresh secrets referenced in %q: %v", r.path, err)
+		return
+	}
+	if r.sourcesChecksum(bytes) != r.checksum {
+		// the files themselves have changed, that's for reloadIfChanged or SIGHUP to pick up
+		return
+	}
+
+	config, err := parseConfig(bytes, r.path)
+	if err != nil {
+		log.Warnf("Unable to refresh secrets referenced in %q: %v", r.path, err)
+		return
+	}
+	if reflect.DeepEqual(config, r.lastParsed) {
+		return
+	}
+
+	log.Infof("Secrets referenced in %q have changed, reloading it", r.path)
+	// errors already get logged
+	_ = r.reload(bytes, nil)
+}
+
+// reload must be called with the mutex held; readErr is the error from reading the file, if any.
+func (r *ConfigReloader) reload(bytes []byte, readErr error) (err error) {
+	defer func() {
+		if err == nil {
+			log.Infof("Reloaded config from %q", r.path)
+		} else {
+			log.Errorf("Rejected new config from %q, keeping the current one: %v", r.path, err)
+		}
+		if r.proxy != nil {
+			r.proxy.CountConfigReload(err)
+		}
+	}()
+
+	if readErr != nil {
+		return readErr
+	}
+	config, err := parseConfig(bytes, r.path)
+	if err == nil {
+		r.lastParsed = config
+	}
+	// after updating lastParsed, in case the include glob has changed
+	r.checksum = r.sourcesChecksum(bytes)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	// all other settings keep their running values, including the upstream ones: the proxy can't pick up
+	// new ones, and registries need to go through the same upstream proxy as the rest of the traffic
+	effective := withReloadedRegistries(r.current, config)
+	if err := r.hijacker.ReloadConfig(effective); err != nil {
+		return errors.Wrap(err, "invalid registries")
+	}
+
+	if !reflect.DeepEqual(withoutReloadableSettings(config), withoutReloadableSettings(r.current)) {
+		log.Warnf("Only the registries get reloaded from %q, other changes will only take effect after a restart", r.path)
+	}
+
+	r.current = effective
+	return nil
+}
+
+// sourcesChecksum returns a checksum of bytes, the contents of the config file, and of the files it includes
+// or imports registries from, as of the last config parsed, so that changes to any of them can be detected.
+func (r *ConfigReloader) sourcesChecksum(bytes []byte) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write(bytes)
+
+	// errors will surface when reloading
+	paths, _ := r.lastParsed.sourceFiles(r.path)
+	for _, path := range paths {
+		contents, _ := ioutil.ReadFile(path)
+		fmt.Fprintf(hash, "\x00%s\x00%d\x00", path, len(contents))
+		hash.Write(contents)
+	}
+
+	var checksum [sha256.Size]byte
+	copy(checksum[:], hash.Sum(nil))
+	return checksum
+}
+
+// withReloadedRegistries returns a shallow copy of running, with the settings ReloadConfig applies taken
+// from reloaded.
+func withReloadedRegistries(running, reloaded *Config) *Config {
+	result := *running
+	result.Registries = reloaded.Registries
+	result.Include = reloaded.Include
+	result.Import = reloaded.Import
+	return &result
+}
+
+// withoutReloadableSettings returns a shallow copy of config, without the settings ReloadConfig applies.
+func withoutReloadableSettings(config *Config) Config {
+	result := *config
+	result.Registries = nil
+	result.Include = ""
+	result.Import = nil
+	return result
+}
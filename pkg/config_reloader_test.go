@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigReloader(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1)
+	defer registryCleanup()
+	redirect1Address, redirect1Cleanup := withDummyRegistry(t, 2, "ubuntu:16")
+	defer redirect1Cleanup()
+	redirect2Address, redirect2Cleanup := withDummyRegistry(t, 3, "ubuntu:16")
+	defer redirect2Cleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	ca, caCleanup := withTestCAFiles(t)
+	defer caCleanup()
+	registryConfig := func(redirectAddress string) string {
+		return testConfig(ca, registryAddress, redirectAddress)
+	}
+
+	configPath, configCleanup := withTestConfigFile(t, registryConfig(redirect1Address)+"config_watch_interval: 10ms\n")
+	defer configCleanup()
+	config, err := NewConfig(configPath)
+	require.NoError(t, err)
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	statsdClient := &testStatsdClient{}
+	proxy := NewMitmProxy("", nil, hijacker, statsdClient)
+
+	reloader := NewConfigReloader(configPath, config, hijacker, proxy)
+
+	servedBy := func(t *testing.T) string {
+		request := buildGetRequest(t, "http://"+registryAddress+"/v2/ubuntu/blobs/16")
+		_, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		require.NoError(t, err)
+		return string(readResponseBody(t, response))
+	}
+	reloads := func(metricName MitmProxyStatsdMetricName) []statsdCall {
+		return []statsdCall{{methodName: "Inc", stat: string(metricName), valueInt: 1, rate: 1}}
+	}
+
+	require.Equal(t, "from registry 2: blobs for ubuntu:16", servedBy(t))
+
+	t.Run("it swaps in valid configs", func(t *testing.T) {
+		writeTestConfigFile(t, configPath, registryConfig(redirect2Address))
+
+		require.NoError(t, reloader.Reload())
+
+		assert.Equal(t, "from registry 3: blobs for ubuntu:16", servedBy(t))
+		assert.Equal(t, redirect2Address, reloader.Current().Registries[0].Redirects[0].Address)
+		assert.Equal(t, reloads(ConfigReloadCounter), statsdClient.reset())
+	})
+
+	t.Run("the upstream settings stay the running ones", func(t *testing.T) {
+		// nothing listens there
+		upstreamProxy := "http://" + localhostAddr(getAvailablePort(t))
+		writeTestConfigFile(t, configPath, registryConfig(redirect2Address)+"upstream_proxy:\n  url: "+upstreamProxy+"\n")
+
+		require.NoError(t, reloader.Reload())
+
+		assert.Equal(t, "from registry 3: blobs for ubuntu:16", servedBy(t))
+		assert.Nil(t, reloader.Current().UpstreamProxy)
+		assert.Equal(t, reloads(ConfigReloadCounter), statsdClient.reset())
+	})
+
+	t.Run("it rejects invalid configs", func(t *testing.T) {
+		for _, invalidConfig := range []string{
+			"not: [yaml",
+			registryConfig(redirect1Address) + "unknown_field: true\n",
+			registryConfig("http://" + redirect1Address),
+		} {
+			writeTestConfigFile(t, configPath, invalidConfig)
+
+			assert.Error(t, reloader.Reload())
+
+			// the previous config is still in effect
+			assert.Equal(t, "from registry 3: blobs for ubuntu:16", servedBy(t))
+			assert.Equal(t, redirect2Address, reloader.Current().Registries[0].Redirects[0].Address)
+			assert.Equal(t, reloads(ConfigReloadFailureCounter), statsdClient.reset())
+		}
+	})
+
+	t.Run("it reloads the config when it changes", func(t *testing.T) {
+		go reloader.Start()
+		defer reloader.Stop()
+
+		// still the invalid config from the previous sub-test, which doesn't get reloaded again
+		time.Sleep(100 * time.Millisecond)
+		assert.Empty(t, statsdClient.reset())
+
+		writeTestConfigFile(t, configPath, registryConfig(redirect1Address))
+
+		deadline := time.Now().Add(genericTestTimeout)
+		for servedBy(t) != "from registry 2: blobs for ubuntu:16" {
+			require.True(t, time.Now().Before(deadline), "Timed out waiting for the config to be reloaded")
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, reloads(ConfigReloadCounter), statsdClient.reset())
+	})
+
+	t.Run("it picks up rotated secrets", func(t *testing.T) {
+		secretPath := filepath.Join(filepath.Dir(configPath), "password")
+		writeTestConfigFile(t, secretPath, "hunter2\n")
+
+		writeTestConfigFile(t, configPath, registryConfig(redirect1Address)+`          basic:
+            username: alice
+            password: file:`+secretPath+`
+secrets_refresh_interval: 10ms
+`)
+		require.NoError(t, reloader.Reload())
+		assert.Equal(t, reloads(ConfigReloadCounter), statsdClient.reset())
+
+		// intervals are only read from the initial config
+		initialConfig, err := NewConfig(configPath)
+		require.NoError(t, err)
+		rotatingReloader := NewConfigReloader(configPath, initialConfig, hijacker, proxy)
+		go rotatingReloader.Start()
+		defer rotatingReloader.Stop()
+
+		password := func() string {
+			return rotatingReloader.Current().Registries[0].Redirects[0].Security.BasicAuth.Password
+		}
+		require.Equal(t, "hunter2", password())
+
+		// unchanged secrets don't trigger reloads
+		time.Sleep(100 * time.Millisecond)
+		assert.Empty(t, statsdClient.reset())
+
+		writeTestConfigFile(t, secretPath, "correct horse battery staple\n")
+
+		deadline := time.Now().Add(genericTestTimeout)
+		for password() != "correct horse battery staple" {
+			require.True(t, time.Now().Before(deadline), "Timed out waiting for the secret to be refreshed")
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, reloads(ConfigReloadCounter), statsdClient.reset())
+	})
+
+	t.Run("rotated upstream proxy secrets don't get picked up", func(t *testing.T) {
+		upstreamSecretPath := filepath.Join(filepath.Dir(configPath), "upstream-password")
+		writeTestConfigFile(t, upstreamSecretPath, "hunter2\n")
+		writeTestConfigFile(t, configPath, registryConfig(redirect1Address)+`upstream_proxy:
+  url: http://`+localhostAddr(getAvailablePort(t))+`
+  basic_auth:
+    username: alice
+    password: file:`+upstreamSecretPath+`
+`)
+		initialConfig, err := NewConfig(configPath)
+		require.NoError(t, err)
+		upstreamReloader := NewConfigReloader(configPath, initialConfig, hijacker, proxy)
+
+		writeTestConfigFile(t, upstreamSecretPath, "correct horse battery staple\n")
+		require.NoError(t, upstreamReloader.Reload())
+
+		assert.Equal(t, "hunter2", upstreamReloader.Current().UpstreamProxy.BasicAuth.Password)
+		assert.Equal(t, reloads(ConfigReloadCounter), statsdClient.reset())
+	})
+}
+
+/*** Helpers below ***/
+
+// testConfig returns a valid YAML config, with a single registry with a single redirect.
+func testConfig(ca *TLSInfo, registryAddress, redirectAddress string) string {
+	return fmt.Sprintf(`listen_address: localhost:0
+ca:
+  cert_path: %s
+  key_path: %s
+registries:
+  - address: %s
+    redirects:
+      - address: %s
+        security:
+          enableHTTPFallback: true
+`, ca.CertPath, ca.KeyPath, registryAddress, redirectAddress)
+}
+
+func withTestConfigFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "kraken-proxy-config")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "config.yml")
+	writeTestConfigFile(t, path, contents)
+
+	return path, func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}
+}
+
+func writeTestConfigFile(t *testing.T, path, contents string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+}
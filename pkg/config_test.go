@@ -20,11 +20,62 @@ ca:
   cert_path: /path/to/cert
   key_path: /path/to/key
 log_level: trace
+shutdown_grace_period: 45s
+config_watch_interval: 30s
 statsd:
   address: 127.0.0.1:9125
   prefix: kraken-proxy
   flush_interval: 10m
   flush_bytes: 1024
+  dogstatsd: true
+prometheus:
+  listen_address: :9090
+  path: /prom
+  namespace: kp
+upstream_proxy:
+  url: http://proxy.corp:3128
+  no_proxy:
+    - localhost
+    - .internal
+  basic_auth:
+    username: proxy_user
+    password: proxy_pwd
+upstream_connections:
+  max_conns_per_host: 4
+  max_idle_conns_per_host: 4
+  idle_conn_timeout: 2m
+  disable_http2: true
+transparent:
+  listen_address: :2829
+  default_upstream_port: 5000
+socks5:
+  listen_address: :1080
+access_control:
+  allowed_cidrs:
+    - 10.0.0.0/8
+    - 192.168.1.12
+  users_file: /path/to/users
+  tls:
+    cert_path: /path/to/proxy/cert
+    key_path: /path/to/proxy/key
+    client_ca_path: /path/to/client/ca
+tracing:
+  endpoint: otel-collector:4318
+  url_path: /traces
+  insecure: true
+  headers:
+    authorization: Bearer abc
+  service_name: kp
+  sample_ratio: 0.25
+access_log:
+  path: /var/log/kraken-proxy/access.log
+audit_log:
+  syslog:
+    network: udp
+    address: syslog.internal:514
+    tag: pulls
+admin:
+  listen_address: 127.0.0.1:9091
 registries:
   - address: docker.io
     timeout: 60s
@@ -56,18 +107,80 @@ registries:
 	config, err := NewConfig(tmpFile.Name())
 	require.NoError(t, err)
 
+	sampleRatio := 0.25
 	expectedConfig := &Config{
 		ListenAddress: ":2828",
 		CA: &TLSInfo{
 			CertPath: "/path/to/cert",
 			KeyPath:  "/path/to/key",
 		},
-		LogLevel: "trace",
+		LogLevel:            "trace",
+		ShutdownGracePeriod: 45 * time.Second,
+		ConfigWatchInterval: 30 * time.Second,
 		Statsd: &StatsdConfig{
 			Address:       "127.0.0.1:9125",
 			Prefix:        "kraken-proxy",
 			FlushInterval: 10 * time.Minute,
 			FlushBytes:    1024,
+			DogStatsD:     true,
+		},
+		Prometheus: &PrometheusConfig{
+			ListenAddress: ":9090",
+			Path:          "/prom",
+			Namespace:     "kp",
+		},
+		UpstreamProxy: &UpstreamProxyConfig{
+			URL:     "http://proxy.corp:3128",
+			NoProxy: []string{"localhost", ".internal"},
+			BasicAuth: &BasicAuthCredentials{
+				Username: "proxy_user",
+				Password: "proxy_pwd",
+			},
+		},
+		UpstreamConnections: &UpstreamConnectionsConfig{
+			MaxConnsPerHost:     4,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     2 * time.Minute,
+			DisableHTTP2:        true,
+		},
+		Transparent: &TransparentProxyConfig{
+			ListenAddress:       ":2829",
+			DefaultUpstreamPort: 5000,
+		},
+		Socks5: &Socks5ProxyConfig{
+			ListenAddress: ":1080",
+		},
+		AccessControl: &AccessControlConfig{
+			AllowedCIDRs: []string{"10.0.0.0/8", "192.168.1.12"},
+			UsersFile:    "/path/to/users",
+			TLS: &ListenerTLSConfig{
+				TLSInfo: TLSInfo{
+					CertPath: "/path/to/proxy/cert",
+					KeyPath:  "/path/to/proxy/key",
+				},
+				ClientCAPath: "/path/to/client/ca",
+			},
+		},
+		Tracing: &TracingConfig{
+			Endpoint:    "otel-collector:4318",
+			URLPath:     "/traces",
+			Insecure:    true,
+			Headers:     map[string]string{"authorization": "Bearer abc"},
+			ServiceName: "kp",
+			SampleRatio: &sampleRatio,
+		},
+		AccessLog: &AccessLogConfig{
+			Path: "/var/log/kraken-proxy/access.log",
+		},
+		AuditLog: &AuditLogConfig{
+			Syslog: &SyslogConfig{
+				Network: "udp",
+				Address: "syslog.internal:514",
+				Tag:     "pulls",
+			},
+		},
+		Admin: &AdminConfig{
+			ListenAddress: "127.0.0.1:9091",
 		},
 		Registries: []Registry{
 			{
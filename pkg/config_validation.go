@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/uber/kraken/lib/backend/registrybackend/security"
+)
+
+// the placeholders that can be used in rewrite_repositories.
+var rewriteRepositoriesPlaceholders = map[byte]bool{
+	'r': true,
+	't': true,
+}
+
+// ConfigErrors lists all the problems found when validating a config.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks that the config makes sense, beyond being well-formed; it returns all the problems it
+// finds at once, as ConfigErrors.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	addErr := func(field string, err error) {
+		errs = append(errs, errors.Wrap(err, field))
+	}
+
+	if err := validateListenAddress(c.ListenAddress); err != nil {
+		addErr("listen_address", err)
+	}
+
+	if c.CA == nil {
+		addErr("ca", errors.New("missing"))
+	} else if err := validateCA(c.CA); err != nil {
+		addErr("ca", err)
+	}
+
+	if c.LogLevel != "" {
+		if _, err := log.ParseLevel(c.LogLevel); err != nil {
+			addErr("log_level", err)
+		}
+	}
+
+	// maps addresses to the registries defining them
+	addresses := make(map[string]*Registry, len(c.Registries))
+	for i := range c.Registries {
+		registry := &c.Registries[i]
+		field := fmt.Sprintf("registries[%d]", i)
+		if registry.source != "" {
+			field += fmt.Sprintf(" (from %q)", registry.source)
+		}
+
+		if err := validateRegistryAddress(registry.Address); err != nil {
+			addErr(field+".address", err)
+		} else if previous, present := addresses[registry.Address]; present {
+			addErr(field+".address", duplicateRegistryError(registry, previous))
+		} else {
+			addresses[registry.Address] = registry
+		}
+
+		if registry.MatchingRegex != "" {
+			if _, err := regexp.Compile(registry.MatchingRegex); err != nil {
+				addErr(field+".matching_regex", err)
+			}
+		}
+
+		if err := validateCredentials(registry.Credentials, registry.Security); err != nil {
+			addErr(field+".credentials", err)
+		}
+		if registry.ClientAuth != nil && registry.ClientAuth.CacheTTL < 0 {
+			addErr(field+".client_auth.cache_ttl", errors.New("cannot be negative"))
+		}
+		if registry.ClientAuth != nil && registry.ClientAuth.CacheSize < 0 {
+			addErr(field+".client_auth.cache_size", errors.New("cannot be negative"))
+		}
+
+		if len(registry.Redirects) == 0 {
+			addErr(field+".redirects", errors.New("missing"))
+		}
+		for j, redirect := range registry.Redirects {
+			redirectField := fmt.Sprintf("%s.redirects[%d]", field, j)
+
+			if err := validateRegistryAddress(redirect.Address); err != nil {
+				addErr(redirectField+".address", err)
+			}
+			if err := validateRewriteRepositories(redirect.RewriteRepositories); err != nil {
+				addErr(redirectField+".rewrite_repositories", err)
+			}
+			if err := validateCredentials(redirect.Credentials, redirect.Security); err != nil {
+				addErr(redirectField+".credentials", err)
+			}
+			if redirect.ClientCredentials != "" && !clientCredentialsPolicies[redirect.ClientCredentials] {
+				addErr(redirectField+".client_credentials", errors.Errorf("unknown policy %q, must be one of %s, %s or %s",
+					redirect.ClientCredentials, StripClientCredentials, PassClientCredentials, MapClientCredentials))
+			} else if redirect.ClientCredentials == MapClientCredentials && registry.ClientAuth == nil {
+				// otherwise any Authorization header would get our own credentials used on the client's behalf
+				addErr(redirectField+".client_credentials", errors.Errorf("%s requires client_auth on the registry, "+
+					"so that clients' credentials get checked", MapClientCredentials))
+			}
+		}
+	}
+
+	if c.Mirror != nil {
+		if err := validateListenAddress(c.Mirror.ListenAddress); err != nil {
+			addErr("mirror.listen_address", err)
+		}
+		if c.Mirror.TLS == nil && c.AccessControl != nil && c.AccessControl.TLS != nil && c.AccessControl.TLS.ClientCAPath != "" {
+			addErr("mirror.tls", errors.New("required with access_control.tls.client_ca_path, to check clients' certificates"))
+		}
+	}
+
+	if c.Prometheus != nil {
+		if err := validateListenAddress(c.Prometheus.ListenAddress); err != nil {
+			addErr("prometheus.listen_address", err)
+		}
+	}
+
+	if c.UpstreamProxy != nil {
+		// the URL's parsed the same way the upstream dialer does
+		if _, err := newUpstreamDialer(&UpstreamProxyConfig{URL: c.UpstreamProxy.URL}, nil); err != nil {
+			addErr("upstream_proxy.url", err)
+		}
+		for i, entry := range c.UpstreamProxy.NoProxy {
+			if _, err := parseNoProxyRule(entry); err != nil {
+				addErr(fmt.Sprintf("upstream_proxy.no_proxy[%d]", i), err)
+			}
+		}
+	}
+
+	if c.Transparent != nil {
+		if err := validateListenAddress(c.Transparent.ListenAddress); err != nil {
+			addErr("transparent.listen_address", err)
+		}
+	}
+
+	if c.Socks5 != nil {
+		if err := validateListenAddress(c.Socks5.ListenAddress); err != nil {
+			addErr("socks5.listen_address", err)
+		}
+	}
+
+	if c.AccessControl != nil {
+		for i, entry := range c.AccessControl.AllowedCIDRs {
+			if _, err := parseCIDROrIP(entry); err != nil {
+				addErr(fmt.Sprintf("access_control.allowed_cidrs[%d]", i), err)
+			}
+		}
+		if c.AccessControl.UsersFile != "" {
+			if _, err := loadUsersFile(c.AccessControl.UsersFile); err != nil {
+				addErr("access_control.users_file", err)
+			}
+		}
+	}
+
+	if c.Tracing != nil && c.Tracing.SampleRatio != nil {
+		if ratio := *c.Tracing.SampleRatio; ratio < 0 || ratio > 1 {
+			addErr("tracing.sample_ratio", errors.Errorf("%v is not between 0 and 1", ratio))
+		}
+	}
+
+	if c.AuditLog != nil && (c.AuditLog.Path == "") == (c.AuditLog.Syslog == nil) {
+		addErr("audit_log", errors.New("exactly one of path and syslog is required"))
+	}
+
+	if c.Admin != nil && c.Admin.ReadinessProbeInterval < 0 {
+		addErr("admin.readiness_probe_interval", errors.New("cannot be negative"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func duplicateRegistryError(registry, previous *Registry) error {
+	if registry.source == "" && previous.source == "" {
+		return errors.Errorf("duplicate registry %q", registry.Address)
+	}
+
+	previousSource := "the main config file"
+	if previous.source != "" {
+		previousSource = fmt.Sprintf("%q", previous.source)
+	}
+	return errors.Errorf("duplicate registry %q, already defined in %s", registry.Address, previousSource)
+}
+
+// validateCredentials checks that credentials, if any, come from exactly one place.
+func validateCredentials(credentials *CredentialsConfig, securityConfig security.Config) error {
+	if credentials == nil {
+		return nil
+	}
+
+	if (credentials.DockerConfig == "") == (credentials.Helper == "") {
+		return errors.New("exactly one of docker_config and helper is required")
+	}
+	if credentials.TTL < 0 {
+		return errors.New("ttl cannot be negative")
+	}
+	if securityConfig.BasicAuth != nil || securityConfig.RemoteCredentialsStore != "" {
+		return errors.New("exclusive with the security block's basic and credsStore")
+	}
+	return nil
+}
+
+// validateListenAddress checks that address is a [host]:port address.
+func validateListenAddress(address string) error {
+	if address == "" {
+		return errors.New("missing")
+	}
+	_, _, err := net.SplitHostPort(address)
+	return err
+}
+
+// validateCA checks that the CA files exist, match, and are indeed for a CA.
+func validateCA(ca *TLSInfo) error {
+	for _, path := range []string{ca.CertPath, ca.KeyPath} {
+		if path == "" {
+			return errors.New("both cert_path and key_path are required")
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(ca.CertPath, ca.KeyPath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !leaf.IsCA {
+		return errors.Errorf("%q is not a CA certificate", ca.CertPath)
+	}
+	return nil
+}
+
+// validateRegistryAddress checks that address is a host, with an optional port.
+func validateRegistryAddress(address string) error {
+	if address == "" {
+		return errors.New("missing")
+	}
+
+	parsed, err := url.Parse("//" + address)
+	if err != nil {
+		return err
+	}
+	if parsed.Host != address || parsed.Hostname() == "" {
+		return errors.Errorf("%q is not a host[:port] address", address)
+	}
+	return nil
+}
+
+// validateRewriteRepositories checks that rule only uses known placeholders.
+func validateRewriteRepositories(rule string) error {
+	for i := 0; i < len(rule); i++ {
+		if rule[i] != '%' {
+			continue
+		}
+		if i+1 == len(rule) || !rewriteRepositoriesPlaceholders[rule[i+1]] {
+			return errors.Errorf("invalid placeholder in %q at position %d, only %%r and %%t are supported", rule, i)
+		}
+		i++
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
+)
+
+func TestConfigValidate(t *testing.T) {
+	ca, caCleanup := withTestCAFiles(t)
+	defer caCleanup()
+	serverTLSInfo, serverTLSCleanup := withTestServerTLSFiles(t)
+	defer serverTLSCleanup()
+
+	validConfig := func() *Config {
+		return &Config{
+			ListenAddress: ":8080",
+			CA:            ca,
+			LogLevel:      "debug",
+			Registries: []Registry{
+				{
+					Config:        krakenConfig("docker.io"),
+					MatchingRegex: `.*\.docker\.io`,
+					Redirects: []RedirectRegistry{
+						{Config: krakenConfig("localhost:5000"), RewriteRepositories: "mirror/%r:%t"},
+						{Config: krakenConfig("kraken.internal")},
+					},
+				},
+				{
+					Config:    krakenConfig("quay.io"),
+					Redirects: []RedirectRegistry{{Config: krakenConfig("localhost:5000")}},
+				},
+			},
+		}
+	}
+
+	t.Run("valid config", func(t *testing.T) {
+		assert.NoError(t, validConfig().Validate())
+	})
+
+	for _, testCase := range []struct {
+		name           string
+		modify         func(config *Config)
+		expectedErrors []string
+	}{
+		{
+			name: "missing listen address and CA",
+			modify: func(config *Config) {
+				config.ListenAddress = ""
+				config.CA = nil
+			},
+			expectedErrors: []string{"listen_address: missing", "ca: missing"},
+		},
+		{
+			name: "CA files that don't exist",
+			modify: func(config *Config) {
+				config.CA = &TLSInfo{CertPath: filepath.Join(filepath.Dir(ca.CertPath), "nope"), KeyPath: ca.KeyPath}
+			},
+			expectedErrors: []string{"ca: stat " + filepath.Join(filepath.Dir(ca.CertPath), "nope") + ": no such file or directory"},
+		},
+		{
+			name: "CA files that don't match",
+			modify: func(config *Config) {
+				config.CA = &TLSInfo{CertPath: ca.CertPath, KeyPath: serverTLSInfo.KeyPath}
+			},
+			expectedErrors: []string{"ca: tls: private key does not match public key"},
+		},
+		{
+			name: "a cert that's not a CA",
+			modify: func(config *Config) {
+				config.CA = serverTLSInfo
+			},
+			expectedErrors: []string{"ca: \"" + serverTLSInfo.CertPath + "\" is not a CA certificate"},
+		},
+		{
+			name: "invalid registries",
+			modify: func(config *Config) {
+				config.LogLevel = "chatty"
+				config.Registries[0].MatchingRegex = "(["
+				config.Registries[0].Redirects[0].Address = "http://localhost:5000"
+				config.Registries[0].Redirects[0].RewriteRepositories = "mirror/%r:%"
+				config.Registries[0].Redirects[1].RewriteRepositories = "%d"
+				config.Registries[0].Redirects[0].ClientCredentials = MapClientCredentials
+				config.Registries[0].Redirects[1].ClientCredentials = "forward"
+				config.Registries[1].Address = "docker.io"
+				config.Registries[1].Redirects = nil
+				config.Registries[1].ClientAuth = &ClientAuthConfig{CacheTTL: -time.Second, CacheSize: -1}
+				config.Registries[1].Credentials = &CredentialsConfig{Helper: "ecr-login", DockerConfig: "/root/.docker/config.json"}
+			},
+			expectedErrors: []string{
+				`log_level: not a valid logrus Level: "chatty"`,
+				"registries[0].matching_regex: error parsing regexp: missing closing ]: `[`",
+				`registries[0].redirects[0].address: "http://localhost:5000" is not a host[:port] address`,
+				`registries[0].redirects[0].rewrite_repositories: invalid placeholder in "mirror/%r:%" at position 10, only %r and %t are supported`,
+				"registries[0].redirects[0].client_credentials: map requires client_auth on the registry, so that clients' credentials get checked",
+				`registries[0].redirects[1].rewrite_repositories: invalid placeholder in "%d" at position 0, only %r and %t are supported`,
+				`registries[0].redirects[1].client_credentials: unknown policy "forward", must be one of strip, passthrough or map`,
+				`registries[1].address: duplicate registry "docker.io"`,
+				"registries[1].credentials: exactly one of docker_config and helper is required",
+				"registries[1].client_auth.cache_ttl: cannot be negative",
+				"registries[1].client_auth.cache_size: cannot be negative",
+				"registries[1].redirects: missing",
+			},
+		},
+		{
+			name: "a mirror without a listen address",
+			modify: func(config *Config) {
+				config.Mirror = &MirrorConfig{DefaultRegistry: "docker.io"}
+			},
+			expectedErrors: []string{"mirror.listen_address: missing"},
+		},
+		{
+			name: "a plain HTTP mirror with a client CA",
+			modify: func(config *Config) {
+				config.Mirror = &MirrorConfig{ListenAddress: ":5000"}
+				config.AccessControl = &AccessControlConfig{TLS: &ListenerTLSConfig{ClientCAPath: "/etc/kraken-proxy/ca.pem"}}
+			},
+			expectedErrors: []string{"mirror.tls: required with access_control.tls.client_ca_path, to check clients' certificates"},
+		},
+		{
+			name: "invalid listen addresses",
+			modify: func(config *Config) {
+				config.Prometheus = &PrometheusConfig{}
+				config.Transparent = &TransparentProxyConfig{ListenAddress: "8443"}
+				config.Socks5 = &Socks5ProxyConfig{ListenAddress: "localhost"}
+			},
+			expectedErrors: []string{
+				"prometheus.listen_address: missing",
+				"transparent.listen_address: address 8443: missing port in address",
+				"socks5.listen_address: address localhost: missing port in address",
+			},
+		},
+		{
+			name: "an invalid upstream proxy",
+			modify: func(config *Config) {
+				config.UpstreamProxy = &UpstreamProxyConfig{
+					URL:     "socks5://proxy.corp:1080",
+					NoProxy: []string{".internal", "*."},
+				}
+			},
+			expectedErrors: []string{
+				`upstream_proxy.url: unsupported upstream proxy scheme "socks5", only http and https are supported`,
+				`upstream_proxy.no_proxy[1]: invalid no_proxy entry "*."`,
+			},
+		},
+		{
+			name: "invalid access control",
+			modify: func(config *Config) {
+				config.AccessControl = &AccessControlConfig{
+					AllowedCIDRs: []string{"10.0.0.0/8", "10.0.0.0/33"},
+					UsersFile:    "/does/not/exist",
+				}
+			},
+			expectedErrors: []string{
+				`access_control.allowed_cidrs[1]: invalid CIDR or IP "10.0.0.0/33"`,
+				`access_control.users_file: unable to open users file "/does/not/exist": open /does/not/exist: no such file or directory`,
+			},
+		},
+		{
+			name: "an out of range sample ratio",
+			modify: func(config *Config) {
+				ratio := 1.5
+				config.Tracing = &TracingConfig{Endpoint: "localhost:4318", SampleRatio: &ratio}
+			},
+			expectedErrors: []string{"tracing.sample_ratio: 1.5 is not between 0 and 1"},
+		},
+		{
+			name: "an audit log with both a path and syslog",
+			modify: func(config *Config) {
+				config.AuditLog = &AuditLogConfig{Path: "/var/log/kraken-proxy/audit.log", Syslog: &SyslogConfig{}}
+			},
+			expectedErrors: []string{"audit_log: exactly one of path and syslog is required"},
+		},
+		{
+			name: "an audit log with neither a path nor syslog",
+			modify: func(config *Config) {
+				config.AuditLog = &AuditLogConfig{MaxSizeMB: 10}
+			},
+			expectedErrors: []string{"audit_log: exactly one of path and syslog is required"},
+		},
+		{
+			name: "a negative readiness probe interval",
+			modify: func(config *Config) {
+				config.Admin = &AdminConfig{ListenAddress: ":8081", ReadinessProbeInterval: -time.Second}
+			},
+			expectedErrors: []string{"admin.readiness_probe_interval: cannot be negative"},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := validConfig()
+			testCase.modify(config)
+
+			err := config.Validate()
+			require.Error(t, err)
+
+			configErrors, ok := err.(ConfigErrors)
+			require.True(t, ok)
+			messages := make([]string, 0, len(configErrors))
+			for _, configErr := range configErrors {
+				messages = append(messages, configErr.Error())
+			}
+			assert.Equal(t, testCase.expectedErrors, messages)
+		})
+	}
+}
+
+func TestNewConfigRejectsUnknownFields(t *testing.T) {
+	path, cleanup := withTestConfigFile(t, "listen_address: :8080\nlisten_adress: :8081\n")
+	defer cleanup()
+
+	_, err := NewConfig(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "field listen_adress not found")
+}
+
+/*** Helpers below ***/
+
+func krakenConfig(address string) krakenconfig.Config {
+	return krakenconfig.Config{Address: address}
+}
@@ -1,15 +1,23 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/uber/kraken/lib/backend/registrybackend"
 	"github.com/uber/kraken/lib/backend/registrybackend/security"
 	"github.com/uber/kraken/utils/httputil"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,37 +25,86 @@ import (
 // DockerRegistryHijacker is an implementation of MitmHijacker to be used to hijack queries to
 // docker registries, and redirect them to Kraken.
 type DockerRegistryHijacker struct {
-	registries []*hijackedRegistry
+	// holds the current []*hijackedRegistry, swapped atomically when the config gets reloaded
+	registries atomic.Value
+	auditLog   *AuditLog
+}
+
+type DockerRegistryHijackerOption func(h *DockerRegistryHijacker)
+
+// WithAuditLog makes the DockerRegistryHijacker record every image manifest it serves to auditLog.
+func WithAuditLog(auditLog *AuditLog) DockerRegistryHijackerOption {
+	return func(h *DockerRegistryHijacker) {
+		h.auditLog = auditLog
+	}
 }
 
 type hijackedRegistry struct {
 	*registryClient
 	matchingRegex *regexp.Regexp
 	redirects     []*redirectRegistry
+	// nil unless clients need to authenticate to the registry themselves
+	clientAuth *clientAuthorizer
 }
 
 type registryClient struct {
 	*registrybackend.Config
+	// nil if the credentials come from the security block
+	credentials   *CredentialsConfig
+	transport     *http.Transport
 	authenticator security.Authenticator
 }
 
 type redirectRegistry struct {
 	*registryClient
 	rewriteRepositories string
+	clientCredentials   ClientCredentialsPolicy
+	// canonical keys of the client's headers never to forward
+	strippedHeaders map[string]bool
 }
 
-func newRegistryClient(config registrybackend.Config) (*registryClient, error) {
-	authenticator, err := authenticatorFactory(config)
+func newRegistryClient(config registrybackend.Config, credentials *CredentialsConfig, dialer *upstreamDialer) (*registryClient, error) {
+	transport := newRegistryTransport(config, dialer)
+
+	var authenticator security.Authenticator
+	var err error
+	if credentials == nil {
+		authenticator, err = authenticatorFactory(config, transport)
+	} else {
+		authenticator, err = newTokenAuthenticator(config, newRefreshingCredentialStore(config.Address, credentials), transport)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to build authenticator")
 	}
 
 	return &registryClient{
 		Config:        &config,
+		credentials:   credentials,
+		transport:     transport,
 		authenticator: authenticator,
 	}, nil
 }
 
+// same as what registrybackend.Config.Authenticator does, except that it goes through the upstream
+// proxy, if any.
+func newRegistryTransport(config registrybackend.Config, dialer *upstreamDialer) *http.Transport {
+	transport := dialer.newTransport()
+
+	if config.ConnectTimeout != 0 {
+		netDialer := &net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: defaultUpstreamKeepAlive,
+		}
+		transport.DialContext = netDialer.DialContext
+	}
+
+	if config.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+
+	return transport
+}
+
 const (
 	manifestQuery registryQueryType = "manifest"
 	blobQuery     registryQueryType = "blob"
@@ -55,8 +112,28 @@ const (
 
 type registryQueryType string
 
+// the values of the OutcomeLabel for registry queries.
+const (
+	// served by one of the redirects
+	redirectedOutcome = "redirected"
+	// served by the original registry, after all redirects failed
+	originOutcome = "origin"
+	// neither the redirects nor the original registry could serve it
+	failedOutcome = "failed"
+)
+
+// the header registries use to tell the digest of manifests
+const dockerContentDigestHeader = "Docker-Content-Digest"
+
+// the name of the DogStatsD tag for the registry a request is addressed to.
+const registryTag = "registry"
+
+// the value of the StatusClassLabel when a registry didn't respond at all.
+const errorStatusClass = "error"
+
 var (
-	_ MitmHijacker = &DockerRegistryHijacker{}
+	_ MitmHijacker              = &DockerRegistryHijacker{}
+	_ ForwardedResponseObserver = &DockerRegistryHijacker{}
 
 	// $1 is the repository,
 	// $2 is the query type,
@@ -65,29 +142,58 @@ var (
 		strings.Join([]string{string(manifestQuery), string(blobQuery)}, "|")))
 
 	// allows overriding in tests.
-	authenticatorFactory = func(config registrybackend.Config) (security.Authenticator, error) {
-		return config.Authenticator()
+	authenticatorFactory = func(config registrybackend.Config, transport *http.Transport) (security.Authenticator, error) {
+		return newTokenAuthenticator(config, securityCredentialStore(config), transport)
 	}
 )
 
 // returns a *MitmHijacker to be used to hijack queries to docker registries, and redirect them
 // to Kraken.
-func NewDockerRegistryHijacker(config *Config) (*DockerRegistryHijacker, error) {
+func NewDockerRegistryHijacker(config *Config, opts ...DockerRegistryHijackerOption) (*DockerRegistryHijacker, error) {
 	registries, err := buildRegistryWrappers(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &DockerRegistryHijacker{
-		registries: registries,
-	}, nil
+	hijacker := &DockerRegistryHijacker{}
+	hijacker.registries.Store(registries)
+	for _, opt := range opts {
+		opt(hijacker)
+	}
+
+	return hijacker, nil
+}
+
+// ReloadConfig swaps in the registries from config; requests already being handled keep using the
+// previous ones.
+func (h *DockerRegistryHijacker) ReloadConfig(config *Config) error {
+	registries, err := buildRegistryWrappers(config)
+	if err != nil {
+		return err
+	}
+
+	previous := h.currentRegistries()
+	h.registries.Store(registries)
+	closeIdleConnections(previous)
+
+	return nil
+}
+
+func (h *DockerRegistryHijacker) currentRegistries() []*hijackedRegistry {
+	registries, _ := h.registries.Load().([]*hijackedRegistry)
+	return registries
 }
 
 func buildRegistryWrappers(config *Config) ([]*hijackedRegistry, error) {
+	dialer, err := newUpstreamDialer(config.UpstreamProxy, config.UpstreamConnections)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to set up upstream proxy")
+	}
+
 	registries := make([]*hijackedRegistry, 0, len(config.Registries))
 
 	for _, registry := range config.Registries {
-		client, err := newRegistryClient(registry.Config)
+		client, err := newRegistryClient(registry.Config, registry.Credentials, dialer)
 		if err != nil {
 			return nil, err
 		}
@@ -98,20 +204,28 @@ func buildRegistryWrappers(config *Config) ([]*hijackedRegistry, error) {
 
 		redirects := make([]*redirectRegistry, 0, len(registry.Redirects))
 		for _, redirect := range registry.Redirects {
-			redirectClient, err := newRegistryClient(redirect.Config)
+			redirectClient, err := newRegistryClient(redirect.Config, redirect.Credentials, dialer)
 			if err != nil {
 				return nil, err
 			}
 
+			clientCredentials := redirect.ClientCredentials
+			if clientCredentials == "" {
+				clientCredentials = StripClientCredentials
+			}
+
 			redirects = append(redirects, &redirectRegistry{
 				registryClient:      redirectClient,
 				rewriteRepositories: redirect.RewriteRepositories,
+				clientCredentials:   clientCredentials,
+				strippedHeaders:     redirectStrippedHeaders(redirect.StripHeaders),
 			})
 		}
 
 		wrapper := &hijackedRegistry{
 			registryClient: client,
 			redirects:      redirects,
+			clientAuth:     newClientAuthorizer(registry.ClientAuth, client),
 		}
 
 		if len(registry.MatchingRegex) != 0 {
@@ -129,9 +243,19 @@ func buildRegistryWrappers(config *Config) ([]*hijackedRegistry, error) {
 	return registries, nil
 }
 
+// ShouldIntercept only intercepts transparent and SOCKS5 connections to configured registries.
+func (h *DockerRegistryHijacker) ShouldIntercept(address string) bool {
+	if h.findRegistry(address) != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	return err == nil && h.findRegistry(host) != nil
+}
+
 func (h *DockerRegistryHijacker) RequestHandler(responseWriter http.ResponseWriter, request *http.Request) (bool, *http.Response, error) {
-	if request.Method != "GET" {
-		// we don't proxy anything else, let it through
+	if request.Method != http.MethodGet && !(request.Method == http.MethodHead && isMirrorRequest(request)) {
+		// we don't proxy anything else, let it through; but mirror clients need HEAD requests to resolve
+		// manifests, since they can't go to the registry
 		return false, nil, nil
 	}
 
@@ -149,6 +273,11 @@ func (h *DockerRegistryHijacker) RequestHandler(responseWriter http.ResponseWrit
 	}
 
 	if path == "/v2" {
+		if registry.clientAuth != nil {
+			// clients need to get the registry's challenge to authenticate
+			return true, nil, registry.clientAuth.relayHandshake(responseWriter, request)
+		}
+
 		// initial handshake, we'll handle authentication to these registries ourselves
 		responseWriter.WriteHeader(http.StatusOK)
 		_, err := responseWriter.Write([]byte("{}"))
@@ -163,46 +292,234 @@ func (h *DockerRegistryHijacker) RequestHandler(responseWriter http.ResponseWrit
 		return false, nil, nil
 	}
 
-	requestHeaders := make(map[string]string)
-	for key := range request.Header {
-		requestHeaders[key] = request.Header.Get(key)
+	SetAccessLogField(request, RepositoryField, repository)
+	SetAccessLogField(request, ReferenceField, tag)
+	SetAccessLogField(request, QueryTypeField, string(queryType))
+
+	if registry.clientAuth != nil {
+		allowed, err := registry.clientAuth.authorize(responseWriter, request, repository, request.URL.Path)
+		if err != nil {
+			// the registry will check the client's credentials itself
+			return false, nil, err
+		}
+		if !allowed {
+			SetMetricLabel(request, OutcomeLabel, unauthorizedOutcome)
+			return true, nil, nil
+		}
 	}
 
-	tryRegistry := func(r *registryClient, rewriteRepoRule string) (*http.Response, error) {
+	authorization := request.Header.Get("Authorization")
+
+	// timeToFirstByte is measured from sending the request that produced the final response, i.e. without
+	// authenticating nor the rejected attempt if retrying with a new token, to getting its headers; it's
+	// zero if no request could be sent.
+	tryRegistry := func(r *registryClient, rewriteRepoRule string, clientCredentials ClientCredentialsPolicy,
+		strippedHeaders map[string]bool) (response *http.Response, timeToFirstByte time.Duration, err error) {
+
 		newRepository := rewriteRepository(rewriteRepoRule, repository, tag)
 
-		opts, err := r.authenticator.Authenticate(newRepository)
-		if err != nil {
-			log.Errorf("unable to authenticate to registry %q: %v", r.Address, err)
-			return nil, err
+		ctx, span := startSpan(request.Context(), "kraken-proxy.try_registry",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				registryAttribute.String(r.Address),
+				repositoryAttribute.String(newRepository),
+				referenceAttribute.String(tag),
+				queryTypeAttribute.String(string(queryType))))
+		defer func() {
+			if response != nil {
+				span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode))
+			}
+			endSpan(span, err)
+		}()
+
+		// preserve original request headers, except for the ones not meant for this registry
+		headers := forwardedHeaders(request, strippedHeaders)
+		delete(headers, "Authorization")
+
+		reportToken := func(name MitmProxyStatsdMetricName, labels MetricLabels) {
+			if r != registry.registryClient {
+				if labels == nil {
+					labels = MetricLabels{}
+				}
+				labels[RedirectLabel] = r.Address
+			}
+			AddToMetricCounter(request, name, 1, labels)
 		}
+
 		redirectURL := fmt.Sprintf("http://%s/v2/%s/%ss/%s", r.Address, newRepository, queryType, tag)
 
-		// preserve original request headers
-		opts = append(opts, httputil.SendHeaders(requestHeaders),
-			httputil.SendTimeout(r.Config.Timeout))
+		for attempt := 0; ; attempt++ {
+			opts, authenticated, err := credentialsOptions(ctx, r, newRepository, clientCredentials, authorization, headers, reportToken)
+			if err != nil {
+				log.Errorf("unable to authenticate to registry %q: %v", r.Address, err)
+				return nil, 0, err
+			}
 
-		response, err := httputil.Get(redirectURL, opts...)
-		if err != nil {
-			log.Warnf("Failed %s request to %s: %v", queryType, redirectURL, err)
+			// propagate the trace-context so that the redirect's spans join this trace
+			injectTraceContext(ctx, headers)
+			opts = append(opts, httputil.SendHeaders(headers),
+				httputil.SendTimeout(r.Config.Timeout))
+
+			sentAt := time.Now()
+			response, err = httputil.Send(request.Method, redirectURL, opts...)
+			timeToFirstByte = time.Since(sentAt)
+			if attempt == 0 && authenticated && httputil.IsStatus(err, http.StatusUnauthorized) && invalidateToken(r, newRepository) {
+				// the token might have been revoked, or the registry's clock be off
+				log.Debugf("%s rejected its token for %s, retrying with a new one", r.Address, newRepository)
+				continue
+			}
+			if err != nil {
+				log.Warnf("Failed %s request to %s: %v", queryType, redirectURL, err)
+			}
+			return response, timeToFirstByte, err
 		}
-		return response, err
 	}
 
-	for _, redirect := range registry.redirects {
-		response, err := tryRegistry(redirect.registryClient, redirect.rewriteRepositories)
+	for i, redirect := range registry.redirects {
+		SetAccessLogField(request, RedirectsTriedField, i+1)
+
+		response, timeToFirstByte, err := tryRegistry(redirect.registryClient, redirect.rewriteRepositories,
+			redirect.clientCredentials, redirect.strippedHeaders)
+
+		attemptLabels := MetricLabels{
+			RedirectLabel:    redirect.Address,
+			StatusClassLabel: statusClass(response, err),
+		}
+		AddToMetricCounter(request, RedirectAttemptCounter, 1, attemptLabels)
+		if timeToFirstByte != 0 {
+			ReportMetricDuration(request, RedirectTimeToFirstByte, timeToFirstByte, attemptLabels)
+		}
+
 		if err == nil {
 			// done
+			AddToMetricCounter(request, RedirectSuccessCounter, 1, attemptLabels)
+			response.Body = &redirectBodyReader{
+				ReadCloser: response.Body,
+				request:    request,
+				redirect:   redirect.Address,
+			}
+
+			SetMetricLabel(request, RedirectLabel, redirect.Address)
+			SetMetricLabel(request, OutcomeLabel, redirectedOutcome)
+			SetAccessLogField(request, RedirectField, redirect.Address)
+			h.audit(request, queryType, repository, tag, response.Header, redirectAuditSource, redirect.Address)
 			return true, response, nil
 		}
+		AddToMetricCounter(request, RedirectFailureCounter, 1, attemptLabels)
 	}
 
 	// unable to get it from any of the redirects, try & get it from the configured
 	// repository, otherwise let the proxy do its thing
-	response, err := tryRegistry(registry.registryClient, "")
+	AddToMetricCounter(request, OriginFallbackCounter, 1, nil)
+	response, _, err := tryRegistry(registry.registryClient, "", originClientCredentials, nil)
+	if err == nil {
+		SetMetricLabel(request, OutcomeLabel, originOutcome)
+		h.audit(request, queryType, repository, tag, response.Header, originAuditSource, "")
+	} else {
+		SetMetricLabel(request, OutcomeLabel, failedOutcome)
+	}
 	return true, response, err
 }
 
+// audit records manifests being served, if there's an audit log; redirect is empty unless served
+// by a redirect.
+func (h *DockerRegistryHijacker) audit(request *http.Request, queryType registryQueryType, repository, tag string, header http.Header, source, redirect string) {
+	if h.auditLog == nil || queryType != manifestQuery || request.Method != http.MethodGet {
+		return
+	}
+
+	record := &auditRecord{
+		Time:       time.Now().UTC(),
+		Client:     clientIP(request),
+		Registry:   request.Host,
+		Repository: repository,
+		Tag:        tag,
+		Digest:     header.Get(dockerContentDigestHeader),
+		Source:     source,
+		Redirect:   redirect,
+	}
+	if record.Digest == "" && strings.Contains(tag, ":") {
+		// pulled by digest
+		record.Digest = tag
+	}
+
+	if err := h.auditLog.record(record); err != nil {
+		log.Errorf("Unable to audit %s:%s being pulled by %s: %v", repository, tag, record.Client, err)
+	}
+}
+
+// ObserveForwardedResponse audits the manifests of the registries we proxy that upstream served,
+// after the hijacker failed to get them from both the redirects and the origin.
+func (h *DockerRegistryHijacker) ObserveForwardedResponse(request *http.Request, statusCode int, header http.Header) {
+	if h.auditLog == nil || statusCode < 200 || statusCode >= 300 || h.findRegistry(request.Host) == nil {
+		return
+	}
+
+	if isRegistryQuery, queryType, repository, tag := parseRegistryURLPath(request.URL.Path); isRegistryQuery {
+		h.audit(request, queryType, repository, tag, header, upstreamAuditSource, "")
+	}
+}
+
+// statusClass returns the class of the status code a registry responded with, e.g. "2xx", or
+// "error" if it didn't respond.
+func statusClass(response *http.Response, err error) string {
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	} else if statusErr, ok := err.(httputil.StatusError); ok {
+		status = statusErr.Status
+	}
+
+	if status == 0 {
+		return errorStatusClass
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// redirectBodyReader reports how many bytes were read from a redirect's response once it's closed.
+type redirectBodyReader struct {
+	io.ReadCloser
+	request  *http.Request
+	redirect string
+	read     int64
+}
+
+func (r *redirectBodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *redirectBodyReader) Close() error {
+	AddToMetricCounter(r.request, RedirectBytesCounter, r.read, MetricLabels{RedirectLabel: r.redirect})
+	return r.ReadCloser.Close()
+}
+
+// authenticate gets the options to authenticate to the registry, in its own span since that can
+// involve fetching tokens; report, which can be nil, gets told about the token cache.
+func authenticate(ctx context.Context, r *registryClient, repository string, report tokenMetricsReporter) ([]httputil.SendOption, error) {
+	_, span := startSpan(ctx, "kraken-proxy.authenticate", trace.WithAttributes(
+		registryAttribute.String(r.Address),
+		repositoryAttribute.String(repository)))
+
+	var opts []httputil.SendOption
+	var err error
+	if tokens, ok := r.authenticator.(*tokenAuthenticator); ok {
+		opts, err = tokens.authenticate(repository, report)
+	} else {
+		opts, err = r.authenticator.Authenticate(repository)
+	}
+	endSpan(span, err)
+	return opts, err
+}
+
+// invalidateToken forgets the cached token for the repository after the registry rejected it; returns
+// whether there was one, i.e. whether it's worth retrying with a new one.
+func invalidateToken(r *registryClient, repository string) bool {
+	tokens, ok := r.authenticator.(*tokenAuthenticator)
+	return ok && tokens.invalidate(repository)
+}
+
 func rewriteRepository(rewriteRepoRule, repository, tag string) (newRepository string) {
 	if rewriteRepoRule == "" {
 		// nothing to re-write
@@ -216,24 +533,53 @@ func rewriteRepository(rewriteRepoRule, repository, tag string) (newRepository s
 }
 
 func (h *DockerRegistryHijacker) matchingRegistry(host string) *hijackedRegistry {
-	for _, registry := range h.registries {
+	if registry := h.findRegistry(host); registry != nil {
+		log.Debugf("Found matching registry %s for host %q", registry.Address, host)
+		return registry
+	}
+	log.Tracef("No matching registry for host %q", host)
+	return nil
+}
+
+func (h *DockerRegistryHijacker) findRegistry(host string) *hijackedRegistry {
+	for _, registry := range h.currentRegistries() {
 		if registry.Address == host ||
 			registry.matchingRegex != nil && registry.matchingRegex.MatchString(host) {
-			log.Debugf("Found matching registry %s for host %q", registry.Address, host)
 			return registry
 		}
 	}
-	log.Tracef("No matching registry for host %q", host)
 	return nil
 }
 
 // we suffix pace metrics with the name of the registry, abd also mark manifests and blob queries as such.
+// Redirect metrics get suffixed with the redirect's address, and the status class of its response when
+// relevant; origin fallbacks with the name of the registry.
 func (h *DockerRegistryHijacker) TransformMetricName(name MitmProxyStatsdMetricName, request *http.Request) string {
-	if name != HijackedRequestTransferPace && name != ProxiedRequestTransferPace {
+	switch name {
+	case RedirectAttemptCounter, RedirectSuccessCounter, RedirectFailureCounter, RedirectTimeToFirstByte:
+		return string(name) + "." + sanitizeMetricNamePart(GetMetricLabel(request, RedirectLabel)) +
+			"." + GetMetricLabel(request, StatusClassLabel)
+	case RedirectBytesCounter:
+		return string(name) + "." + sanitizeMetricNamePart(GetMetricLabel(request, RedirectLabel))
+	case OriginFallbackCounter:
+		return string(name) + "." + sanitizeMetricNamePart(request.Host)
+	case TokenCacheHitCounter, TokenCacheMissCounter, TokenFetchCounter:
+		// the registry the token is for
+		registry := GetMetricLabel(request, RedirectLabel)
+		if registry == "" {
+			registry = request.Host
+		}
+		newName := string(name) + "." + sanitizeMetricNamePart(registry)
+		if name == TokenFetchCounter {
+			newName += "." + GetMetricLabel(request, StatusClassLabel)
+		}
+		return newName
+	case HijackedRequestTransferPace, ProxiedRequestTransferPace:
+	default:
 		return string(name)
 	}
 
-	newName := string(name) + "." + strings.ReplaceAll(request.Host, ".", "_")
+	newName := string(name) + "." + sanitizeMetricNamePart(request.Host)
 
 	isRegistryQuery, queryType, _, _ := parseRegistryURLPath(request.URL.Path)
 	if isRegistryQuery {
@@ -243,6 +589,152 @@ func (h *DockerRegistryHijacker) TransformMetricName(name MitmProxyStatsdMetricN
 	return newName
 }
 
+// dots separate statsd metric name parts, and colons separate names from values.
+var metricNamePartReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+func sanitizeMetricNamePart(part string) string {
+	return metricNamePartReplacer.Replace(part)
+}
+
+// we label metrics for requests to registries with the registry's host and the query type; the redirect
+// and the outcome get recorded by RequestHandler.
+func (h *DockerRegistryHijacker) MetricLabels(_ MitmProxyStatsdMetricName, request *http.Request) MetricLabels {
+	labels := MetricLabels{}
+	if h.findRegistry(request.Host) == nil {
+		return labels
+	}
+
+	labels[HostLabel] = request.Host
+	if isRegistryQuery, queryType, _, _ := parseRegistryURLPath(request.URL.Path); isRegistryQuery {
+		labels[QueryTypeLabel] = string(queryType)
+	}
+	return labels
+}
+
+// with DogStatsD, we keep the metric names as they are, and tag metric points with the same labels
+// as the Prometheus ones; except for the host, tagged as the registry.
+func (h *DockerRegistryHijacker) TaggedMetricName(name MitmProxyStatsdMetricName, request *http.Request) (string, MetricTags) {
+	labels := recordedLabels(request)
+	for label, value := range h.MetricLabels(name, request) {
+		labels[label] = value
+	}
+
+	tags := make(MetricTags, len(labels))
+	for label, value := range labels {
+		if value == "" {
+			continue
+		}
+		if label == HostLabel {
+			label = registryTag
+		}
+		tags[label] = value
+	}
+	return string(name), tags
+}
+
+// closeIdleConnections closes the idle connections to all registries and redirects.
+func (h *DockerRegistryHijacker) closeIdleConnections() {
+	closeIdleConnections(h.currentRegistries())
+}
+
+func closeIdleConnections(registries []*hijackedRegistry) {
+	for _, registry := range registries {
+		registry.transport.CloseIdleConnections()
+		for _, redirect := range registry.redirects {
+			redirect.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// the status reported for redirects that answered /v2/ when checking readiness
+const reachableStatus = "ok"
+
+// CheckReadiness reports the hijacker as ready if at least one redirect for each registry answers /v2/;
+// the details list which redirects are reachable. It probes every redirect, see BackgroundReadinessChecker.
+func (h *DockerRegistryHijacker) CheckReadiness(ctx context.Context) (bool, interface{}) {
+	registries := h.currentRegistries()
+	reachability := make(map[string]map[string]string, len(registries))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, registry := range registries {
+		redirects := make(map[string]string, len(registry.redirects))
+		reachability[registry.Address] = redirects
+
+		for _, redirect := range registry.redirects {
+			wg.Add(1)
+			go func(redirect *redirectRegistry, redirects map[string]string) {
+				defer wg.Done()
+
+				status := reachableStatus
+				if err := redirect.ping(ctx); err != nil {
+					status = err.Error()
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				redirects[redirect.Address] = status
+			}(redirect, redirects)
+		}
+	}
+	wg.Wait()
+
+	for _, redirects := range reachability {
+		if !containsValue(redirects, reachableStatus) {
+			return false, reachability
+		}
+	}
+	return true, reachability
+}
+
+// ping checks that the registry answers /v2/, using the same scheme(s) as for actual queries;
+// a 401 is fine, since that's how registries requiring authentication answer.
+func (r *registryClient) ping(ctx context.Context) (err error) {
+	schemes := []string{"https"}
+	if r.Security.TLS.Client.Disabled {
+		schemes = []string{"http"}
+	} else if r.Security.EnableHTTPFallback {
+		schemes = append(schemes, "http")
+	}
+
+	client := &http.Client{
+		Transport: r.transport,
+	}
+	for _, scheme := range schemes {
+		if err = pingRegistry(ctx, client, fmt.Sprintf("%s://%s/v2/", scheme, r.Address)); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func pingRegistry(ctx context.Context, client *http.Client, url string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusUnauthorized {
+		return errors.Errorf("unexpected status code %d from %s", response.StatusCode, url)
+	}
+	return nil
+}
+
+func containsValue(m map[string]string, value string) bool {
+	for _, v := range m {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func parseRegistryURLPath(urlPath string) (isRegistryQuery bool, queryType registryQueryType, repository, tag string) {
 	match := routeRegex.FindStringSubmatch(urlPath)
 	if len(match) != 0 {
@@ -2,15 +2,19 @@ package pkg
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/pressly/chi"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
@@ -373,9 +377,476 @@ func TestDockerRegistryHijackerRequestHandler(t *testing.T) {
 	})
 }
 
+func TestDockerRegistryHijackerClientCredentials(t *testing.T) {
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer redirectCleanup()
+
+	authRequests, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	// one registry per policy, all redirecting to the same dummy registry
+	var registries []Registry
+	for _, policy := range []ClientCredentialsPolicy{"", PassClientCredentials, MapClientCredentials} {
+		redirect := redirects(redirectAddress)
+		redirect[0].ClientCredentials = policy
+		redirect[0].StripHeaders = []string{"x-secret"}
+		registries = append(registries, Registry{
+			Config:    krakenconfig.Config{Address: fmt.Sprintf("%s.example.com", policy)},
+			Redirects: redirect,
+		})
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(&Config{Registries: registries})
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	pull := func(host, authorization string) (*http.Response, int) {
+		authRequestsBefore := len(authRequests.requests)
+
+		request := buildGetRequest(t, "https://"+host+"/v2/ubuntu/manifests/18")
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		request.Header.Set("Cookie", "session=abc")
+		request.Header.Set("X-Secret", "hush")
+		request.Header.Set("Connection", "X-Hop")
+		request.Header.Set("X-Hop", "1")
+
+		hijacked, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		require.NoError(t, err)
+		require.True(t, hijacked)
+		require.NotNil(t, response)
+		readResponseBody(t, response)
+
+		assert.Empty(t, response.Header.Get("echoed-Cookie"))
+		return response, len(authRequests.requests) - authRequestsBefore
+	}
+
+	t.Run("by default, client credentials are stripped, and ours used", func(t *testing.T) {
+		response, authenticated := pull(".example.com", "Bearer client")
+		assert.Empty(t, response.Header.Get("echoed-Authorization"))
+		assert.Equal(t, 1, authenticated)
+	})
+
+	t.Run("they can be passed through", func(t *testing.T) {
+		response, authenticated := pull("passthrough.example.com", "Bearer client")
+		assert.Equal(t, "Bearer client", response.Header.Get("echoed-Authorization"))
+		assert.Equal(t, 0, authenticated)
+	})
+
+	t.Run("they can be mapped to ours, only for clients sending some", func(t *testing.T) {
+		response, authenticated := pull("map.example.com", "Bearer client")
+		assert.Empty(t, response.Header.Get("echoed-Authorization"))
+		assert.Equal(t, 1, authenticated)
+
+		response, authenticated = pull("map.example.com", "")
+		assert.Empty(t, response.Header.Get("echoed-Authorization"))
+		assert.Equal(t, 0, authenticated)
+	})
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	request := buildGetRequest(t, "https://index.docker.io/v2/ubuntu/manifests/18")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Authorization", "Bearer client")
+	request.Header.Set("Cookie", "session=abc")
+	request.Header.Set("X-Secret", "hush")
+	request.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	request.Header.Set("Connection", "keep-alive, x-hop")
+	request.Header.Set("X-Hop", "1")
+
+	assert.Equal(t, map[string]string{
+		"Accept":        "application/json",
+		"Authorization": "Bearer client",
+		"Cookie":        "session=abc",
+		"X-Secret":      "hush",
+	}, forwardedHeaders(request, nil))
+
+	assert.Equal(t, map[string]string{
+		"Accept": "application/json",
+	}, forwardedHeaders(request, redirectStrippedHeaders([]string{"x-secret"})))
+}
+
+func TestDockerRegistryHijackerShouldIntercept(t *testing.T) {
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: "index.docker.io",
+				},
+				MatchingRegex: `\.gcr\.io$`,
+				Redirects:     redirects("localhost:8765"),
+			},
+			{
+				Config: krakenconfig.Config{
+					Address: "localhost:7878",
+				},
+				Redirects: redirects("localhost:8765"),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+
+	for address, expected := range map[string]bool{
+		"index.docker.io:443":     true,
+		"index.docker.io":         true,
+		"eu.gcr.io:443":           true,
+		"auth.docker.io:443":      false,
+		"localhost:7878":          true,
+		"localhost:443":           false,
+		"quay.io:443":             false,
+		"production.cloudflare:1": false,
+	} {
+		assert.Equal(t, expected, hijacker.ShouldIntercept(address), address)
+	}
+}
+
+func TestDockerRegistryHijackerMetricLabels(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer registryCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 2, "ubuntu:16")
+	defer redirectCleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	// otherwise connections that the transports dialed but never used can prevent the registries
+	// from shutting down in time
+	defer hijacker.closeIdleConnections()
+
+	for _, testCase := range []struct {
+		url            string
+		expectedLabels MetricLabels
+	}{
+		{
+			url: "http://" + registryAddress + "/v2/ubuntu/blobs/16",
+			expectedLabels: MetricLabels{
+				HostLabel:      registryAddress,
+				QueryTypeLabel: "blob",
+				RedirectLabel:  redirectAddress,
+				OutcomeLabel:   "redirected",
+			},
+		},
+		{
+			url: "http://" + registryAddress + "/v2/ubuntu/manifests/18",
+			expectedLabels: MetricLabels{
+				HostLabel:      registryAddress,
+				QueryTypeLabel: "manifest",
+				OutcomeLabel:   "origin",
+			},
+		},
+		{
+			url: "http://" + registryAddress + "/v2/ubuntu/manifests/20",
+			expectedLabels: MetricLabels{
+				HostLabel:      registryAddress,
+				QueryTypeLabel: "manifest",
+				OutcomeLabel:   "failed",
+			},
+		},
+		{
+			url:            "https://quay.io/v2/ubuntu/manifests/latest",
+			expectedLabels: MetricLabels{},
+		},
+	} {
+		request := withMetricLabelsRecorder(buildGetRequest(t, testCase.url))
+		_, response, _ := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		if response != nil {
+			require.NoError(t, response.Body.Close())
+		}
+
+		assert.Equal(t, testCase.expectedLabels, collectMetricLabels(hijacker, HijackedRequestCounter, request), testCase.url)
+	}
+}
+
+func TestDockerRegistryHijackerTaggedMetricName(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1)
+	defer registryCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 2, "ubuntu:16")
+	defer redirectCleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	request := withMetricLabelsRecorder(buildGetRequest(t, "http://"+registryAddress+"/v2/ubuntu/blobs/16"))
+	_, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+
+	// the name is left alone, and only non-empty tags are set
+	name, tags := hijacker.TaggedMetricName(HijackedRequestTransferPace, request)
+	assert.Equal(t, string(HijackedRequestTransferPace), name)
+	assert.Equal(t, MetricTags{
+		"registry":   registryAddress,
+		"query_type": "blob",
+		"redirect":   redirectAddress,
+		"outcome":    "redirected",
+	}, tags)
+
+	name, tags = hijacker.TaggedMetricName(ProxiedRequestCounter, buildGetRequest(t, "https://quay.io/v2/ubuntu/manifests/latest"))
+	assert.Equal(t, string(ProxiedRequestCounter), name)
+	assert.Empty(t, tags)
+}
+
+func TestDockerRegistryHijackerAccessLogFields(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer registryCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 2, "ubuntu:16")
+	defer redirectCleanup()
+	// nothing listens there
+	downAddress := localhostAddr(getAvailablePort(t))
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(downAddress, redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	for _, testCase := range []struct {
+		url            string
+		expectedFields log.Fields
+	}{
+		{
+			url: "http://" + registryAddress + "/v2/ubuntu/blobs/16",
+			expectedFields: log.Fields{
+				RepositoryField:     "ubuntu",
+				ReferenceField:      "16",
+				QueryTypeField:      "blob",
+				RedirectField:       redirectAddress,
+				RedirectsTriedField: 2,
+			},
+		},
+		{
+			url: "http://" + registryAddress + "/v2/ubuntu/manifests/18",
+			expectedFields: log.Fields{
+				RepositoryField:     "ubuntu",
+				ReferenceField:      "18",
+				QueryTypeField:      "manifest",
+				RedirectsTriedField: 2,
+			},
+		},
+		{
+			url:            "http://" + registryAddress + "/v2/",
+			expectedFields: log.Fields{},
+		},
+	} {
+		request := withAccessLogRecorder(buildGetRequest(t, testCase.url))
+		_, response, _ := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		if response != nil {
+			require.NoError(t, response.Body.Close())
+		}
+
+		assert.Equal(t, testCase.expectedFields, accessLogFields(request), testCase.url)
+	}
+}
+
+func TestDockerRegistryHijackerCheckReadiness(t *testing.T) {
+	redirect1Address, redirect1Cleanup := withDummyRegistry(t, 1)
+	defer redirect1Cleanup()
+	redirect2Address, redirect2Cleanup := withDummyRegistry(t, 2)
+	defer redirect2Cleanup()
+	// nothing listens there
+	downAddress := localhostAddr(getAvailablePort(t))
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	newHijacker := func(t *testing.T, registries ...Registry) *DockerRegistryHijacker {
+		hijacker, err := NewDockerRegistryHijacker(&Config{Registries: registries})
+		require.NoError(t, err)
+		return hijacker
+	}
+	registry := func(address string, redirectAddresses ...string) Registry {
+		return Registry{
+			Config:    krakenconfig.Config{Address: address},
+			Redirects: redirects(redirectAddresses...),
+		}
+	}
+
+	t.Run("it's ready when at least one redirect per registry is reachable", func(t *testing.T) {
+		hijacker := newHijacker(t,
+			registry("index.docker.io", downAddress, redirect1Address),
+			registry("quay.io", redirect2Address))
+		defer hijacker.closeIdleConnections()
+
+		ready, details := hijacker.CheckReadiness(context.Background())
+
+		assert.True(t, ready)
+		reachability := details.(map[string]map[string]string)
+		assert.Equal(t, map[string]string{redirect2Address: "ok"}, reachability["quay.io"])
+		assert.Equal(t, "ok", reachability["index.docker.io"][redirect1Address])
+		assert.NotEqual(t, "ok", reachability["index.docker.io"][downAddress])
+	})
+
+	t.Run("it's not ready if a registry has no reachable redirect", func(t *testing.T) {
+		hijacker := newHijacker(t,
+			registry("index.docker.io", redirect1Address),
+			registry("quay.io", downAddress))
+		defer hijacker.closeIdleConnections()
+
+		ready, details := hijacker.CheckReadiness(context.Background())
+
+		assert.False(t, ready)
+		reachability := details.(map[string]map[string]string)
+		assert.Equal(t, map[string]string{redirect1Address: "ok"}, reachability["index.docker.io"])
+		assert.Contains(t, reachability["quay.io"][downAddress], "connection refused")
+	})
+}
+
+func TestDockerRegistryHijackerRedirectMetrics(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer registryCleanup()
+	missingAddress, missingCleanup := withDummyRegistry(t, 2)
+	defer missingCleanup()
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 3, "ubuntu:16")
+	defer redirectCleanup()
+	// nothing listens there
+	downAddress := localhostAddr(getAvailablePort(t))
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	config := &Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(downAddress, missingAddress, redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	sanitized := func(address string) string {
+		return strings.NewReplacer(".", "_", ":", "_").Replace(address)
+	}
+	attemptMetrics := func(address, statusClass string, outcome MitmProxyStatsdMetricName) []string {
+		suffix := "." + sanitized(address) + "." + statusClass
+		return []string{
+			string(RedirectAttemptCounter) + suffix + ":1",
+			string(RedirectTimeToFirstByte) + suffix,
+			string(outcome) + suffix + ":1",
+		}
+	}
+
+	t.Run("served by a redirect", func(t *testing.T) {
+		reporter := &recordingMetricsReporter{hijacker: hijacker}
+		request := withMetricsReporter(buildGetRequest(t, "http://"+registryAddress+"/v2/ubuntu/blobs/16"), reporter)
+
+		_, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+
+		var expected []string
+		expected = append(expected, attemptMetrics(downAddress, "error", RedirectFailureCounter)...)
+		expected = append(expected, attemptMetrics(missingAddress, "4xx", RedirectFailureCounter)...)
+		expected = append(expected, attemptMetrics(redirectAddress, "2xx", RedirectSuccessCounter)...)
+		expected = append(expected, fmt.Sprintf("%s.%s:%d", RedirectBytesCounter, sanitized(redirectAddress), len(body)))
+		assert.Equal(t, expected, reporter.metrics)
+
+		assert.Equal(t, MetricLabels{RedirectLabel: redirectAddress, StatusClassLabel: "2xx"}, reporter.labels[len(reporter.labels)-2])
+		assert.Equal(t, MetricLabels{RedirectLabel: redirectAddress}, reporter.labels[len(reporter.labels)-1])
+	})
+
+	t.Run("falling back to the origin", func(t *testing.T) {
+		reporter := &recordingMetricsReporter{hijacker: hijacker}
+		request := withMetricsReporter(buildGetRequest(t, "http://"+registryAddress+"/v2/ubuntu/manifests/18"), reporter)
+
+		_, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+
+		var expected []string
+		expected = append(expected, attemptMetrics(downAddress, "error", RedirectFailureCounter)...)
+		expected = append(expected, attemptMetrics(missingAddress, "4xx", RedirectFailureCounter)...)
+		expected = append(expected, attemptMetrics(redirectAddress, "4xx", RedirectFailureCounter)...)
+		expected = append(expected, string(OriginFallbackCounter)+"."+sanitized(registryAddress)+":1")
+		assert.Equal(t, expected, reporter.metrics)
+	})
+
+	t.Run("the time to first byte doesn't include authenticating", func(t *testing.T) {
+		authDelay := 500 * time.Millisecond
+
+		previousFactory := authenticatorFactory
+		defer func() { authenticatorFactory = previousFactory }()
+		authenticatorFactory = func(krakenconfig.Config, *http.Transport) (security.Authenticator, error) {
+			return &slowAuthenticator{delay: authDelay}, nil
+		}
+
+		slowHijacker, err := NewDockerRegistryHijacker(&Config{
+			Registries: []Registry{
+				{
+					Config:    krakenconfig.Config{Address: registryAddress},
+					Redirects: redirects(redirectAddress),
+				},
+			},
+		})
+		require.NoError(t, err)
+		defer slowHijacker.closeIdleConnections()
+
+		reporter := &recordingMetricsReporter{hijacker: slowHijacker}
+		request := withMetricsReporter(buildGetRequest(t, "http://"+registryAddress+"/v2/ubuntu/blobs/16"), reporter)
+
+		_, response, err := slowHijacker.RequestHandler(&dummyResponseWriter{}, request)
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+
+		require.Len(t, reporter.durations, 1)
+		assert.Less(t, int64(reporter.durations[0]), int64(authDelay))
+	})
+}
+
 /*** Helpers below ***/
 
-// a dummyRegistry gives dummy responses to manifests and blob queries.
+// a dummyRegistry gives dummy responses to manifests and blob queries, and echoes the trace-context, credentials
+// and cookies it receives.
 type dummyRegistry struct {
 	id          int
 	knownImages map[string]bool
@@ -395,8 +866,17 @@ func newDummyRegistry(id int, images ...string) *dummyRegistry {
 func (r *dummyRegistry) start(t *testing.T) (address string, cleanup func()) {
 	router := chi.NewRouter()
 
-	router.Get("/v2/{repo}/{queryType}/{tag}", func(writer http.ResponseWriter, request *http.Request) {
+	router.Get("/v2/", func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	})
+
+	imageHandler := func(writer http.ResponseWriter, request *http.Request) {
 		image := fmt.Sprintf("%s:%s", chi.URLParam(request, "repo"), chi.URLParam(request, "tag"))
+		for _, header := range []string{"traceparent", "Authorization", "Cookie"} {
+			if value := request.Header.Get(header); value != "" {
+				writer.Header().Set("echoed-"+header, value)
+			}
+		}
 		if r.knownImages[image] {
 			if valueStr := request.Header.Get("double-me"); valueStr != "" {
 				value, err := strconv.Atoi(valueStr)
@@ -405,15 +885,21 @@ func (r *dummyRegistry) start(t *testing.T) (address string, cleanup func()) {
 				writer.Header().Add("doubled-ya", strconv.Itoa(value*2))
 			}
 
+			response := fmt.Sprintf("from registry %d: %s for %s", r.id, chi.URLParam(request, "queryType"), image)
+			if chi.URLParam(request, "queryType") == "manifests" {
+				writer.Header().Set(dockerContentDigestHeader, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(response))))
+			}
+
 			writer.WriteHeader(http.StatusOK)
 
-			response := fmt.Sprintf("from registry %d: %s for %s", r.id, chi.URLParam(request, "queryType"), image)
 			_, err := writer.Write([]byte(response))
 			require.NoError(t, err)
 		} else {
 			writer.WriteHeader(http.StatusNotFound)
 		}
-	})
+	}
+	router.Get("/v2/{repo}/{queryType}/{tag}", imageHandler)
+	router.Head("/v2/{repo}/{queryType}/{tag}", imageHandler)
 
 	port := getAvailablePort(t)
 	address = localhostAddr(port)
@@ -476,6 +962,18 @@ func (d dummyAuthenticator) Authenticate(repo string) ([]httputil.SendOption, er
 	return nil, nil
 }
 
+// a slowAuthenticator takes its time to authenticate, e.g. like when it needs to fetch a token.
+type slowAuthenticator struct {
+	delay time.Duration
+}
+
+var _ security.Authenticator = &slowAuthenticator{}
+
+func (a *slowAuthenticator) Authenticate(string) ([]httputil.SendOption, error) {
+	time.Sleep(a.delay)
+	return nil, nil
+}
+
 // replaces the authenticator factory by one producing dummyAuthenticators, and returns
 // both an *authRequests allowing for auth audit, and a func to clean up when done testing.
 func withDummyAuthenticators() (*authRequests, func()) {
@@ -483,7 +981,7 @@ func withDummyAuthenticators() (*authRequests, func()) {
 
 	requests := &authRequests{}
 
-	authenticatorFactory = func(config krakenconfig.Config) (security.Authenticator, error) {
+	authenticatorFactory = func(config krakenconfig.Config, _ *http.Transport) (security.Authenticator, error) {
 		return &dummyAuthenticator{
 			address:  config.Address,
 			requests: requests,
@@ -511,6 +1009,7 @@ func buildGetRequest(t *testing.T, url string) *http.Request {
 
 type dummyResponseWriter struct {
 	statusCode int
+	header     http.Header
 	body       []byte
 	touched    bool
 }
@@ -519,7 +1018,10 @@ var _ http.ResponseWriter = &dummyResponseWriter{}
 
 func (w *dummyResponseWriter) Header() http.Header {
 	w.touched = true
-	return nil
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
 }
 
 func (w *dummyResponseWriter) Write(bytes []byte) (int, error) {
@@ -547,3 +1049,26 @@ func redirects(addresses ...string) []RedirectRegistry {
 	}
 	return result
 }
+
+// a recordingMetricsReporter records the metric points hijackers report, with their names transformed
+// by the hijacker; counters are recorded as "name:value".
+type recordingMetricsReporter struct {
+	hijacker  MitmHijacker
+	metrics   []string
+	labels    []MetricLabels
+	durations []time.Duration
+}
+
+func (r *recordingMetricsReporter) addToMetricCounter(metricName MitmProxyStatsdMetricName, request *http.Request, value int64) {
+	r.record(fmt.Sprintf("%s:%d", r.hijacker.TransformMetricName(metricName, request), value), request)
+}
+
+func (r *recordingMetricsReporter) reportMetricDuration(metricName MitmProxyStatsdMetricName, request *http.Request, duration time.Duration) {
+	r.record(r.hijacker.TransformMetricName(metricName, request), request)
+	r.durations = append(r.durations, duration)
+}
+
+func (r *recordingMetricsReporter) record(metric string, request *http.Request) {
+	r.metrics = append(r.metrics, metric)
+	r.labels = append(r.labels, recordedLabels(request))
+}
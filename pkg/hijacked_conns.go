@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hijackedConns keeps track of the connections a mitmHandler serves outside of the proxy's own
+// http.Server, so that they can be drained when shutting down: intercepted connections, each served
+// by its own http.Server, and tunnels.
+// Its zero value is ready to use.
+type hijackedConns struct {
+	// intercepted connections map to the server serving them, tunnels to nil
+	conns map[net.Conn]*http.Server
+	// set once draining starts; from then on, new connections get closed right away
+	draining bool
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+}
+
+// add starts tracking conn; the returned function must be called once done with it.
+func (c *hijackedConns) add(conn net.Conn, server *http.Server) (done func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.draining {
+		log.Debugf("Closing connection from %s: shutting down", conn.RemoteAddr())
+		if err := conn.Close(); err != nil {
+			log.Debugf("Error closing connection from %s: %v", conn.RemoteAddr(), err)
+		}
+		return func() {}
+	}
+
+	if c.conns == nil {
+		c.conns = make(map[net.Conn]*http.Server)
+	}
+	c.conns[conn] = server
+	c.wg.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mutex.Lock()
+			delete(c.conns, conn)
+			c.mutex.Unlock()
+
+			c.wg.Done()
+		})
+	}
+}
+
+// drain closes intercepted connections as soon as they're idle, and waits for tunnels to end; once ctx
+// is done, it closes all remaining connections and returns ctx's error.
+func (c *hijackedConns) drain(ctx context.Context) error {
+	c.mutex.Lock()
+	c.draining = true
+	for _, server := range c.conns {
+		if server != nil {
+			go func(server *http.Server) {
+				// the error can only be ctx's, which we deal with below
+				_ = server.Shutdown(ctx)
+			}(server)
+		}
+	}
+	c.mutex.Unlock()
+
+	drained := make(chan interface{})
+	go func() {
+		c.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		c.closeAll()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// closeAll closes all connections right away.
+func (c *hijackedConns) closeAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.draining = true
+	for conn := range c.conns {
+		if err := conn.Close(); err != nil {
+			log.Debugf("Error closing connection from %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type metricsReporterContextKey struct{}
+
+// a metricsReporter emits metric points to statsd and/or Prometheus; MitmProxys are metricsReporters.
+type metricsReporter interface {
+	addToMetricCounter(metricName MitmProxyStatsdMetricName, request *http.Request, value int64)
+	reportMetricDuration(metricName MitmProxyStatsdMetricName, request *http.Request, d time.Duration)
+}
+
+var _ metricsReporter = &MitmProxy{}
+
+// withMetricsReporter returns a copy of the request that hijackers can report metrics for.
+func withMetricsReporter(request *http.Request, reporter metricsReporter) *http.Request {
+	ctx := context.WithValue(request.Context(), metricsReporterContextKey{}, reporter)
+	return request.WithContext(ctx)
+}
+
+// AddToMetricCounter can be called by hijackers while handling a request, to emit their own counter metric
+// points; just like the proxy's own, they go through the hijacker's TransformMetricName and MetricLabels.
+// labels only apply to that metric point, on top of the ones set with SetMetricLabel; TransformMetricName
+// can read them with GetMetricLabel.
+// It's a no-op for requests that are not being handled by a MitmProxy.
+func AddToMetricCounter(request *http.Request, metricName MitmProxyStatsdMetricName, value int64, labels MetricLabels) {
+	if reporter, ok := request.Context().Value(metricsReporterContextKey{}).(metricsReporter); ok {
+		reporter.addToMetricCounter(metricName, withMetricPointLabels(request, labels), value)
+	}
+}
+
+// ReportMetricDuration is the same as AddToMetricCounter, for timing metrics.
+func ReportMetricDuration(request *http.Request, metricName MitmProxyStatsdMetricName, d time.Duration, labels MetricLabels) {
+	if reporter, ok := request.Context().Value(metricsReporterContextKey{}).(metricsReporter); ok {
+		reporter.reportMetricDuration(metricName, withMetricPointLabels(request, labels), d)
+	}
+}
+
+// withMetricPointLabels returns a copy of the request, with labels added to the ones recorded on it.
+func withMetricPointLabels(request *http.Request, labels MetricLabels) *http.Request {
+	if len(labels) == 0 {
+		return request
+	}
+
+	pointLabels := recordedLabels(request)
+	for name, value := range labels {
+		pointLabels[name] = value
+	}
+
+	ctx := context.WithValue(request.Context(), metricLabelsContextKey{}, &recordedMetricLabels{labels: pointLabels})
+	return request.WithContext(ctx)
+}
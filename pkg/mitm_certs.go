@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Leaf certificates forged for intercepted connections; adapted from github.com/kr/mitm.
+const (
+	leafMaxAge  = 24 * time.Hour
+	leafKeySize = 2048
+	leafUsage   = x509.KeyUsageDigitalSignature |
+		x509.KeyUsageContentCommitment |
+		x509.KeyUsageKeyEncipherment |
+		x509.KeyUsageDataEncipherment |
+		x509.KeyUsageKeyAgreement |
+		x509.KeyUsageCertSign |
+		x509.KeyUsageCRLSign
+	serialNumberBits = 128
+)
+
+// genCert generates a leaf certificate for the given names, signed by ca.
+func genCert(ca *tls.Certificate, names ...string) (*tls.Certificate, error) {
+	if !ca.Leaf.IsCA {
+		return nil, errors.New("CA cert is not a CA")
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialNumberBits))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	now := time.Now().Add(-1 * time.Hour).UTC()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: names[0]},
+		NotBefore:             now,
+		NotAfter:              now.Add(leafMaxAge),
+		KeyUsage:              leafUsage,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    x509.SHA512WithRSA,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, leafKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{certificate},
+		PrivateKey:  key,
+	}
+	cert.Leaf, err = x509.ParseCertificate(certificate)
+	return cert, err
+}
@@ -0,0 +1,291 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// mitmHandler is a forward proxy that substitutes its own certificate for incoming TLS connections in
+// place of the upstream server's certificate.
+// It's adapted from github.com/kr/mitm (Copyright (c) 2015 Keith Rarick, MIT license), the main differences
+// being that it dials upstream through an upstreamDialer instead of always dialing directly, and that it
+// can simply tunnel the transparent and SOCKS5 connections it's not interested in intercepting.
+type mitmHandler struct {
+	// wrap is used to inspect the decrypted HTTP requests and responses.
+	wrap func(upstream http.Handler) http.Handler
+
+	// intercept decides whether transparent and SOCKS5 connections to the given address (host:port)
+	// should be intercepted, or simply tunneled to upstream; CONNECT requests are always intercepted.
+	intercept func(address string) bool
+
+	// if not nil, tunneled gets called for each tunneled connection.
+	tunneled func(request *http.Request)
+
+	// ca is used to generate leaf certs for each incoming TLS request.
+	ca *tls.Certificate
+
+	dialer *upstreamDialer
+
+	// used for plain HTTP requests
+	transport *http.Transport
+
+	// used for requests from intercepted connections; it pools connections to upstream
+	// servers across client connections, and speaks HTTP/2 to those that support it.
+	interceptedTransport *http.Transport
+
+	// if true, HTTP/2 is not offered to clients on intercepted connections.
+	disableHTTP2 bool
+
+	// the intercepted and tunneled connections being served
+	conns hijackedConns
+}
+
+type upstreamAddressContextKey struct{}
+
+// newInterceptedTransport returns the http.Transport to use for requests from intercepted connections;
+// it dials the upstream address the client connection was initially addressed to, if any, rather than
+// whatever the requests' Host header says.
+func newInterceptedTransport(dialer *upstreamDialer, tlsClientConfig *tls.Config) *http.Transport {
+	transport := dialer.newTransport()
+	// the dialer takes care of going through the upstream proxy, if any
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if upstreamAddress, ok := ctx.Value(upstreamAddressContextKey{}).(string); ok {
+			address = upstreamAddress
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	if tlsClientConfig != nil {
+		transport.TLSClientConfig = tlsClientConfig.Clone()
+	}
+	return transport
+}
+
+func (h *mitmHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodConnect {
+		h.serveConnect(writer, request)
+		return
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director:  httpDirector,
+		Transport: h.transport,
+	}
+	h.wrap(reverseProxy).ServeHTTP(writer, request)
+}
+
+func (h *mitmHandler) serveConnect(writer http.ResponseWriter, request *http.Request) {
+	name := dnsName(request.Host)
+	if name == "" {
+		log.Warnf("Cannot determine cert name for %q", request.Host)
+		http.Error(writer, "no upstream", http.StatusServiceUnavailable)
+		return
+	}
+
+	rawConn, err := hijackConnect(writer)
+	if err != nil {
+		log.Warnf("Unable to hijack CONNECT request to %s: %v", request.Host, err)
+		return
+	}
+
+	h.interceptTLS(rawConn, request.Host, name)
+}
+
+// interceptTLS performs the TLS handshake with the client over rawConn, presenting a certificate forged
+// for the server name the client asks for (or for defaultName if the client doesn't use SNI), and then
+// serves the decrypted requests, forwarding them to upstreamAddress. It closes rawConn when done.
+func (h *mitmHandler) interceptTLS(rawConn net.Conn, upstreamAddress, defaultName string) {
+	serverConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName := hello.ServerName
+			if serverName == "" {
+				serverName = defaultName
+			}
+			return genCert(h.ca, serverName)
+		},
+	}
+	if !h.disableHTTP2 {
+		serverConfig.NextProtos = []string{http2Proto, http11Proto}
+	}
+
+	clientConn := tls.Server(rawConn, serverConfig)
+	defer clientConn.Close()
+
+	// tracked until the handshake is done, so that clients that never complete it don't hold up
+	// shutting down; serveMitmConn then takes over
+	untrack := h.conns.add(rawConn, nil)
+	err := clientConn.Handshake()
+	untrack()
+	if err != nil {
+		log.Warnf("Handshake with client for %s failed: %v", upstreamAddress, err)
+		return
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director:  httpsDirector,
+		Transport: h.interceptedTransport,
+	}
+	h.serveMitmConn(clientConn, h.wrap(reverseProxy), upstreamAddress)
+}
+
+// interceptHTTP serves the plain HTTP requests coming from conn, addressed to upstreamAddress.
+func (h *mitmHandler) interceptHTTP(conn net.Conn, upstreamAddress string) {
+	defer conn.Close()
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director:  httpDirector,
+		Transport: h.transport,
+	}
+	h.serveMitmConn(conn, h.wrap(reverseProxy), upstreamAddress)
+}
+
+// serveMitmConn serves the HTTP requests coming from conn through handler, over either HTTP/1.1 or HTTP/2
+// depending on what's been negotiated if it's a TLS connection; it returns when conn gets closed.
+func (h *mitmHandler) serveMitmConn(conn net.Conn, handler http.Handler, upstreamAddress string) {
+	done := make(chan interface{})
+	var once sync.Once
+	// tracked from when the server starts serving it, so that draining can't race with Serve
+	untrack := func() {}
+	var server *http.Server
+	server = &http.Server{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ctx := context.WithValue(request.Context(), upstreamAddressContextKey{}, upstreamAddress)
+			handler.ServeHTTP(writer, request.WithContext(ctx))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				untrack = h.conns.add(conn, server)
+			case http.StateClosed, http.StateHijacked:
+				once.Do(func() { close(done) })
+			}
+		},
+	}
+	if h.disableHTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	// Serve always returns an error once the one-shot listener's connection has been accepted
+	_ = server.Serve(&oneShotListener{conn: conn})
+	<-done
+	untrack()
+}
+
+// tunnel transparently copies data between the client and upstream, until either end closes its connection.
+func (h *mitmHandler) tunnel(request *http.Request, clientConn, upstreamConn net.Conn) {
+	defer clientConn.Close()
+	defer upstreamConn.Close()
+	defer h.conns.add(clientConn, nil)()
+
+	log.Debugf("Tunneling connection to %s", request.Host)
+	if h.tunneled != nil {
+		h.tunneled(request)
+	}
+
+	done := make(chan interface{}, 2)
+	pipe := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- nil
+	}
+	go pipe(upstreamConn, clientConn)
+	go pipe(clientConn, upstreamConn)
+	<-done
+}
+
+var okHeader = []byte("HTTP/1.1 200 OK\r\n\r\n")
+
+// ALPN protocol IDs
+const (
+	http2Proto  = "h2"
+	http11Proto = "http/1.1"
+)
+
+// hijackConnect hijacks writer's underlying net.Conn, and responds to the CONNECT request.
+func hijackConnect(writer http.ResponseWriter) (net.Conn, error) {
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "no upstream", http.StatusServiceUnavailable)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(writer, "no upstream", http.StatusServiceUnavailable)
+		return nil, err
+	}
+	if _, err = conn.Write(okHeader); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if buffer.Reader.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, reader: buffer.Reader}, nil
+	}
+	return conn, nil
+}
+
+func httpDirector(request *http.Request) {
+	request.URL.Host = request.Host
+	request.URL.Scheme = "http"
+}
+
+func httpsDirector(request *http.Request) {
+	request.URL.Host = request.Host
+	request.URL.Scheme = "https"
+}
+
+// dnsName returns the DNS name in addr, if any.
+func dnsName(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// a oneShotListener's Accept only returns its conn, followed by an error for each subsequent Accept.
+type oneShotListener struct {
+	conn net.Conn
+	addr net.Addr
+}
+
+func (l *oneShotListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, errors.New("closed")
+	}
+	conn := l.conn
+	l.addr = conn.LocalAddr()
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *oneShotListener) Close() error {
+	return nil
+}
+
+func (l *oneShotListener) Addr() net.Addr {
+	if l.conn != nil {
+		return l.conn.LocalAddr()
+	}
+	return l.addr
+}
+
+// connectRequest builds a CONNECT request to address, for connections that don't come with one
+// (e.g. transparent or SOCKS5 connections) to be handled the same way as regular CONNECTs.
+func connectRequest(address string) *http.Request {
+	return &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+}
@@ -6,14 +6,18 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cactus/go-statsd-client/statsd"
-	"github.com/kr/mitm"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // The names of the statsd metrics that MitmProxys push.
@@ -33,6 +37,51 @@ const (
 	// Statsd counter metric incremented when hijacking a request fails.
 	HijackingErrorsCounter MitmProxyStatsdMetricName = "mitm.hijacked.errors"
 
+	// Statsd counter metric incremented when a transparent or SOCKS5 connection is tunneled to upstream
+	// without being intercepted.
+	TunneledConnectionCounter MitmProxyStatsdMetricName = "mitm.tunneled"
+
+	// Statsd counter metric incremented when a client is denied access based on its IP (403).
+	ForbiddenRequestCounter MitmProxyStatsdMetricName = "mitm.denied.forbidden"
+
+	// Statsd counter metric incremented when a client fails to authenticate (407).
+	UnauthenticatedRequestCounter MitmProxyStatsdMetricName = "mitm.denied.unauthenticated"
+
+	// Statsd counter metric incremented for each attempt to get a response from a redirect registry.
+	RedirectAttemptCounter MitmProxyStatsdMetricName = "registry.redirect.attempts"
+
+	// Statsd counter metric incremented for each successful attempt to get a response from a redirect registry.
+	RedirectSuccessCounter MitmProxyStatsdMetricName = "registry.redirect.successes"
+
+	// Statsd counter metric incremented for each failed attempt to get a response from a redirect registry.
+	RedirectFailureCounter MitmProxyStatsdMetricName = "registry.redirect.failures"
+
+	// Statsd counter metric incremented when all redirect registries failed, and the request gets sent
+	// to the original registry instead.
+	OriginFallbackCounter MitmProxyStatsdMetricName = "registry.origin.fallbacks"
+
+	// Statsd counter metric counting the bytes served to clients from redirect registries.
+	RedirectBytesCounter MitmProxyStatsdMetricName = "registry.redirect.bytes"
+
+	// Statsd timing metric, measuring the time to get the response headers from redirect registries.
+	RedirectTimeToFirstByte MitmProxyStatsdMetricName = "registry.redirect.ttfb"
+
+	// Statsd counter metric incremented each time a registry token gets served from the cache.
+	TokenCacheHitCounter MitmProxyStatsdMetricName = "registry.token.cache_hits"
+
+	// Statsd counter metric incremented each time a registry token isn't in the cache, and needs fetching.
+	TokenCacheMissCounter MitmProxyStatsdMetricName = "registry.token.cache_misses"
+
+	// Statsd counter metric incremented each time a token gets fetched from a registry's token server,
+	// including background refreshes.
+	TokenFetchCounter MitmProxyStatsdMetricName = "registry.token.fetches"
+
+	// Statsd counter metric incremented each time the config gets reloaded.
+	ConfigReloadCounter MitmProxyStatsdMetricName = "config.reloads"
+
+	// Statsd counter metric incremented each time a new config gets rejected when trying to reload it.
+	ConfigReloadFailureCounter MitmProxyStatsdMetricName = "config.reload_failures"
+
 	oneKb = 1000
 )
 
@@ -43,12 +92,105 @@ type MitmProxy struct {
 	ca           *TLSInfo
 	hijacker     MitmHijacker
 	statsdClient statsd.StatSender
+	prometheus   *PrometheusMetrics
+	accessLog    *AccessLog
+	tracing      *Tracing
+
+	upstreamProxy       *UpstreamProxyConfig
+	upstreamConnections *UpstreamConnectionsConfig
+	transparent         *TransparentProxyConfig
+	socks5              *Socks5ProxyConfig
+	accessControl       *AccessControlConfig
+	// allows overriding in tests
+	socks5HandshakeTimeout time.Duration
+
+	server  *http.Server
+	handler *mitmHandler
+	// the listeners other than the server's
+	listeners []net.Listener
+	// set when Shutdown or Stop gets called, so that a pending start doesn't go on
+	stopped bool
+	// guards the server, the handler, the listeners, and stopped: Shutdown can be called from another
+	// goroutine while starting
+	lifecycleMutex sync.Mutex
+
+	// set to 1 once the CA is loaded and all listeners are up, accessed atomically
+	ready int32
+}
+
+// MitmProxyOption allows customizing a MitmProxy's behavior.
+type MitmProxyOption func(*MitmProxy)
+
+// WithUpstreamProxy makes the MitmProxy go through an upstream HTTP(S) proxy for all
+// upstream connections, except the ones excluded by its no_proxy rules.
+func WithUpstreamProxy(config *UpstreamProxyConfig) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.upstreamProxy = config
+	}
+}
+
+// WithUpstreamConnections tunes the MitmProxy's connections to upstream servers: connection pooling
+// limits, and whether to use HTTP/2.
+func WithUpstreamConnections(config *UpstreamConnectionsConfig) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.upstreamConnections = config
+	}
+}
 
-	server *http.Server
+// WithTransparentListener makes the MitmProxy also accept TLS connections redirected to it, e.g. by
+// iptables rules, in addition to its regular HTTP proxy listener.
+func WithTransparentListener(config *TransparentProxyConfig) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.transparent = config
+	}
+}
+
+// WithSocks5Listener makes the MitmProxy also accept SOCKS5 connections, in addition to its regular
+// HTTP proxy listener; they get intercepted or tunneled just like transparent connections.
+func WithSocks5Listener(config *Socks5ProxyConfig) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.socks5 = config
+	}
+}
+
+// WithPrometheusMetrics makes the MitmProxy report its metrics to Prometheus, in addition to
+// statsd if it's got a statsd client.
+func WithPrometheusMetrics(metrics *PrometheusMetrics) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.prometheus = metrics
+	}
+}
+
+// WithAccessLog makes the MitmProxy log every request it handles to accessLog.
+func WithAccessLog(accessLog *AccessLog) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.accessLog = accessLog
+	}
+}
+
+// WithTracing makes the MitmProxy trace every request it handles; hijackers can then create child spans.
+func WithTracing(tracing *Tracing) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.tracing = tracing
+	}
+}
+
+// WithAccessControl restricts which clients can use the MitmProxy: by IP, with basic auth,
+// and/or with client certificates.
+func WithAccessControl(config *AccessControlConfig) MitmProxyOption {
+	return func(p *MitmProxy) {
+		p.accessControl = config
+	}
 }
 
 // a MitmHijacker tells a MitmProxy how to handle incoming requests.
 type MitmHijacker interface {
+	// ShouldIntercept is called for each connection coming through the transparent or SOCKS5
+	// listeners, with the address (host:port) it's addressed to; if it returns false, the connection
+	// is simply tunneled to upstream, and none of its requests are seen by RequestHandler.
+	// CONNECT requests to the HTTP proxy listener are always intercepted.
+	ShouldIntercept(address string) bool
+
 	// RequestHandler is called for all incoming requests
 	// * the first item of the return tuple, the boolean, says whether the hijacker wishes to hijack that request; in
 	//   that case,
@@ -60,6 +202,16 @@ type MitmHijacker interface {
 	// metricName is guaranteed to be one of the constants defined above.
 	// If it returns an empty string, then the metric point is not emitted.
 	TransformMetricName(MitmProxyStatsdMetricName, *http.Request) string
+
+	// the label-based equivalent of TransformMetricName, for Prometheus metrics: hijackers can choose
+	// the labels attached to metric points, on top of the ones set with SetMetricLabel.
+	// If it returns nil, then the metric point is not emitted.
+	MetricLabels(MitmProxyStatsdMetricName, *http.Request) MetricLabels
+
+	// used instead of TransformMetricName when the statsd client supports DogStatsD tags: hijackers
+	// can choose both the name of the metric, and the tags attached to its points.
+	// If it returns an empty name, then the metric point is not emitted.
+	TaggedMetricName(MitmProxyStatsdMetricName, *http.Request) (string, MetricTags)
 }
 
 // A default implementation of the MitmHijacker interface.
@@ -67,6 +219,18 @@ type DefaultMitmHijacker struct{}
 
 var _ MitmHijacker = &DefaultMitmHijacker{}
 
+// a ForwardedResponseObserver is a MitmHijacker that also wants to know how upstream responded to
+// the requests it didn't hijack, or failed to.
+type ForwardedResponseObserver interface {
+	// ObserveForwardedResponse is called once the request has been forwarded upstream, with the
+	// status code and headers of the response copied back to the client.
+	ObserveForwardedResponse(request *http.Request, statusCode int, header http.Header)
+}
+
+func (d DefaultMitmHijacker) ShouldIntercept(string) bool {
+	return true
+}
+
 func (d DefaultMitmHijacker) RequestHandler(http.ResponseWriter, *http.Request) (bool, *http.Response, error) {
 	return false, nil, nil
 }
@@ -75,17 +239,30 @@ func (d DefaultMitmHijacker) TransformMetricName(name MitmProxyStatsdMetricName,
 	return string(name)
 }
 
-func NewMitmProxy(listenAddr string, ca *TLSInfo, hijacker MitmHijacker, statsdClient statsd.StatSender) *MitmProxy {
+func (d DefaultMitmHijacker) MetricLabels(MitmProxyStatsdMetricName, *http.Request) MetricLabels {
+	return MetricLabels{}
+}
+
+func (d DefaultMitmHijacker) TaggedMetricName(name MitmProxyStatsdMetricName, _ *http.Request) (string, MetricTags) {
+	return string(name), nil
+}
+
+func NewMitmProxy(listenAddr string, ca *TLSInfo, hijacker MitmHijacker, statsdClient statsd.StatSender, opts ...MitmProxyOption) *MitmProxy {
 	if hijacker == nil {
 		hijacker = &DefaultMitmHijacker{}
 	}
 
-	return &MitmProxy{
+	proxy := &MitmProxy{
 		listenAddr:   listenAddr,
 		ca:           ca,
 		hijacker:     hijacker,
 		statsdClient: statsdClient,
 	}
+	for _, opt := range opts {
+		opt(proxy)
+	}
+
+	return proxy
 }
 
 // Start is a blocking call.
@@ -95,37 +272,213 @@ func (p *MitmProxy) Start() error {
 
 // If passed a listeningChan, it will close it when it's started listening.
 func (p *MitmProxy) start(listeningChan chan interface{}, upstreamTLSConfig *tls.Config) error {
+	server, listenerTLSInfo, err := p.setUp(upstreamTLSConfig)
+	if err != nil || server == nil {
+		return err
+	}
+
+	serverListening := make(chan interface{})
+	serverDone := make(chan interface{})
+	defer close(serverDone)
+	go func() {
+		select {
+		case <-serverListening:
+			p.lifecycleMutex.Lock()
+			if !p.stopped {
+				atomic.StoreInt32(&p.ready, 1)
+			}
+			p.lifecycleMutex.Unlock()
+			if listeningChan != nil {
+				close(listeningChan)
+			}
+		case <-serverDone:
+		}
+	}()
+
+	startedLogLine := fmt.Sprintf("Proxy listening on %s", p.listenAddr)
+	if err := startHTTPServer(server, serverListening, listenerTLSInfo, startedLogLine); err != nil {
+		return err
+	}
+
+	log.Infof("Proxy closed")
+	return nil
+}
+
+// setUp builds the proxy's server, and starts its other listeners; returns a nil server if the proxy
+// got stopped before starting.
+func (p *MitmProxy) setUp(upstreamTLSConfig *tls.Config) (*http.Server, *TLSInfo, error) {
+	p.lifecycleMutex.Lock()
+	defer p.lifecycleMutex.Unlock()
+
 	if p.server != nil {
-		return errors.New("proxy already started")
+		return nil, nil, errors.New("proxy already started")
+	}
+	if p.stopped {
+		log.Infof("Proxy stopped before starting")
+		return nil, nil, nil
 	}
 
 	ca, err := p.loadCA()
 	if err != nil {
-		return errors.Wrap(err, "unable to load TLSInfo")
-	}
-
-	p.server = &http.Server{
-		Addr: p.listenAddr,
-		Handler: &mitm.Proxy{
-			CA: &ca,
-			Wrap: func(upstream http.Handler) http.Handler {
-				return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-					p.RequestHandler(upstream, writer, request)
-				})
-			},
-			TLSClientConfig: upstreamTLSConfig,
+		return nil, nil, errors.Wrap(err, "unable to load TLSInfo")
+	}
+
+	dialer, err := newUpstreamDialer(p.upstreamProxy, p.upstreamConnections)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to set up upstream proxy")
+	}
+
+	handler := &mitmHandler{
+		wrap: func(upstream http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				p.RequestHandler(upstream, writer, request)
+			})
+		},
+		intercept: p.hijacker.ShouldIntercept,
+		tunneled: func(request *http.Request) {
+			p.incrementMetricCounter(TunneledConnectionCounter, request)
 		},
+		ca:                   &ca,
+		dialer:               dialer,
+		transport:            dialer.newTransport(),
+		interceptedTransport: newInterceptedTransport(dialer, upstreamTLSConfig),
+		disableHTTP2:         dialer.http2Disabled(),
 	}
 
-	startedLogLine := fmt.Sprintf("Proxy listening on %s", p.listenAddr)
-	if err := startHTTPServer(p.server, listeningChan, nil, startedLogLine); err != nil {
+	controller, err := newAccessController(p.accessControl)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to set up access control")
+	}
+
+	server := &http.Server{
+		Addr:    p.listenAddr,
+		Handler: p.accessControlHandler(controller, handler),
+	}
+
+	var listenerTLSInfo *TLSInfo
+	if p.accessControl != nil && p.accessControl.TLS != nil {
+		tlsConfig, err := listenerTLSConfig(p.accessControl.TLS)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to set up TLS for the proxy listener")
+		}
+		server.TLSConfig = tlsConfig
+		// CONNECT requests need to be hijacked, which is not possible with HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		listenerTLSInfo = &p.accessControl.TLS.TLSInfo
+	}
+
+	if p.transparent != nil && p.transparent.ListenAddress != "" {
+		if err := p.startTransparentListener(controller, handler); err != nil {
+			p.closeListeners()
+			return nil, nil, err
+		}
+	}
+
+	if p.socks5 != nil && p.socks5.ListenAddress != "" {
+		if err := p.startSocks5Listener(controller, handler); err != nil {
+			p.closeListeners()
+			return nil, nil, err
+		}
+	}
+
+	p.handler = handler
+	p.server = server
+	return server, listenerTLSInfo, nil
+}
+
+// accessControlHandler rejects requests from clients that are not allowed to use the proxy,
+// and strips the proxy credentials from the others before passing them on to handler.
+func (p *MitmProxy) accessControlHandler(controller *accessController, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !controller.allowedAddr(request.RemoteAddr) {
+			log.Warnf("Denying request %s from %s: IP not allowed", requestToString(request), request.RemoteAddr)
+			p.incrementMetricCounter(ForbiddenRequestCounter, request)
+			http.Error(writer, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if !controller.authenticated(request) {
+			log.Warnf("Denying request %s from %s: authentication required", requestToString(request), request.RemoteAddr)
+			p.incrementMetricCounter(UnauthenticatedRequestCounter, request)
+			writer.Header().Set(proxyAuthenticateHeader, fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+			http.Error(writer, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		request.Header.Del(proxyAuthorizationHeader)
+
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func (p *MitmProxy) startTransparentListener(controller *accessController, handler *mitmHandler) error {
+	listener, err := p.listen("transparent", p.transparent.ListenAddress, controller)
+	if err != nil {
 		return err
 	}
 
-	log.Infof("Proxy closed")
+	go func() {
+		err := handler.serveTransparent(listener, p.transparent)
+		log.Infof("Transparent listener closed: %v", err)
+	}()
+
+	return nil
+}
+
+func (p *MitmProxy) startSocks5Listener(controller *accessController, handler *mitmHandler) error {
+	listener, err := p.listen("SOCKS5", p.socks5.ListenAddress, controller)
+	if err != nil {
+		return err
+	}
+
+	server := &socks5Server{
+		handler:    handler,
+		controller: controller,
+		unauthenticated: func(conn net.Conn) {
+			p.incrementMetricCounter(UnauthenticatedRequestCounter, connectRequest(conn.LocalAddr().String()))
+		},
+		handshakeTimeout: p.socks5HandshakeTimeout,
+	}
+	go func() {
+		err := server.serve(listener)
+		log.Infof("SOCKS5 listener closed: %v", err)
+	}()
+
 	return nil
 }
 
+// listen starts listening on address, and only lets in the connections from clients with allowed IPs.
+func (p *MitmProxy) listen(name, address string, controller *accessController) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to start %s listener", name)
+	}
+	p.listeners = append(p.listeners, listener)
+
+	log.Infof("Proxy listening for %s connections on %s", name, address)
+
+	return &filteringListener{
+		Listener: listener,
+		allowed: func(conn net.Conn) bool {
+			if controller.allowedAddr(conn.RemoteAddr().String()) {
+				return true
+			}
+			log.Warnf("Denying %s connection from %s: IP not allowed", name, conn.RemoteAddr())
+			p.incrementMetricCounter(ForbiddenRequestCounter, connectRequest(conn.LocalAddr().String()))
+			return false
+		},
+	}, nil
+}
+
+// closeListeners expects the lifecycle lock to be held.
+func (p *MitmProxy) closeListeners() {
+	for _, listener := range p.listeners {
+		if err := listener.Close(); err != nil {
+			log.Warnf("Error closing listener on %s: %v", listener.Addr(), err)
+		}
+	}
+	p.listeners = nil
+}
+
 type writerWrapper struct {
 	http.ResponseWriter
 	written    int64
@@ -146,13 +499,21 @@ func (w *writerWrapper) Write(data []byte) (int, error) {
 func (p *MitmProxy) RequestHandler(upstream http.Handler, writer http.ResponseWriter, request *http.Request) {
 	startedAt := time.Now()
 	wrapper := &writerWrapper{ResponseWriter: writer}
+	// allows the hijacker to set labels on this request's metrics, fields on its access log entry,
+	// and to report its own metrics
+	request = withMetricsReporter(withAccessLogRecorder(withMetricLabelsRecorder(request)), p)
+
+	var span trace.Span
+	if p.tracing != nil {
+		request, span = p.tracing.startRequestSpan(request)
+	}
 
 	requestStr := requestToString(request)
 	log.Tracef("Request headers for %s: %v", requestStr, request.Header)
 
-	hijacked, response, err := p.hijacker.RequestHandler(wrapper, request)
-	if err != nil {
-		log.Errorf("Error from hijacker when handling request %s, forwarding upstream: %v", requestStr, err)
+	hijacked, response, hijackerErr := p.hijacker.RequestHandler(wrapper, request)
+	if hijackerErr != nil {
+		log.Errorf("Error from hijacker when handling request %s, forwarding upstream: %v", requestStr, hijackerErr)
 		p.incrementMetricCounter(HijackingErrorsCounter, request)
 		hijacked = false
 	}
@@ -160,6 +521,31 @@ func (p *MitmProxy) RequestHandler(upstream http.Handler, writer http.ResponseWr
 	defer func() {
 		elapsed := time.Since(startedAt)
 
+		status := wrapper.statusCode
+		if status == 0 {
+			// nothing written, or written without calling WriteHeader first
+			status = http.StatusOK
+		}
+
+		if span != nil {
+			span.SetAttributes(
+				hijackedAttribute.Bool(hijacked),
+				semconv.HTTPStatusCodeKey.Int(status),
+				semconv.HTTPResponseContentLengthKey.Int64(wrapper.written))
+			endSpan(span, hijackerErr)
+		}
+
+		if p.accessLog != nil {
+			p.accessLog.log(&accessLogEntry{
+				request:  request,
+				hijacked: hijacked,
+				status:   status,
+				bytes:    wrapper.written,
+				duration: elapsed,
+				err:      hijackerErr,
+			})
+		}
+
 		var logVerb string
 		if hijacked {
 			p.incrementMetricCounter(HijackedRequestCounter, request)
@@ -207,23 +593,71 @@ func (p *MitmProxy) RequestHandler(upstream http.Handler, writer http.ResponseWr
 		}
 	} else if !hijacked {
 		upstream.ServeHTTP(wrapper, request)
+
+		if observer, ok := p.hijacker.(ForwardedResponseObserver); ok {
+			statusCode := wrapper.statusCode
+			if statusCode == 0 {
+				statusCode = http.StatusOK
+			}
+			observer.ObserveForwardedResponse(request, statusCode, wrapper.Header())
+		}
 	}
 }
 
 func (p *MitmProxy) incrementMetricCounter(metricName MitmProxyStatsdMetricName, request *http.Request) {
-	if metricNameStr := p.metricName(metricName, request); metricNameStr != "" {
-		if err := p.statsdClient.Inc(metricNameStr, 1, 1); err != nil {
+	p.addToMetricCounter(metricName, request, 1)
+}
+
+func (p *MitmProxy) addToMetricCounter(metricName MitmProxyStatsdMetricName, request *http.Request, value int64) {
+	if taggedClient, ok := p.statsdClient.(TaggedStatSender); ok {
+		if metricNameStr, tags := p.taggedMetricName(metricName, request); metricNameStr != "" {
+			if err := taggedClient.IncWithTags(metricNameStr, value, 1, tags); err != nil {
+				log.Warnf("Unable to increment metric counter %q: %v", metricNameStr, err)
+			}
+		}
+	} else if metricNameStr := p.metricName(metricName, request); metricNameStr != "" {
+		if err := p.statsdClient.Inc(metricNameStr, value, 1); err != nil {
 			log.Warnf("Unable to increment metric counter %q: %v", metricNameStr, err)
 		}
 	}
+	if labels := p.metricLabels(metricName, request); labels != nil {
+		p.prometheus.add(metricName, labels, value)
+	}
 }
 
 func (p *MitmProxy) reportMetricDuration(metricName MitmProxyStatsdMetricName, request *http.Request, d time.Duration) {
-	if metricNameStr := p.metricName(metricName, request); metricNameStr != "" {
+	if taggedClient, ok := p.statsdClient.(TaggedStatSender); ok {
+		if metricNameStr, tags := p.taggedMetricName(metricName, request); metricNameStr != "" {
+			if err := taggedClient.TimingDurationWithTags(metricNameStr, d, 1, tags); err != nil {
+				log.Warnf("Unable to report metric duration %q: %v", metricNameStr, err)
+			}
+		}
+	} else if metricNameStr := p.metricName(metricName, request); metricNameStr != "" {
 		if err := p.statsdClient.TimingDuration(metricNameStr, d, 1); err != nil {
 			log.Warnf("Unable to report metric duration %q: %v", metricNameStr, err)
 		}
 	}
+	if labels := p.metricLabels(metricName, request); labels != nil {
+		p.prometheus.observeDuration(metricName, labels, d)
+	}
+}
+
+// CountConfigReload reports the outcome of a config reload, err being nil if it succeeded; these metric
+// points don't relate to any request, so they don't go through the hijacker's hooks.
+func (p *MitmProxy) CountConfigReload(err error) {
+	metricName := ConfigReloadCounter
+	if err != nil {
+		metricName = ConfigReloadFailureCounter
+	}
+
+	if p.statsdClient != nil {
+		if err := p.statsdClient.Inc(string(metricName), 1, 1); err != nil {
+			log.Warnf("Unable to increment metric counter %q: %v", metricName, err)
+		}
+	}
+	if p.prometheus != nil {
+		p.prometheus.add(metricName, MetricLabels{}, 1)
+	}
 }
 
 func (p *MitmProxy) metricName(metricName MitmProxyStatsdMetricName, request *http.Request) string {
@@ -233,6 +667,18 @@ func (p *MitmProxy) metricName(metricName MitmProxyStatsdMetricName, request *ht
 	return strings.TrimSpace(p.hijacker.TransformMetricName(metricName, request))
 }
 
+func (p *MitmProxy) taggedMetricName(metricName MitmProxyStatsdMetricName, request *http.Request) (string, MetricTags) {
+	name, tags := p.hijacker.TaggedMetricName(metricName, request)
+	return strings.TrimSpace(name), tags
+}
+
+func (p *MitmProxy) metricLabels(metricName MitmProxyStatsdMetricName, request *http.Request) MetricLabels {
+	if p.prometheus == nil {
+		return nil
+	}
+	return collectMetricLabels(p.hijacker, metricName, request)
+}
+
 func (p *MitmProxy) loadCA() (cert tls.Certificate, err error) {
 	cert, err = tls.LoadX509KeyPair(p.ca.CertPath, p.ca.KeyPath)
 	if err == nil {
@@ -241,11 +687,64 @@ func (p *MitmProxy) loadCA() (cert tls.Certificate, err error) {
 	return
 }
 
+// CheckReadiness reports the proxy as ready once it has loaded its CA and is listening.
+func (p *MitmProxy) CheckReadiness(context.Context) (bool, interface{}) {
+	if atomic.LoadInt32(&p.ready) == 0 {
+		return false, "not listening"
+	}
+	return true, fmt.Sprintf("listening on %s", p.listenAddr)
+}
+
+// Stop closes all connections right away, including intercepted and tunneled ones; see Shutdown
+// to stop gracefully.
+// If the proxy hasn't started yet, it returns an error, and the proxy won't start either.
 func (p *MitmProxy) Stop() error {
-	if p.server == nil {
+	server, handler := p.stop()
+	if server == nil {
 		return errors.New("Proxy not started yet")
 	}
-	return p.server.Shutdown(context.Background())
+	handler.conns.closeAll()
+	return server.Close()
+}
+
+// Shutdown stops the proxy gracefully: it stops accepting connections and reports itself as not ready,
+// then waits for in-flight requests and tunnels to be done. Once ctx is done, it closes the remaining
+// connections, and returns ctx's error.
+// If the proxy hasn't started yet, it won't, and Start returns right away.
+func (p *MitmProxy) Shutdown(ctx context.Context) error {
+	server, handler := p.stop()
+	if server == nil {
+		return nil
+	}
+
+	// requests on intercepted connections don't go through the server, and vice versa
+	hijackedDrained := make(chan error, 1)
+	go func() {
+		hijackedDrained <- handler.conns.drain(ctx)
+	}()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		if closeErr := server.Close(); closeErr != nil {
+			log.Warnf("Error closing proxy server: %v", closeErr)
+		}
+	}
+	if hijackedErr := <-hijackedDrained; err == nil {
+		err = hijackedErr
+	}
+	return err
+}
+
+// stop marks the proxy as stopped and not ready, and closes its listeners other than the server's;
+// returns its server and handler, nil if it hasn't started yet.
+func (p *MitmProxy) stop() (*http.Server, *mitmHandler) {
+	p.lifecycleMutex.Lock()
+	defer p.lifecycleMutex.Unlock()
+
+	p.stopped = true
+	atomic.StoreInt32(&p.ready, 0)
+	p.closeListeners()
+	return p.server, p.handler
 }
 
 func requestToString(request *http.Request) string {
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -342,14 +343,399 @@ func TestMitmProxy(t *testing.T) {
 	})
 }
 
+func TestMitmProxyInterceptsAllConnectRequests(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+
+	hijacker := &nonInterceptingHijacker{
+		testMitmHijacker: &testMitmHijacker{
+			DefaultMitmHijacker: &DefaultMitmHijacker{},
+			t:                   t,
+		},
+	}
+	statsdClient := &testStatsdClient{}
+	proxyPort, proxyCleanup := withTestProxy(t, hijacker, statsdClient)
+	defer proxyCleanup()
+
+	proxyURL, err := url.Parse("http://" + localhostAddr(proxyPort))
+	require.NoError(t, err)
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsClientConfig(t),
+			Proxy:           http.ProxyURL(proxyURL),
+		},
+	}
+
+	// ShouldIntercept only applies to transparent and SOCKS5 connections
+	resp, respBody := makeRequest(t, proxyClient, baseURL, "/ok")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ok, respBody)
+	// and the client sees the proxy's forged certificate
+	assert.Equal(t, "localhost", peerCommonName(resp))
+
+	assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+	assert.Nil(t, hijacker.reset())
+	assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+}
+
+func TestMitmProxyTaggedMetrics(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+
+	hijacker := &taggingHijacker{
+		testMitmHijacker: &testMitmHijacker{
+			DefaultMitmHijacker: &DefaultMitmHijacker{},
+			t:                   t,
+			upstreamClient: &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: tlsClientConfig(t),
+				},
+			},
+			baseURL: baseURL,
+		},
+	}
+	statsdClient := &testTaggedStatsdClient{}
+	proxyPort, proxyCleanup := withTestProxy(t, hijacker, statsdClient)
+	defer proxyCleanup()
+	proxyClient := newProxyClient(t, "http://"+localhostAddr(proxyPort), tlsClientConfig(t))
+
+	// the hijacker's TaggedMetricName is used instead of its TransformMetricName
+	resp, _ := makeRequest(t, proxyClient, baseURL, "/ok_transform_metric")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []statsdCall{{
+		methodName: "IncWithTags",
+		stat:       string(HijackedRequestCounter),
+		valueInt:   1,
+		rate:       1,
+		tags:       MetricTags{"path": "/ok_transform_metric"},
+	}}, statsdClient.reset())
+
+	// and it can still choose not to emit metric points
+	resp, _ = makeRequest(t, proxyClient, baseURL, "/ok")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, statsdClient.reset())
+}
+
+func TestMitmProxyShutdown(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	upstreamAddress := localhostAddr(upstreamPort)
+	baseURL := "https://" + upstreamAddress
+
+	newHijacker := func() *testMitmHijacker {
+		return &testMitmHijacker{
+			DefaultMitmHijacker: &DefaultMitmHijacker{},
+			t:                   t,
+			upstreamClient: &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: tlsClientConfig(t),
+				},
+			},
+			baseURL: baseURL,
+		}
+	}
+
+	t.Run("it waits for in-flight requests on intercepted connections", func(t *testing.T) {
+		proxy, proxyPort, proxyCleanup := withStartedTestProxy(t, newHijacker())
+		defer proxyCleanup()
+		proxyClient := newProxyClient(t, "http://"+localhostAddr(proxyPort), tlsClientConfig(t))
+
+		responseStatus := make(chan int, 1)
+		go func() {
+			resp, _ := makeRequest(t, proxyClient, baseURL, "/hijack_to_slow")
+			responseStatus <- resp.StatusCode
+		}()
+		waitForUpstreamRoute(t, upstreamServer, "/slow")
+
+		ctx, cancel := context.WithTimeout(context.Background(), genericTestTimeout)
+		defer cancel()
+		require.NoError(t, proxy.Shutdown(ctx))
+
+		assert.Equal(t, http.StatusOK, <-responseStatus)
+		ready, _ := proxy.CheckReadiness(context.Background())
+		assert.False(t, ready)
+
+		// and it doesn't accept new connections
+		_, err := net.Dial("tcp", localhostAddr(proxyPort))
+		assert.Error(t, err)
+	})
+
+	t.Run("it closes connections still open at the end of the grace period", func(t *testing.T) {
+		proxy, proxyPort, proxyCleanup := withStartedTestProxy(t, newHijacker())
+		defer proxyCleanup()
+
+		conn, err := net.Dial("tcp", localhostAddr(proxyPort))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamAddress, upstreamAddress)
+		require.NoError(t, err)
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		// the client never starts the TLS handshake
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, proxy.Shutdown(ctx))
+
+		// the connection's been closed
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(genericTestTimeout)))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("shut down before starting, it doesn't start", func(t *testing.T) {
+		ca, caCleanup := withTestCAFiles(t)
+		defer caCleanup()
+		port := getAvailablePort(t)
+		proxy := NewMitmProxy(localhostAddr(port), ca, newHijacker(), nil)
+
+		require.NoError(t, proxy.Shutdown(context.Background()))
+
+		started := make(chan error, 1)
+		go func() {
+			started <- proxy.Start()
+		}()
+		select {
+		case err := <-started:
+			assert.NoError(t, err)
+		case <-time.After(genericTestTimeout):
+			t.Fatalf("Start didn't return")
+		}
+
+		_, err := net.Dial("tcp", localhostAddr(port))
+		assert.Error(t, err)
+	})
+
+	t.Run("stopped before starting, it errors out, and doesn't start", func(t *testing.T) {
+		ca, caCleanup := withTestCAFiles(t)
+		defer caCleanup()
+		port := getAvailablePort(t)
+		proxy := NewMitmProxy(localhostAddr(port), ca, newHijacker(), nil)
+
+		assert.EqualError(t, proxy.Stop(), "Proxy not started yet")
+		assert.NoError(t, proxy.Start())
+
+		_, err := net.Dial("tcp", localhostAddr(port))
+		assert.Error(t, err)
+	})
+}
+
+func TestMitmProxyCheckReadiness(t *testing.T) {
+	ca, caCleanup := withTestCAFiles(t)
+	defer caCleanup()
+
+	proxy := NewMitmProxy(localhostAddr(getAvailablePort(t)), ca, nil, nil)
+
+	ready, _ := proxy.CheckReadiness(context.Background())
+	assert.False(t, ready)
+
+	listeningChan := make(chan interface{})
+	go func() {
+		require.NoError(t, proxy.start(listeningChan, tlsClientConfig(t)))
+	}()
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for test mitm server to start listening")
+	}
+
+	ready, _ = proxy.CheckReadiness(context.Background())
+	assert.True(t, ready)
+
+	require.NoError(t, proxy.Stop())
+	ready, _ = proxy.CheckReadiness(context.Background())
+	assert.False(t, ready)
+}
+
+func TestMitmProxyHTTP2(t *testing.T) {
+	upstreamServer := &connTrackingHandler{
+		Handler: &dummyUpstreamServer{
+			t: t,
+		},
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+
+	hijacker := &testMitmHijacker{
+		DefaultMitmHijacker: &DefaultMitmHijacker{},
+		t:                   t,
+	}
+
+	// makes a first request, and then concurrentRequests concurrent requests, all to /ok
+	makeConcurrentRequests := func(t *testing.T, proxyClient *http.Client, concurrentRequests int) (clientProtos []string) {
+		resp, respBody := makeRequest(t, proxyClient, baseURL, "/ok")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ok, respBody)
+		clientProtos = append(clientProtos, resp.Proto)
+
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		for i := 0; i < concurrentRequests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				resp, respBody := makeRequest(t, proxyClient, baseURL, "/ok")
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, ok, respBody)
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				clientProtos = append(clientProtos, resp.Proto)
+			}()
+		}
+		wg.Wait()
+
+		return
+	}
+
+	t.Run("it speaks HTTP/2 on both sides, and concurrent requests share a single upstream connection", func(t *testing.T) {
+		upstreamServer.reset()
+
+		proxyPort, proxyCleanup := withTestProxy(t, hijacker, &testStatsdClient{})
+		defer proxyCleanup()
+
+		proxyClient := newHTTP2ProxyClient(t, proxyPort)
+		clientProtos := makeConcurrentRequests(t, proxyClient, 10)
+
+		assert.Equal(t, 11, len(clientProtos))
+		for _, proto := range clientProtos {
+			assert.Equal(t, "HTTP/2.0", proto)
+		}
+
+		protos, connections := upstreamServer.reset()
+		assert.Equal(t, 11, len(protos))
+		for _, proto := range protos {
+			assert.Equal(t, "HTTP/2.0", proto)
+		}
+		assert.Equal(t, 1, connections)
+	})
+
+	t.Run("HTTP/2 can be disabled, and the number of connections per host limited", func(t *testing.T) {
+		upstreamServer.reset()
+
+		proxyPort, proxyCleanup := withTestProxy(t, hijacker, &testStatsdClient{}, WithUpstreamConnections(&UpstreamConnectionsConfig{
+			MaxConnsPerHost: 2,
+			DisableHTTP2:    true,
+		}))
+		defer proxyCleanup()
+
+		proxyClient := newHTTP2ProxyClient(t, proxyPort)
+		clientProtos := makeConcurrentRequests(t, proxyClient, 10)
+
+		assert.Equal(t, 11, len(clientProtos))
+		for _, proto := range clientProtos {
+			assert.Equal(t, "HTTP/1.1", proto)
+		}
+
+		protos, connections := upstreamServer.reset()
+		assert.Equal(t, 11, len(protos))
+		for _, proto := range protos {
+			assert.Equal(t, "HTTP/1.1", proto)
+		}
+		assert.True(t, connections <= 2, "%d upstream connections", connections)
+	})
+}
+
 /*** Helpers below ***/
 
+// a nonInterceptingHijacker doesn't intercept any connection.
+type nonInterceptingHijacker struct {
+	*testMitmHijacker
+
+	seenAddresses []string
+	mutex         sync.Mutex
+}
+
+func (h *nonInterceptingHijacker) ShouldIntercept(address string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seenAddresses = append(h.seenAddresses, address)
+	return false
+}
+
+func (h *nonInterceptingHijacker) reset() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	addresses := h.seenAddresses
+	h.seenAddresses = nil
+	return addresses
+}
+
+// a connTrackingHandler records the protocol of each request, as well as how many
+// different connections these requests came from.
+type connTrackingHandler struct {
+	http.Handler
+
+	protos      []string
+	remoteAddrs map[string]bool
+	mutex       sync.Mutex
+}
+
+func (h *connTrackingHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	h.mutex.Lock()
+	h.protos = append(h.protos, request.Proto)
+	if h.remoteAddrs == nil {
+		h.remoteAddrs = make(map[string]bool)
+	}
+	h.remoteAddrs[request.RemoteAddr] = true
+	h.mutex.Unlock()
+
+	h.Handler.ServeHTTP(writer, request)
+}
+
+func (h *connTrackingHandler) reset() (protos []string, connections int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	protos, connections = h.protos, len(h.remoteAddrs)
+	h.protos, h.remoteAddrs = nil, nil
+	return
+}
+
+// returns a client that goes through the proxy, and is willing to speak HTTP/2 to upstream servers.
+func newHTTP2ProxyClient(t *testing.T, proxyPort int) *http.Client {
+	proxyURL, err := url.Parse("http://" + localhostAddr(proxyPort))
+	require.NoError(t, err)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsClientConfig(t),
+			Proxy:             http.ProxyURL(proxyURL),
+			ForceAttemptHTTP2: true,
+		},
+	}
+}
+
+// returns the common name of the certificate the server presented.
+func peerCommonName(response *http.Response) string {
+	if response.TLS == nil || len(response.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return response.TLS.PeerCertificates[0].Subject.CommonName
+}
+
 // sets up a test MitmProxy, and returns its port as well as a function to tear it down when done testing.
-func withTestProxy(t *testing.T, hijacker MitmHijacker, statsdClient statsd.StatSender) (int, func()) {
+func withTestProxy(t *testing.T, hijacker MitmHijacker, statsdClient statsd.StatSender, opts ...MitmProxyOption) (int, func()) {
 	ca, caCleanup := withTestCAFiles(t)
 
 	port := getAvailablePort(t)
-	proxy := NewMitmProxy(localhostAddr(port), ca, hijacker, statsdClient)
+	proxy := NewMitmProxy(localhostAddr(port), ca, hijacker, statsdClient, opts...)
 
 	listeningChan := make(chan interface{})
 
@@ -369,6 +755,47 @@ func withTestProxy(t *testing.T, hijacker MitmHijacker, statsdClient statsd.Stat
 	}
 }
 
+// same as withTestProxy, but also returns the proxy; the cleanup function doesn't require it to still
+// be running.
+func withStartedTestProxy(t *testing.T, hijacker MitmHijacker) (*MitmProxy, int, func()) {
+	ca, caCleanup := withTestCAFiles(t)
+
+	port := getAvailablePort(t)
+	proxy := NewMitmProxy(localhostAddr(port), ca, hijacker, nil)
+
+	listeningChan := make(chan interface{})
+	go func() {
+		require.NoError(t, proxy.start(listeningChan, tlsClientConfig(t)))
+	}()
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for test mitm server to start listening on %d", port)
+	}
+
+	return proxy, port, func() {
+		caCleanup()
+		_ = proxy.Stop()
+	}
+}
+
+// waits until the upstream server has started serving route.
+func waitForUpstreamRoute(t *testing.T, server *dummyUpstreamServer, route string) {
+	deadline := time.Now().Add(genericTestTimeout)
+	for time.Now().Before(deadline) {
+		server.mutex.Lock()
+		for _, visited := range server.visitedRoutes {
+			if visited == route {
+				server.mutex.Unlock()
+				return
+			}
+		}
+		server.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for upstream to serve %s", route)
+}
+
 // sets up a dummy server, and returns its port as well as a function to tear it down when done testing.
 func withDummyUpstreamServer(t *testing.T, handler http.Handler) (int, func()) {
 	tlsInfo, tlsCleanup := withTestServerTLSFiles(t)
@@ -400,3 +827,15 @@ func withDummyUpstreamServer(t *testing.T, handler http.Handler) (int, func()) {
 		require.NoError(t, server.Shutdown(ctx))
 	}
 }
+
+// a taggingHijacker tags metric points with the request's path, and doesn't emit any for /ok.
+type taggingHijacker struct {
+	*testMitmHijacker
+}
+
+func (h *taggingHijacker) TaggedMetricName(name MitmProxyStatsdMetricName, request *http.Request) (string, MetricTags) {
+	if request.URL.Path == "/ok" {
+		return "", nil
+	}
+	return string(name), MetricTags{"path": request.URL.Path}
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package pkg
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// originalDestination returns the address the client was originally trying to connect to, before its
+// connection got redirected to us by netfilter; or an error if the connection wasn't redirected.
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errNoOriginalDestination
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	isIPv6 := false
+	if localAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		isIPv6 = localAddr.IP.To4() == nil
+	}
+
+	var (
+		address    string
+		sockoptErr error
+	)
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if isIPv6 {
+			// the IPv6MTUInfo struct starts with a sockaddr_in6, which is what the kernel returns
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockoptErr = err
+				return
+			}
+			port := int(info.Addr.Port>>8) | int(info.Addr.Port&0xff)<<8
+			address = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(port))
+		} else {
+			// the IPv6Mreq struct is large enough to hold the sockaddr_in the kernel returns
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockoptErr = err
+				return
+			}
+			port := int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])
+			address = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(port))
+		}
+	})
+	if controlErr != nil {
+		return "", controlErr
+	}
+	if sockoptErr != nil {
+		return "", errors.Wrap(sockoptErr, "getsockopt SO_ORIGINAL_DST failed")
+	}
+
+	// if the connection wasn't redirected, the kernel may just return our own address
+	if address == conn.LocalAddr().String() {
+		return "", errNoOriginalDestination
+	}
+	return address, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package pkg
+
+import "net"
+
+// originalDestination is only supported on Linux, elsewhere transparent connections are routed
+// solely based on SNI.
+func originalDestination(net.Conn) (string, error) {
+	return "", errNoOriginalDestination
+}
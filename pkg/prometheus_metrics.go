@@ -0,0 +1,269 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPrometheusNamespace = "kraken_proxy"
+	defaultPrometheusPath      = "/metrics"
+)
+
+// The labels set on Prometheus metrics; hijackers can provide values for them with MetricLabels.
+const (
+	// The registry host the request was addressed to.
+	HostLabel = "host"
+
+	// The type of registry query, e.g. manifest or blob.
+	QueryTypeLabel = "query_type"
+
+	// The address of the redirect registry that served the request.
+	RedirectLabel = "redirect"
+
+	// How the request ended up being served.
+	OutcomeLabel = "outcome"
+
+	// The class of the status code of a response from a registry, e.g. 2xx, or "error" if there was none.
+	StatusClassLabel = "status_class"
+)
+
+var metricLabelNames = []string{HostLabel, QueryTypeLabel, RedirectLabel, OutcomeLabel, StatusClassLabel}
+
+// MetricLabels are the labels to attach to a Prometheus metric point; only the label names defined above are used.
+type MetricLabels map[string]string
+
+// the help strings for the Prometheus metrics corresponding to the MitmProxyStatsdMetricName constants.
+var prometheusHelp = map[MitmProxyStatsdMetricName]string{
+	HijackedRequestCounter:        "Number of hijacked requests.",
+	ProxiedRequestCounter:         "Number of requests transparently proxied upstream.",
+	HijackedRequestTransferPace:   "Time needed to transmit 1kB for hijacked requests.",
+	ProxiedRequestTransferPace:    "Time needed to transmit 1kB for proxied requests.",
+	HijackingErrorsCounter:        "Number of errors when hijacking requests.",
+	TunneledConnectionCounter:     "Number of connections tunneled to upstream without being intercepted.",
+	ForbiddenRequestCounter:       "Number of requests denied based on the client's IP.",
+	UnauthenticatedRequestCounter: "Number of requests denied because the client failed to authenticate.",
+	RedirectAttemptCounter:        "Number of attempts to get a response from redirect registries.",
+	RedirectSuccessCounter:        "Number of successful attempts to get a response from redirect registries.",
+	RedirectFailureCounter:        "Number of failed attempts to get a response from redirect registries.",
+	OriginFallbackCounter:         "Number of requests sent to the original registry after all redirects failed.",
+	RedirectBytesCounter:          "Number of bytes served to clients from redirect registries.",
+	RedirectTimeToFirstByte:       "Time to get the response headers from redirect registries.",
+	TokenCacheHitCounter:          "Number of registry tokens served from the cache.",
+	TokenCacheMissCounter:         "Number of registry tokens not in the cache, that needed fetching.",
+	TokenFetchCounter:             "Number of tokens fetched from registries' token servers, including background refreshes.",
+	ConfigReloadCounter:           "Number of times the config got reloaded.",
+	ConfigReloadFailureCounter:    "Number of times a new config got rejected when trying to reload it.",
+}
+
+// the buckets for histograms, in seconds: from 10µs to about 2.5s (per kB) for paces, and the
+// client's defaults for durations
+var histogramBuckets = map[MitmProxyStatsdMetricName][]float64{
+	HijackedRequestTransferPace: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	ProxiedRequestTransferPace:  prometheus.ExponentialBuckets(0.00001, 4, 10),
+	RedirectTimeToFirstByte:     prometheus.DefBuckets,
+}
+
+// PrometheusMetrics exposes the same metrics a MitmProxy sends to statsd as labeled Prometheus counters
+// and histograms; it's a http.Handler serving them.
+type PrometheusMetrics struct {
+	config   *PrometheusConfig
+	registry *prometheus.Registry
+
+	counters   map[MitmProxyStatsdMetricName]*prometheus.CounterVec
+	histograms map[MitmProxyStatsdMetricName]*prometheus.HistogramVec
+
+	handler http.Handler
+	server  *http.Server
+}
+
+// NewPrometheusMetrics returns nil if Prometheus is not configured.
+func NewPrometheusMetrics(config *Config) (*PrometheusMetrics, error) {
+	if config == nil || config.Prometheus == nil {
+		return nil, nil
+	}
+
+	namespace := config.Prometheus.Namespace
+	if namespace == "" {
+		namespace = defaultPrometheusNamespace
+	}
+
+	metrics := &PrometheusMetrics{
+		config:     config.Prometheus,
+		registry:   prometheus.NewRegistry(),
+		counters:   make(map[MitmProxyStatsdMetricName]*prometheus.CounterVec),
+		histograms: make(map[MitmProxyStatsdMetricName]*prometheus.HistogramVec),
+	}
+
+	for metricName, help := range prometheusHelp {
+		name := strings.ReplaceAll(string(metricName), ".", "_")
+
+		var collector prometheus.Collector
+		if buckets, isTimingMetric := histogramBuckets[metricName]; isTimingMetric {
+			histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      name + "_seconds",
+				Help:      help,
+				Buckets:   buckets,
+			}, metricLabelNames)
+			metrics.histograms[metricName] = histogram
+			collector = histogram
+		} else {
+			counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      name + "_total",
+				Help:      help,
+			}, metricLabelNames)
+			metrics.counters[metricName] = counter
+			collector = counter
+		}
+
+		if err := metrics.registry.Register(collector); err != nil {
+			return nil, errors.Wrapf(err, "unable to register Prometheus metric for %q", metricName)
+		}
+	}
+
+	metrics.handler = promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+
+	return metrics, nil
+}
+
+func (m *PrometheusMetrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	m.handler.ServeHTTP(writer, request)
+}
+
+// Start serves the metrics on the configured listen address, if any; it's a blocking call.
+func (m *PrometheusMetrics) Start() error {
+	return m.start(nil)
+}
+
+// If passed a listeningChan, it will close it when it's started listening.
+func (m *PrometheusMetrics) start(listeningChan chan interface{}) error {
+	if m.config.ListenAddress == "" {
+		return errors.New("no listen address configured for Prometheus metrics")
+	}
+	if m.server != nil {
+		return errors.New("Prometheus metrics server already started")
+	}
+
+	path := m.config.Path
+	if path == "" {
+		path = defaultPrometheusPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, m)
+
+	m.server = &http.Server{
+		Addr:    m.config.ListenAddress,
+		Handler: mux,
+	}
+
+	startedLogLine := fmt.Sprintf("Serving Prometheus metrics on %s%s", m.config.ListenAddress, path)
+	return startHTTPServer(m.server, listeningChan, nil, startedLogLine)
+}
+
+func (m *PrometheusMetrics) Stop() error {
+	if m.server == nil {
+		return errors.New("Prometheus metrics server not started yet")
+	}
+	return m.server.Shutdown(context.Background())
+}
+
+func (m *PrometheusMetrics) add(metricName MitmProxyStatsdMetricName, labels MetricLabels, value int64) {
+	if counter, present := m.counters[metricName]; present {
+		counter.With(prometheusLabels(labels)).Add(float64(value))
+	} else {
+		log.Warnf("Unknown Prometheus counter %q", metricName)
+	}
+}
+
+func (m *PrometheusMetrics) observeDuration(metricName MitmProxyStatsdMetricName, labels MetricLabels, d time.Duration) {
+	if histogram, present := m.histograms[metricName]; present {
+		histogram.With(prometheusLabels(labels)).Observe(d.Seconds())
+	} else {
+		log.Warnf("Unknown Prometheus histogram %q", metricName)
+	}
+}
+
+// prometheusLabels returns a value for each of the known labels, defaulting to empty strings.
+func prometheusLabels(labels MetricLabels) prometheus.Labels {
+	result := make(prometheus.Labels, len(metricLabelNames))
+	for _, name := range metricLabelNames {
+		result[name] = labels[name]
+	}
+	return result
+}
+
+type metricLabelsContextKey struct{}
+
+// recordedMetricLabels holds the labels that hijackers record while handling a request.
+type recordedMetricLabels struct {
+	labels MetricLabels
+	mutex  sync.Mutex
+}
+
+// withMetricLabelsRecorder returns a copy of the request that SetMetricLabel can record labels on.
+func withMetricLabelsRecorder(request *http.Request) *http.Request {
+	ctx := context.WithValue(request.Context(), metricLabelsContextKey{}, &recordedMetricLabels{labels: make(MetricLabels)})
+	return request.WithContext(ctx)
+}
+
+// SetMetricLabel can be called by hijackers from their RequestHandler, to set a label on all the metric
+// points emitted for that request; labels returned by MetricLabels take precedence.
+func SetMetricLabel(request *http.Request, name, value string) {
+	if recorded, ok := request.Context().Value(metricLabelsContextKey{}).(*recordedMetricLabels); ok {
+		recorded.mutex.Lock()
+		defer recorded.mutex.Unlock()
+
+		recorded.labels[name] = value
+	}
+}
+
+// GetMetricLabel returns the value of a label recorded on the request, either with SetMetricLabel or
+// for the metric point being reported with AddToMetricCounter or ReportMetricDuration.
+func GetMetricLabel(request *http.Request, name string) string {
+	if recorded, ok := request.Context().Value(metricLabelsContextKey{}).(*recordedMetricLabels); ok {
+		recorded.mutex.Lock()
+		defer recorded.mutex.Unlock()
+
+		return recorded.labels[name]
+	}
+	return ""
+}
+
+// recordedLabels returns a copy of the labels recorded on the request.
+func recordedLabels(request *http.Request) MetricLabels {
+	result := make(MetricLabels)
+	if recorded, ok := request.Context().Value(metricLabelsContextKey{}).(*recordedMetricLabels); ok {
+		recorded.mutex.Lock()
+		for name, value := range recorded.labels {
+			result[name] = value
+		}
+		recorded.mutex.Unlock()
+	}
+	return result
+}
+
+// collectMetricLabels merges the labels recorded on the request with the ones returned by the hijacker's
+// MetricLabels; returns nil if the metric point should not be emitted.
+func collectMetricLabels(hijacker MitmHijacker, metricName MitmProxyStatsdMetricName, request *http.Request) MetricLabels {
+	labels := hijacker.MetricLabels(metricName, request)
+	if labels == nil {
+		return nil
+	}
+
+	result := recordedLabels(request)
+	for name, value := range labels {
+		result[name] = value
+	}
+	return result
+}
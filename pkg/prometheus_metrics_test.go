@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+
+	hijacker := &labelingHijacker{
+		testMitmHijacker: &testMitmHijacker{
+			DefaultMitmHijacker: &DefaultMitmHijacker{},
+			t:                   t,
+			upstreamClient: &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: tlsClientConfig(t),
+				},
+			},
+			baseURL: baseURL,
+		},
+	}
+
+	metrics, metricsAddress, metricsCleanup := withTestPrometheusMetrics(t, &PrometheusConfig{Namespace: "test"})
+	defer metricsCleanup()
+
+	// no statsd client, only Prometheus
+	proxyPort, proxyCleanup := withTestProxy(t, hijacker, nil, WithPrometheusMetrics(metrics))
+	defer proxyCleanup()
+
+	proxyURL, err := url.Parse("http://" + localhostAddr(proxyPort))
+	require.NoError(t, err)
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsClientConfig(t),
+			Proxy:           http.ProxyURL(proxyURL),
+		},
+	}
+
+	for _, route := range []string{"/hijack_me", "/hijack_me", "/ok", "/ok_transform_metric", "/hijack_to_stream"} {
+		resp, _ := makeRequest(t, proxyClient, baseURL, route)
+		require.Equal(t, http.StatusOK, resp.StatusCode, route)
+	}
+
+	resp, respBody := makeRequest(t, nil, "http://"+metricsAddress, "/metrics")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	lines := strings.Split(string(respBody), "\n")
+
+	// labels returned by MetricLabels take precedence over the ones set with SetMetricLabel,
+	// and hijackers can choose to not emit metric points (for /ok_transform_metric here)
+	assert.Contains(t, lines, `test_mitm_hijacked_total{host="hijacked.host",outcome="recorded",query_type="",redirect="",status_class=""} 3`)
+	assert.Contains(t, lines, `test_mitm_proxied_total{host="overridden",outcome="",query_type="",redirect="",status_class=""} 1`)
+	// the stream's pace
+	assert.Contains(t, lines, `test_mitm_hijacked_pace_seconds_count{host="hijacked.host",outcome="recorded",query_type="",redirect="",status_class=""} 1`)
+	assert.Contains(t, lines, `# TYPE test_mitm_hijacked_pace_seconds histogram`)
+	// and metrics that haven't been incremented are not exposed yet
+	for _, line := range lines {
+		assert.NotContains(t, line, "test_mitm_tunneled_total")
+	}
+}
+
+func TestSetMetricLabel(t *testing.T) {
+	hijacker := &DefaultMitmHijacker{}
+
+	t.Run("it records labels on requests that have a recorder", func(t *testing.T) {
+		request := withMetricLabelsRecorder(buildGetRequest(t, "https://index.docker.io/v2/"))
+		SetMetricLabel(request, OutcomeLabel, "ok")
+		SetMetricLabel(request, RedirectLabel, "localhost:5000")
+
+		assert.Equal(t, MetricLabels{OutcomeLabel: "ok", RedirectLabel: "localhost:5000"}, collectMetricLabels(hijacker, HijackedRequestCounter, request))
+	})
+
+	t.Run("it's a no-op for other requests", func(t *testing.T) {
+		request := buildGetRequest(t, "https://index.docker.io/v2/")
+		SetMetricLabel(request, OutcomeLabel, "ok")
+
+		assert.Equal(t, MetricLabels{}, collectMetricLabels(hijacker, HijackedRequestCounter, request))
+	})
+}
+
+/*** Helpers below ***/
+
+// a labelingHijacker sets labels on the metrics for hijacked requests, and doesn't emit Prometheus
+// metric points for requests with a transformed metric name.
+type labelingHijacker struct {
+	*testMitmHijacker
+}
+
+func (h *labelingHijacker) RequestHandler(writer http.ResponseWriter, request *http.Request) (bool, *http.Response, error) {
+	SetMetricLabel(request, HostLabel, "overridden")
+	SetMetricLabel(request, OutcomeLabel, "recorded")
+	return h.testMitmHijacker.RequestHandler(writer, request)
+}
+
+func (h *labelingHijacker) MetricLabels(name MitmProxyStatsdMetricName, request *http.Request) MetricLabels {
+	switch {
+	case request.URL.Path == "/ok_transform_metric":
+		return nil
+	case name == HijackedRequestCounter || name == HijackedRequestTransferPace:
+		return MetricLabels{HostLabel: "hijacked.host"}
+	default:
+		return MetricLabels{OutcomeLabel: ""}
+	}
+}
+
+// starts serving Prometheus metrics, and returns the address they're served on.
+func withTestPrometheusMetrics(t *testing.T, config *PrometheusConfig) (*PrometheusMetrics, string, func()) {
+	config.ListenAddress = localhostAddr(getAvailablePort(t))
+	metrics, err := NewPrometheusMetrics(&Config{Prometheus: config})
+	require.NoError(t, err)
+
+	listeningChan := make(chan interface{})
+	go func() {
+		require.NoError(t, metrics.start(listeningChan))
+	}()
+
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for Prometheus metrics server to start listening on %s", config.ListenAddress)
+	}
+
+	return metrics, config.ListenAddress, func() {
+		require.NoError(t, metrics.Stop())
+	}
+}
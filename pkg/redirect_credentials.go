@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/uber/kraken/utils/httputil"
+)
+
+// ClientCredentialsPolicy says what to do with a client's credentials, i.e. its Authorization header, when
+// sending its requests to a redirect.
+type ClientCredentialsPolicy string
+
+const (
+	// the client's credentials don't get forwarded, the redirect gets the credentials configured for it,
+	// if any; the default
+	StripClientCredentials ClientCredentialsPolicy = "strip"
+	// the client's credentials get forwarded as is, the ones configured for the redirect are not used
+	PassClientCredentials ClientCredentialsPolicy = "passthrough"
+	// the client's credentials get swapped for the ones configured for the redirect; clients that send
+	// none get none sent for them either
+	MapClientCredentials ClientCredentialsPolicy = "map"
+
+	// for the origin registry: the client's credentials get forwarded, unless we have our own for it,
+	// which take precedence
+	originClientCredentials ClientCredentialsPolicy = ""
+)
+
+var clientCredentialsPolicies = map[ClientCredentialsPolicy]bool{
+	StripClientCredentials: true,
+	PassClientCredentials:  true,
+	MapClientCredentials:   true,
+}
+
+var (
+	// only meaningful for a single connection, never forwarded to any registry
+	hopByHopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+
+	// meant for the origin registry, never forwarded to redirects, in addition to hop-by-hop headers
+	originOnlyHeaders = []string{
+		"Authorization",
+		"Cookie",
+	}
+)
+
+// forwardedHeaders returns the headers of request to send to a registry, without the ones in stripped
+// (canonical header keys), nor hop-by-hop headers, including the ones the Connection header lists.
+func forwardedHeaders(request *http.Request, stripped map[string]bool) map[string]string {
+	skipped := make(map[string]bool, len(hopByHopHeaders))
+	for _, header := range hopByHopHeaders {
+		skipped[header] = true
+	}
+	for _, value := range request.Header.Values("Connection") {
+		for _, header := range strings.Split(value, ",") {
+			skipped[http.CanonicalHeaderKey(strings.TrimSpace(header))] = true
+		}
+	}
+
+	headers := make(map[string]string, len(request.Header))
+	for key := range request.Header {
+		if !skipped[key] && !stripped[key] {
+			headers[key] = request.Header.Get(key)
+		}
+	}
+	return headers
+}
+
+// redirectStrippedHeaders returns the canonical keys of the headers never to forward to a redirect.
+func redirectStrippedHeaders(extra []string) map[string]bool {
+	stripped := make(map[string]bool, len(originOnlyHeaders)+len(extra))
+	for _, header := range append(append([]string{}, originOnlyHeaders...), extra...) {
+		stripped[http.CanonicalHeaderKey(header)] = true
+	}
+	return stripped
+}
+
+// credentialsOptions returns the options to send a request to the registry with, and sets the
+// Authorization header to send if any, according to policy; authorization is the client's.
+// Also returns whether the request gets sent with our own credentials, if any.
+func credentialsOptions(ctx context.Context, r *registryClient, repository string, policy ClientCredentialsPolicy,
+	authorization string, headers map[string]string, report tokenMetricsReporter) ([]httputil.SendOption, bool, error) {
+
+	switch {
+	case policy == PassClientCredentials, policy == MapClientCredentials && authorization == "":
+		if policy == PassClientCredentials && authorization != "" {
+			headers["Authorization"] = authorization
+		}
+		return unauthenticatedSendOptions(r), false, nil
+	case policy == originClientCredentials && authorization != "":
+		// overridden by the authenticator if we have our own credentials
+		headers["Authorization"] = authorization
+	}
+
+	opts, err := authenticate(ctx, r, repository, report)
+	if err != nil {
+		return nil, false, err
+	}
+	// the authenticator's options can override the transport, but it still
+	// needs to go through the upstream proxy if there's one
+	return append([]httputil.SendOption{httputil.SendTransport(r.transport)}, opts...), true, nil
+}
+
+// unauthenticatedSendOptions returns the options to send requests to the registry without our own
+// credentials, with the same TLS settings as when sending them with our credentials.
+func unauthenticatedSendOptions(r *registryClient) []httputil.SendOption {
+	if r.Security.TLS.Client.Disabled {
+		return []httputil.SendOption{httputil.SendTransport(r.transport)}
+	}
+
+	opts := []httputil.SendOption{httputil.SendTLSTransport(r.transport)}
+	if !r.Security.EnableHTTPFallback {
+		opts = append(opts, httputil.DisableHTTPFallback())
+	}
+	return opts
+}
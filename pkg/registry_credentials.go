@@ -0,0 +1,343 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ecr "github.com/awslabs/amazon-ecr-credential-helper/ecr-login"
+	"github.com/awslabs/amazon-ecr-credential-helper/ecr-login/api"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCredentialsTTL = time.Hour
+	// credentials get refreshed once that fraction of their TTL is left
+	credentialsRefreshFraction = 10
+	// how long to wait before fetching credentials again after failing to
+	credentialsRetryInterval = 30 * time.Second
+
+	credentialHelperPrefix = "docker-credential-"
+	// the ECR helper, which gets called in-process rather than through its binary, like kraken does
+	ecrLoginHelper = "ecr-login"
+	// what helpers reply when they have no credentials for a registry
+	credentialsNotFoundMessage = "credentials not found in native keychain"
+	// the username helpers reply with when the secret is an identity token
+	identityTokenUsername = "<token>"
+
+	// the key for Docker Hub in Docker config files
+	dockerHubConfigKey = "https://index.docker.io/v1/"
+)
+
+var errCredentialsNotFound = errors.New(credentialsNotFoundMessage)
+
+// registryCredentials are the credentials for a registry, as the Docker CLI stores them.
+type registryCredentials struct {
+	username string
+	secret   string
+	// if set, to exchange for tokens instead of the username & secret
+	identityToken string
+}
+
+// dockerConfigFile is the subset of Docker's config.json we care about.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+type dockerConfigAuth struct {
+	// base64-encoded username:password
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// credentialHelperOutput is what helpers print when asked for credentials.
+type credentialHelperOutput struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// refreshingCredentialStore is an auth.CredentialStore that fetches credentials from a Docker config file
+// or a credential helper, and caches them for their TTL; they get refreshed in the background shortly
+// before they expire, so that pulls don't have to wait for it. Only one fetch happens at a time, without
+// holding the lock, and none for credentialsRetryInterval after one fails.
+type refreshingCredentialStore struct {
+	address string
+	config  *CredentialsConfig
+	ttl     time.Duration
+
+	current   *registryCredentials
+	fetchedAt time.Time
+	failedAt  time.Time
+	// closed once the fetch in flight, if any, is done
+	fetching chan struct{}
+	mutex    sync.Mutex
+
+	// allows overriding in tests
+	now func() time.Time
+}
+
+var _ auth.CredentialStore = &refreshingCredentialStore{}
+
+func newRefreshingCredentialStore(address string, config *CredentialsConfig) *refreshingCredentialStore {
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = defaultCredentialsTTL
+	}
+
+	return &refreshingCredentialStore{
+		address: address,
+		config:  config,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+func (s *refreshingCredentialStore) Basic(*url.URL) (string, string) {
+	credentials := s.credentials()
+	if credentials == nil || credentials.identityToken != "" {
+		return "", ""
+	}
+	return credentials.username, credentials.secret
+}
+
+func (s *refreshingCredentialStore) RefreshToken(*url.URL, string) string {
+	if credentials := s.credentials(); credentials != nil {
+		return credentials.identityToken
+	}
+	return ""
+}
+
+func (s *refreshingCredentialStore) SetRefreshToken(*url.URL, string, string) {}
+
+// credentials returns the current credentials, fetching them if they've expired, or starting to refresh
+// them in the background if they're about to; nil if there are none.
+func (s *refreshingCredentialStore) credentials() *registryCredentials {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	age := now.Sub(s.fetchedAt)
+	expired := s.current == nil || age >= s.ttl
+	backingOff := !s.failedAt.IsZero() && now.Sub(s.failedAt) < credentialsRetryInterval
+
+	switch {
+	case expired && backingOff:
+		return nil
+	case expired:
+		done := s.startFetch()
+		s.mutex.Unlock()
+		<-done
+		s.mutex.Lock()
+	case age >= s.ttl-s.ttl/credentialsRefreshFraction && !backingOff:
+		s.startFetch()
+	}
+
+	return s.current
+}
+
+// startFetch starts fetching credentials in the background, unless that's already in flight; it returns
+// a channel closed once done. Expects the lock to be held.
+func (s *refreshingCredentialStore) startFetch() chan struct{} {
+	if s.fetching == nil {
+		done := make(chan struct{})
+		s.fetching = done
+
+		go func() {
+			credentials, err := s.fetch()
+
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.update(credentials, err)
+			s.fetching = nil
+			close(done)
+		}()
+	}
+	return s.fetching
+}
+
+// update swaps in freshly fetched credentials; expects the lock to be held. Credentials that fail to get
+// refreshed keep being used until they expire.
+func (s *refreshingCredentialStore) update(credentials *registryCredentials, err error) {
+	if err == nil {
+		s.current = credentials
+		s.fetchedAt = s.now()
+		s.failedAt = time.Time{}
+		return
+	}
+	s.failedAt = s.now()
+
+	if s.current != nil && s.now().Sub(s.fetchedAt) < s.ttl {
+		log.Warnf("Unable to refresh credentials for %s, still using the current ones: %v", s.address, err)
+		return
+	}
+	if err == errCredentialsNotFound {
+		log.Warnf("No credentials found for %s", s.address)
+	} else {
+		log.Errorf("Unable to get credentials for %s: %v", s.address, err)
+	}
+	s.current = nil
+}
+
+func (s *refreshingCredentialStore) fetch() (*registryCredentials, error) {
+	if s.config.Helper != "" {
+		return credentialsFromHelper(s.config.Helper, credentialsServerURL(s.address))
+	}
+	return credentialsFromDockerConfig(s.config.DockerConfig, s.address)
+}
+
+// credentialsFromDockerConfig looks up the credentials for address the same way the Docker CLI does: from
+// the registry's helper if it has one, else from the default store if there's one, else from the file.
+func credentialsFromDockerConfig(path, address string) (*registryCredentials, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read Docker config %q", path)
+	}
+	config := &dockerConfigFile{}
+	if err := json.Unmarshal(contents, config); err != nil {
+		return nil, errors.Wrapf(err, "%q is not a valid Docker config", path)
+	}
+
+	serverURL := credentialsServerURL(address)
+
+	for key, helper := range config.CredHelpers {
+		if dockerConfigKeyMatches(key, address) {
+			return credentialsFromHelper(helper, serverURL)
+		}
+	}
+
+	if config.CredsStore != "" {
+		credentials, err := credentialsFromHelper(config.CredsStore, serverURL)
+		if err != errCredentialsNotFound {
+			return credentials, err
+		}
+	}
+
+	for key, entry := range config.Auths {
+		if dockerConfigKeyMatches(key, address) {
+			return entry.credentials()
+		}
+	}
+	return nil, errCredentialsNotFound
+}
+
+func (a *dockerConfigAuth) credentials() (*registryCredentials, error) {
+	credentials := &registryCredentials{
+		username:      a.Username,
+		secret:        a.Password,
+		identityToken: a.IdentityToken,
+	}
+
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid auth in Docker config")
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid auth in Docker config, expected username:password")
+		}
+		credentials.username, credentials.secret = parts[0], parts[1]
+	}
+
+	return credentials, nil
+}
+
+// credentialsFromHelper runs docker-credential-<helper> get for serverURL.
+func credentialsFromHelper(helper, serverURL string) (*registryCredentials, error) {
+	if helper == ecrLoginHelper {
+		return credentialsFromECR(serverURL)
+	}
+
+	name := credentialHelperPrefix + helper
+	cmd := exec.Command(name, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, credentialsNotFoundMessage) {
+			return nil, errCredentialsNotFound
+		}
+		if output == "" {
+			return nil, errors.Wrapf(err, "%s failed", name)
+		}
+		return nil, errors.Wrapf(err, "%s failed: %s", name, output)
+	}
+
+	output := &credentialHelperOutput{}
+	if err := json.Unmarshal(stdout.Bytes(), output); err != nil {
+		return nil, errors.Wrapf(err, "unexpected output from %s", name)
+	}
+
+	if output.Username == identityTokenUsername {
+		return &registryCredentials{identityToken: output.Secret}, nil
+	}
+	return &registryCredentials{username: output.Username, secret: output.Secret}, nil
+}
+
+func credentialsFromECR(serverURL string) (*registryCredentials, error) {
+	helper := ecr.ECRHelper{ClientFactory: api.DefaultClientFactory{}}
+	username, secret, err := helper.Get(serverURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get ECR credentials for %s", serverURL)
+	}
+	return &registryCredentials{username: username, secret: secret}, nil
+}
+
+// credentialsServerURL returns what the Docker CLI passes to helpers for address.
+func credentialsServerURL(address string) string {
+	if isDockerHub(address) {
+		return dockerHubConfigKey
+	}
+	return address
+}
+
+// dockerConfigKeyMatches returns whether key, from a Docker config file, is for address; keys can be
+// URLs, and Docker Hub has its own.
+func dockerConfigKeyMatches(key, address string) bool {
+	if key == dockerHubConfigKey {
+		return isDockerHub(address)
+	}
+
+	host := key
+	if parsed, err := url.Parse(key); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	return host == address || isDockerHub(host) && isDockerHub(address)
+}
+
+func isDockerHub(address string) bool {
+	return address == dockerHubRegistryAddress || address == legacyDockerHubAddress || address == dockerHubNamespace
+}
+
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to expand ~")
+	}
+	return filepath.Join(home, path[2:]), nil
+}
@@ -0,0 +1,386 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+func TestCredentialsFromHelper(t *testing.T) {
+	counterPath, cleanup := withFakeCredentialHelper(t)
+	defer cleanup()
+
+	credentials, err := credentialsFromHelper(fakeCredentialHelper, "quay.io")
+	require.NoError(t, err)
+	assert.Equal(t, &registryCredentials{username: "quay.io-user", secret: "secret-1"}, credentials)
+	assert.Equal(t, 1, fakeCredentialHelperCalls(t, counterPath))
+
+	credentials, err = credentialsFromHelper(fakeCredentialHelper, dockerHubConfigKey)
+	require.NoError(t, err)
+	assert.Equal(t, &registryCredentials{identityToken: "secret-2"}, credentials)
+
+	_, err = credentialsFromHelper(fakeCredentialHelper, fakeCredentialHelperUnknownServer)
+	assert.Equal(t, errCredentialsNotFound, err)
+
+	_, err = credentialsFromHelper("does-not-exist", "quay.io")
+	assert.Error(t, err)
+	assert.NotEqual(t, errCredentialsNotFound, err)
+}
+
+func TestCredentialsFromDockerConfig(t *testing.T) {
+	_, helperCleanup := withFakeCredentialHelper(t)
+	defer helperCleanup()
+
+	auth := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+
+	path, cleanup := withTestConfigFile(t, fmt.Sprintf(`{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": %q},
+    "https://%s/v2/": {"auth": %q},
+    "gcr.io": {"identitytoken": "refresh-me"}
+  },
+  "credHelpers": {
+    "quay.io": %q
+  }
+}`, auth("hub-user", "hub-password"), fakeCredentialHelperUnknownServer, auth("bob", "pw"), fakeCredentialHelper))
+	defer cleanup()
+
+	for _, testCase := range []struct {
+		address  string
+		expected *registryCredentials
+	}{
+		{address: "quay.io", expected: &registryCredentials{username: "quay.io-user", secret: "secret-1"}},
+		{address: dockerHubRegistryAddress, expected: &registryCredentials{username: "hub-user", secret: "hub-password"}},
+		{address: fakeCredentialHelperUnknownServer, expected: &registryCredentials{username: "bob", secret: "pw"}},
+		{address: "gcr.io", expected: &registryCredentials{identityToken: "refresh-me"}},
+	} {
+		credentials, err := credentialsFromDockerConfig(path, testCase.address)
+		require.NoError(t, err, testCase.address)
+		assert.Equal(t, testCase.expected, credentials, testCase.address)
+	}
+
+	_, err := credentialsFromDockerConfig(path, "ghcr.io")
+	assert.Equal(t, errCredentialsNotFound, err)
+
+	t.Run("with a default store, the file is only used for registries the store doesn't know", func(t *testing.T) {
+		storePath, storeCleanup := withTestConfigFile(t, fmt.Sprintf(`{
+  "auths": {
+    %q: {"auth": %q},
+    "ghcr.io": {"auth": %q}
+  },
+  "credsStore": %q
+}`, fakeCredentialHelperUnknownServer, auth("bob", "pw"), auth("alice", "pw"), fakeCredentialHelper))
+		defer storeCleanup()
+
+		credentials, err := credentialsFromDockerConfig(storePath, "ghcr.io")
+		require.NoError(t, err)
+		assert.Equal(t, "ghcr.io-user", credentials.username)
+
+		credentials, err = credentialsFromDockerConfig(storePath, fakeCredentialHelperUnknownServer)
+		require.NoError(t, err)
+		assert.Equal(t, "bob", credentials.username)
+	})
+}
+
+func TestRefreshingCredentialStore(t *testing.T) {
+	counterPath, cleanup := withFakeCredentialHelper(t)
+	defer cleanup()
+
+	clock := &fakeClock{}
+	store := newRefreshingCredentialStore("quay.io", &CredentialsConfig{Helper: fakeCredentialHelper})
+	store.now = clock.now
+
+	basic := func() string {
+		_, secret := store.Basic(nil)
+		return secret
+	}
+
+	assert.Equal(t, "secret-1", basic())
+
+	clock.advance(30 * time.Minute)
+	assert.Equal(t, "secret-1", basic())
+	assert.Equal(t, 1, fakeCredentialHelperCalls(t, counterPath))
+
+	// about to expire, they get refreshed in the background
+	clock.advance(25 * time.Minute)
+	assert.Equal(t, "secret-1", basic())
+	assert.Eventually(t, func() bool {
+		return basic() == "secret-2"
+	}, genericTestTimeout, 10*time.Millisecond)
+
+	// expired, they get fetched right away
+	clock.advance(2 * time.Hour)
+	assert.Equal(t, "secret-3", basic())
+	assert.Equal(t, 3, fakeCredentialHelperCalls(t, counterPath))
+
+	t.Run("credentials that fail to get refreshed keep being used until they expire", func(t *testing.T) {
+		failing := newRefreshingCredentialStore("quay.io", &CredentialsConfig{Helper: fakeCredentialHelper})
+		failing.now = clock.now
+		_, secret := failing.Basic(nil)
+		require.NotEmpty(t, secret)
+
+		failing.config = &CredentialsConfig{Helper: "does-not-exist"}
+		clock.advance(55 * time.Minute)
+		_, stillSecret := failing.Basic(nil)
+		assert.Equal(t, secret, stillSecret)
+
+		clock.advance(10 * time.Minute)
+		username, _ := failing.Basic(nil)
+		assert.Empty(t, username)
+	})
+
+	t.Run("failing helpers don't get called again before the retry interval", func(t *testing.T) {
+		failing := newRefreshingCredentialStore("quay.io", &CredentialsConfig{Helper: "does-not-exist"})
+		failing.now = clock.now
+		failedAt := func() time.Time {
+			failing.mutex.Lock()
+			defer failing.mutex.Unlock()
+			return failing.failedAt
+		}
+
+		username, _ := failing.Basic(nil)
+		assert.Empty(t, username)
+		firstFailure := failedAt()
+		require.False(t, firstFailure.IsZero())
+
+		clock.advance(credentialsRetryInterval / 2)
+		username, _ = failing.Basic(nil)
+		assert.Empty(t, username)
+		assert.Equal(t, firstFailure, failedAt())
+
+		// the helper comes back
+		failing.config = &CredentialsConfig{Helper: fakeCredentialHelper}
+		clock.advance(credentialsRetryInterval)
+		_, secret := failing.Basic(nil)
+		assert.NotEmpty(t, secret)
+		assert.True(t, failedAt().IsZero())
+	})
+
+	t.Run("concurrent pulls share the same fetch", func(t *testing.T) {
+		callsBefore := fakeCredentialHelperCalls(t, counterPath)
+		clock.advance(2 * time.Hour)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NotEmpty(t, basic())
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, callsBefore+1, fakeCredentialHelperCalls(t, counterPath))
+	})
+}
+
+func TestTokenAuthenticatorWithRefreshingCredentials(t *testing.T) {
+	_, helperCleanup := withFakeCredentialHelper(t)
+	defer helperCleanup()
+
+	registry := &basicAuthRegistry{}
+	address, registryCleanup := registry.start(t)
+	defer registryCleanup()
+
+	config := krakenconfig.Config{Address: address}
+	config.Security.EnableHTTPFallback = true
+	client, err := newRegistryClient(config, &CredentialsConfig{Helper: fakeCredentialHelper}, &upstreamDialer{})
+	require.NoError(t, err)
+	defer client.transport.CloseIdleConnections()
+
+	opts, err := client.authenticator.Authenticate("ubuntu")
+	require.NoError(t, err)
+
+	response, err := httputil.Get(fmt.Sprintf("http://%s/v2/ubuntu/manifests/18", address), opts...)
+	require.NoError(t, err)
+	readResponseBody(t, response)
+
+	assert.Equal(t, []string{address + "-user:secret-1"}, registry.credentials())
+	assert.Contains(t, describeAuthenticator(config.Security, client.credentials), fakeCredentialHelper)
+}
+
+/*** Helpers below ***/
+
+const (
+	fakeCredentialHelper = "kraken-proxy-test"
+	// the fake helper has no credentials for that one
+	fakeCredentialHelperUnknownServer = "unknown.example.com"
+	// counts how many times the fake helper has been called
+	fakeCredentialHelperCounterEnv = "KRAKEN_PROXY_TEST_HELPER_COUNTER"
+)
+
+// replies with <server>-user as the username, and secret-<n> as the secret, n being how many times it's been
+// called; and with an identity token for Docker Hub.
+const fakeCredentialHelperSource = `package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) != 2 || os.Args[1] != "get" {
+		os.Exit(2)
+	}
+	input, _ := ioutil.ReadAll(os.Stdin)
+	server := strings.TrimSpace(string(input))
+
+	if server == "` + fakeCredentialHelperUnknownServer + `" {
+		fmt.Println("credentials not found in native keychain")
+		os.Exit(1)
+	}
+
+	counterPath := os.Getenv("` + fakeCredentialHelperCounterEnv + `")
+	contents, _ := ioutil.ReadFile(counterPath)
+	count, _ := strconv.Atoi(string(contents))
+	count++
+	if err := ioutil.WriteFile(counterPath, []byte(strconv.Itoa(count)), 0600); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	username := server + "-user"
+	if server == "https://index.docker.io/v1/" {
+		username = "<token>"
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]string{
+		"ServerURL": server,
+		"Username":  username,
+		"Secret":    "secret-" + strconv.Itoa(count),
+	})
+}
+`
+
+var (
+	// the fake helper only gets built once
+	fakeCredentialHelperDir     string
+	fakeCredentialHelperBuildMu sync.Mutex
+)
+
+// builds the fake credential helper, and adds it to the PATH; returns the path to the file counting how many
+// times it gets called.
+func withFakeCredentialHelper(t *testing.T) (string, func()) {
+	fakeCredentialHelperBuildMu.Lock()
+	defer fakeCredentialHelperBuildMu.Unlock()
+
+	if fakeCredentialHelperDir == "" {
+		dir, err := ioutil.TempDir("", "kraken-proxy-helper-")
+		require.NoError(t, err)
+
+		sourcePath := filepath.Join(dir, "main.go")
+		require.NoError(t, ioutil.WriteFile(sourcePath, []byte(fakeCredentialHelperSource), 0600))
+
+		build := exec.Command("go", "build", "-o", filepath.Join(dir, credentialHelperPrefix+fakeCredentialHelper), sourcePath)
+		build.Dir = dir
+		build.Env = append(os.Environ(), "GO111MODULE=off")
+		output, err := build.CombinedOutput()
+		require.NoError(t, err, string(output))
+
+		fakeCredentialHelperDir = dir
+	}
+
+	counter, err := ioutil.TempFile("", "kraken-proxy-helper-counter-")
+	require.NoError(t, err)
+	require.NoError(t, counter.Close())
+
+	previousPath := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", fakeCredentialHelperDir+string(os.PathListSeparator)+previousPath))
+	require.NoError(t, os.Setenv(fakeCredentialHelperCounterEnv, counter.Name()))
+
+	return counter.Name(), func() {
+		require.NoError(t, os.Setenv("PATH", previousPath))
+		require.NoError(t, os.Unsetenv(fakeCredentialHelperCounterEnv))
+		require.NoError(t, os.Remove(counter.Name()))
+	}
+}
+
+func fakeCredentialHelperCalls(t *testing.T, counterPath string) int {
+	contents, err := ioutil.ReadFile(counterPath)
+	require.NoError(t, err)
+	count, err := strconv.Atoi(string(contents))
+	require.NoError(t, err)
+	return count
+}
+
+type fakeClock struct {
+	elapsed int64
+}
+
+func (c *fakeClock) now() time.Time {
+	return time.Unix(0, 0).Add(time.Duration(atomic.LoadInt64(&c.elapsed)))
+}
+
+func (c *fakeClock) advance(duration time.Duration) {
+	atomic.AddInt64(&c.elapsed, int64(duration))
+}
+
+// a basicAuthRegistry challenges requests without basic auth, and records the credentials it gets.
+type basicAuthRegistry struct {
+	received []string
+	mutex    sync.Mutex
+}
+
+func (r *basicAuthRegistry) credentials() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.received...)
+}
+
+func (r *basicAuthRegistry) start(t *testing.T) (address string, cleanup func()) {
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		username, password, ok := request.BasicAuth()
+		if !ok {
+			writer.Header().Set(registryAPIVersionHeader, registryAPIVersion)
+			writer.Header().Set(wwwAuthenticateHeader, `Basic realm="test"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.TrimRight(request.URL.Path, "/") != "/v2" {
+			r.mutex.Lock()
+			r.received = append(r.received, username+":"+password)
+			r.mutex.Unlock()
+		}
+	}
+
+	address = localhostAddr(getAvailablePort(t))
+	server := &http.Server{
+		Addr:    address,
+		Handler: http.HandlerFunc(handler),
+	}
+
+	listeningChan := make(chan interface{})
+	go func() {
+		require.NoError(t, startHTTPServer(server, listeningChan, nil, ""))
+	}()
+
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for basic auth registry to start listening")
+	}
+
+	return address, func() {
+		require.NoError(t, server.Close())
+	}
+}
@@ -0,0 +1,342 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the query parameter containerd uses to tell mirrors which registry a request is for
+	mirrorNamespaceParam = "ns"
+
+	registryAPIVersionHeader = "Docker-Distribution-Api-Version"
+	registryAPIVersion       = "registry/2.0"
+)
+
+// error codes from the registry API spec
+const (
+	blobUnknownErrorCode     = "BLOB_UNKNOWN"
+	manifestUnknownErrorCode = "MANIFEST_UNKNOWN"
+	nameUnknownErrorCode     = "NAME_UNKNOWN"
+	unsupportedErrorCode     = "UNSUPPORTED"
+	deniedErrorCode          = "DENIED"
+)
+
+// RegistryMirror serves the registry API directly, for clients that can be pointed at a mirror, e.g.
+// containerd through hosts.toml files; so neither MITM nor trusting the proxy's CA is needed.
+// Requests go through the DockerRegistryHijacker's redirects, for the registry given by:
+// * the ns query parameter, that containerd sends
+// * or else, a path prefix, e.g. /v2/quay.io/org/repo/manifests/latest
+// * or else, the configured default registry
+// Requests that can't be served get registry API errors, nothing gets proxied.
+type RegistryMirror struct {
+	config   *MirrorConfig
+	hijacker *DockerRegistryHijacker
+	// requests get handled by its RequestHandler, to get metrics, access logs and traces
+	proxy *MitmProxy
+	// the same access control as the proxy listener's: allowed CIDRs, users, and client certificates
+	controller *accessController
+	// if set, clients need to present a certificate signed by that CA
+	clientCAPath string
+
+	server *http.Server
+	// set when Shutdown gets called, so that a pending start doesn't go on
+	stopped bool
+	// guards the server and stopped, Shutdown can be called from another goroutine while starting
+	lifecycleMutex sync.Mutex
+	ready          int32
+}
+
+var _ ReadinessChecker = &RegistryMirror{}
+
+// mirrorError is a registry API error.
+type mirrorError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *mirrorError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+type registryAPIErrors struct {
+	Errors []registryAPIError `json:"errors"`
+}
+
+type registryAPIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewRegistryMirror returns nil if the mirror is not configured.
+func NewRegistryMirror(config *Config, hijacker *DockerRegistryHijacker, proxy *MitmProxy) (*RegistryMirror, error) {
+	if config == nil || config.Mirror == nil {
+		return nil, nil
+	}
+
+	controller, err := newAccessController(config.AccessControl)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to set up access control")
+	}
+
+	clientCAPath := ""
+	if config.AccessControl != nil && config.AccessControl.TLS != nil {
+		clientCAPath = config.AccessControl.TLS.ClientCAPath
+	}
+	if clientCAPath != "" && config.Mirror.TLS == nil {
+		return nil, errors.New("the registry mirror needs to serve TLS to check clients' certificates")
+	}
+
+	return &RegistryMirror{
+		config:       config.Mirror,
+		hijacker:     hijacker,
+		proxy:        proxy,
+		controller:   controller,
+		clientCAPath: clientCAPath,
+	}, nil
+}
+
+// Start is a blocking call.
+func (m *RegistryMirror) Start() error {
+	return m.start(nil)
+}
+
+// If passed a listeningChan, it will close it when it's started listening.
+func (m *RegistryMirror) start(listeningChan chan interface{}) error {
+	if m.config.ListenAddress == "" {
+		return errors.New("no listen address configured for the registry mirror")
+	}
+	m.lifecycleMutex.Lock()
+	if m.server != nil {
+		m.lifecycleMutex.Unlock()
+		return errors.New("registry mirror already started")
+	}
+	if m.stopped {
+		m.lifecycleMutex.Unlock()
+		log.Infof("Registry mirror stopped before starting")
+		return nil
+	}
+	server := &http.Server{
+		Addr:    m.config.ListenAddress,
+		Handler: m,
+	}
+	if m.clientCAPath != "" {
+		tlsConfig, err := listenerTLSConfig(&ListenerTLSConfig{TLSInfo: *m.config.TLS, ClientCAPath: m.clientCAPath})
+		if err != nil {
+			m.lifecycleMutex.Unlock()
+			return errors.Wrap(err, "unable to set up TLS for the registry mirror")
+		}
+		server.TLSConfig = tlsConfig
+	}
+	m.server = server
+	m.lifecycleMutex.Unlock()
+
+	serverListening := make(chan interface{})
+	serverDone := make(chan interface{})
+	defer close(serverDone)
+	go func() {
+		select {
+		case <-serverListening:
+			m.lifecycleMutex.Lock()
+			if !m.stopped {
+				atomic.StoreInt32(&m.ready, 1)
+			}
+			m.lifecycleMutex.Unlock()
+			if listeningChan != nil {
+				close(listeningChan)
+			}
+		case <-serverDone:
+		}
+	}()
+
+	startedLogLine := fmt.Sprintf("Registry mirror listening on %s", m.config.ListenAddress)
+	return startHTTPServer(server, serverListening, m.config.TLS, startedLogLine)
+}
+
+// Shutdown stops the mirror gracefully, see http.Server.Shutdown. If the mirror hasn't started yet, it
+// won't, and Start returns right away.
+func (m *RegistryMirror) Shutdown(ctx context.Context) error {
+	m.lifecycleMutex.Lock()
+	m.stopped = true
+	atomic.StoreInt32(&m.ready, 0)
+	server := m.server
+	m.lifecycleMutex.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+func (m *RegistryMirror) CheckReadiness(context.Context) (bool, interface{}) {
+	if atomic.LoadInt32(&m.ready) == 0 {
+		return false, "not listening"
+	}
+	return true, fmt.Sprintf("listening on %s", m.config.ListenAddress)
+}
+
+func (m *RegistryMirror) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set(registryAPIVersionHeader, registryAPIVersion)
+
+	if !m.controller.allowedAddr(request.RemoteAddr) {
+		log.Warnf("Denying mirror request %s from %s: IP not allowed", requestToString(request), request.RemoteAddr)
+		m.proxy.incrementMetricCounter(ForbiddenRequestCounter, request)
+		writeRegistryError(writer, &mirrorError{status: http.StatusForbidden, code: deniedErrorCode, message: "IP not allowed"})
+		return
+	}
+
+	if !m.controller.authenticated(request) {
+		log.Warnf("Denying mirror request %s from %s: authentication required", requestToString(request), request.RemoteAddr)
+		m.proxy.incrementMetricCounter(UnauthenticatedRequestCounter, request)
+		writer.Header().Set(proxyAuthenticateHeader, fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+		writeRegistryError(writer, &mirrorError{
+			status:  http.StatusProxyAuthRequired,
+			code:    unauthorizedErrorCode,
+			message: "proxy authentication required",
+		})
+		return
+	}
+	request.Header.Del(proxyAuthorizationHeader)
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writeRegistryError(writer, &mirrorError{
+			status:  http.StatusMethodNotAllowed,
+			code:    unsupportedErrorCode,
+			message: "this is a read-only mirror",
+		})
+		return
+	}
+
+	if strings.TrimRight(request.URL.Path, "/") == "/v2" {
+		// we handle authentication to registries ourselves
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte("{}"))
+		return
+	}
+
+	mirrored, err := m.hijacker.mirroredRequest(request, m.config.DefaultRegistry)
+	if err != nil {
+		log.Debugf("Unable to serve mirror request %s: %v", requestToString(request), err)
+		writeRegistryError(writer, err)
+		return
+	}
+
+	m.proxy.RequestHandler(http.HandlerFunc(notMirrored), writer, mirrored)
+}
+
+// notMirrored handles the requests that the DockerRegistryHijacker couldn't serve, from any of the redirects
+// nor from the origin registry.
+func notMirrored(writer http.ResponseWriter, request *http.Request) {
+	_, queryType, repository, tag := parseRegistryURLPath(request.URL.Path)
+
+	code := manifestUnknownErrorCode
+	if queryType == blobQuery {
+		code = blobUnknownErrorCode
+	}
+	writeRegistryError(writer, &mirrorError{
+		status:  http.StatusNotFound,
+		code:    code,
+		message: fmt.Sprintf("unable to get %s %s:%s from %s or its redirects", queryType, repository, tag, request.Host),
+	})
+}
+
+// mirroredRequest turns a request to the mirror into a request as the DockerRegistryHijacker would get it
+// when intercepting it, addressed to the registry it's for.
+func (h *DockerRegistryHijacker) mirroredRequest(request *http.Request, defaultRegistry string) (*http.Request, error) {
+	isRegistryQuery, queryType, repository, tag := parseRegistryURLPath(request.URL.Path)
+	if !isRegistryQuery {
+		return nil, &mirrorError{
+			status:  http.StatusNotFound,
+			code:    unsupportedErrorCode,
+			message: "only manifests and blobs can be pulled from this mirror",
+		}
+	}
+
+	host := ""
+	if ns := request.URL.Query().Get(mirrorNamespaceParam); ns != "" {
+		if host = h.mirroredRegistryHost(ns); host == "" {
+			return nil, &mirrorError{
+				status:  http.StatusNotFound,
+				code:    nameUnknownErrorCode,
+				message: fmt.Sprintf("no registry configured for %q", ns),
+			}
+		}
+	} else if parts := strings.SplitN(repository, "/", 2); len(parts) == 2 {
+		if host = h.mirroredRegistryHost(parts[0]); host != "" {
+			repository = parts[1]
+		}
+	}
+	if host == "" {
+		host = h.mirroredRegistryHost(defaultRegistry)
+	}
+	if host == "" {
+		return nil, &mirrorError{
+			status:  http.StatusNotFound,
+			code:    nameUnknownErrorCode,
+			message: fmt.Sprintf("unable to tell which registry %s is for", repository),
+		}
+	}
+
+	mirrored := withMirrorRequest(request.Clone(request.Context()))
+	mirrored.Host = host
+	mirrored.URL.Path = fmt.Sprintf("/v2/%s/%ss/%s", repository, queryType, tag)
+	mirrored.URL.RawPath = ""
+	mirrored.URL.RawQuery = ""
+	return mirrored, nil
+}
+
+// mirroredRegistryHost returns the host of a configured registry for name, as found in image references,
+// or an empty string if there's none.
+func (h *DockerRegistryHijacker) mirroredRegistryHost(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	candidates := []string{name}
+	if name == dockerHubNamespace {
+		candidates = append(candidates, dockerHubRegistryAddress, legacyDockerHubAddress)
+	}
+	for _, candidate := range candidates {
+		if h.findRegistry(candidate) != nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func writeRegistryError(writer http.ResponseWriter, err error) {
+	mirrorErr, ok := err.(*mirrorError)
+	if !ok {
+		mirrorErr = &mirrorError{status: http.StatusInternalServerError, code: unsupportedErrorCode, message: err.Error()}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(mirrorErr.status)
+	if err := json.NewEncoder(writer).Encode(&registryAPIErrors{
+		Errors: []registryAPIError{{Code: mirrorErr.code, Message: mirrorErr.message}},
+	}); err != nil {
+		log.Warnf("Unable to write registry error: %v", err)
+	}
+}
+
+type mirrorRequestContextKey struct{}
+
+// withMirrorRequest marks request as coming from the mirror.
+func withMirrorRequest(request *http.Request) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), mirrorRequestContextKey{}, true))
+}
+
+func isMirrorRequest(request *http.Request) bool {
+	mirrored, _ := request.Context().Value(mirrorRequestContextKey{}).(bool)
+	return mirrored
+}
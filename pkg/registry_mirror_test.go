@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryMirror(t *testing.T) {
+	registry1Address, registry1Cleanup := withDummyRegistry(t, 1, "ubuntu:16")
+	defer registry1Cleanup()
+	redirect1Address, redirect1Cleanup := withDummyRegistry(t, 2, "ubuntu:18")
+	defer redirect1Cleanup()
+	registry2Address, registry2Cleanup := withDummyRegistry(t, 3, "alpine:3")
+	defer registry2Cleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	registry1 := Registry{Config: krakenConfig(registry1Address), Redirects: []RedirectRegistry{{Config: krakenConfig(redirect1Address)}}}
+	registry1.Security.EnableHTTPFallback = true
+	registry1.Redirects[0].Security.EnableHTTPFallback = true
+	registry2 := Registry{Config: krakenConfig(registry2Address), Redirects: []RedirectRegistry{{Config: krakenConfig(redirect1Address)}}}
+	registry2.Security.EnableHTTPFallback = true
+	registry2.Redirects[0].Security.EnableHTTPFallback = true
+
+	config := &Config{
+		Registries: []Registry{registry1, registry2},
+		Mirror:     &MirrorConfig{DefaultRegistry: registry1Address},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	statsdClient := &testStatsdClient{}
+	proxy := NewMitmProxy("", nil, hijacker, statsdClient)
+
+	mirrorAddress, mirrorCleanup := withTestRegistryMirror(t, config, hijacker, proxy)
+	defer mirrorCleanup()
+	baseURL := "http://" + mirrorAddress
+
+	t.Run("it answers the API version check", func(t *testing.T) {
+		resp, body := makeRequest(t, nil, baseURL, "/v2/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, registryAPIVersion, resp.Header.Get(registryAPIVersionHeader))
+		assert.Equal(t, "{}", string(body))
+	})
+
+	t.Run("it serves the default registry, through its redirects", func(t *testing.T) {
+		resp, body := makeRequest(t, nil, baseURL, "/v2/ubuntu/manifests/18")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 2: manifests for ubuntu:18", string(body))
+
+		resp, body = makeRequest(t, nil, baseURL, "/v2/ubuntu/manifests/16")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 1: manifests for ubuntu:16", string(body))
+	})
+
+	t.Run("it picks the registry from the ns query parameter", func(t *testing.T) {
+		resp, body := makeRequest(t, nil, baseURL, "/v2/alpine/blobs/3?ns="+registry2Address)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 3: blobs for alpine:3", string(body))
+
+		resp, body = makeRequest(t, nil, baseURL, "/v2/alpine/blobs/3?ns=quay.io")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assertRegistryErrorCode(t, nameUnknownErrorCode, body)
+	})
+
+	t.Run("it picks the registry from a path prefix", func(t *testing.T) {
+		resp, body := makeRequest(t, nil, baseURL, "/v2/"+registry2Address+"/alpine/manifests/3")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 3: manifests for alpine:3", string(body))
+	})
+
+	t.Run("it serves HEAD requests", func(t *testing.T) {
+		resp, err := http.Head(baseURL + "/v2/ubuntu/manifests/18")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get(dockerContentDigestHeader))
+	})
+
+	t.Run("it replies with registry errors for unknown images", func(t *testing.T) {
+		resp, body := makeRequest(t, nil, baseURL, "/v2/ubuntu/manifests/20")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assertRegistryErrorCode(t, manifestUnknownErrorCode, body)
+
+		resp, body = makeRequest(t, nil, baseURL, "/v2/ubuntu/blobs/20")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assertRegistryErrorCode(t, blobUnknownErrorCode, body)
+	})
+
+	t.Run("it's read-only", func(t *testing.T) {
+		resp, err := http.Post(baseURL+"/v2/ubuntu/blobs/uploads/", "application/octet-stream", strings.NewReader(""))
+		require.NoError(t, err)
+		body := readResponseBody(t, resp)
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assertRegistryErrorCode(t, unsupportedErrorCode, body)
+	})
+
+	t.Run("without a default registry, it needs to be told which registry to use", func(t *testing.T) {
+		noDefaultConfig := &Config{Registries: config.Registries, Mirror: &MirrorConfig{}}
+		noDefaultAddress, noDefaultCleanup := withTestRegistryMirror(t, noDefaultConfig, hijacker, proxy)
+		defer noDefaultCleanup()
+
+		resp, body := makeRequest(t, nil, "http://"+noDefaultAddress, "/v2/ubuntu/manifests/16")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assertRegistryErrorCode(t, nameUnknownErrorCode, body)
+	})
+
+	t.Run("shut down before starting, it doesn't start", func(t *testing.T) {
+		stoppedConfig := &Config{Registries: config.Registries, Mirror: &MirrorConfig{ListenAddress: localhostAddr(getAvailablePort(t))}}
+		mirror, err := NewRegistryMirror(stoppedConfig, hijacker, proxy)
+		require.NoError(t, err)
+
+		require.NoError(t, mirror.Shutdown(context.Background()))
+		assert.NoError(t, mirror.Start())
+
+		_, err = net.Dial("tcp", stoppedConfig.Mirror.ListenAddress)
+		assert.Error(t, err)
+		ready, _ := mirror.CheckReadiness(context.Background())
+		assert.False(t, ready)
+	})
+
+	t.Run("it requires clients to authenticate when there's a users file", func(t *testing.T) {
+		usersFile, usersCleanup := withUsersFile(t, "alice:secret\n")
+		defer usersCleanup()
+
+		authConfig := &Config{
+			Registries:    config.Registries,
+			Mirror:        &MirrorConfig{DefaultRegistry: registry1Address},
+			AccessControl: &AccessControlConfig{UsersFile: usersFile},
+		}
+		authAddress, authCleanup := withTestRegistryMirror(t, authConfig, hijacker, proxy)
+		defer authCleanup()
+
+		for _, route := range []string{"/v2/", "/v2/ubuntu/manifests/16"} {
+			statsdClient.reset()
+
+			resp, body := makeRequest(t, nil, "http://"+authAddress, route)
+			assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+			assert.Equal(t, `Basic realm="kraken-proxy"`, resp.Header.Get("Proxy-Authenticate"))
+			assertRegistryErrorCode(t, unauthorizedErrorCode, body)
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(UnauthenticatedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		}
+
+		request, err := http.NewRequest(http.MethodGet, "http://"+authAddress+"/v2/ubuntu/manifests/16", nil)
+		require.NoError(t, err)
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		body := readResponseBody(t, resp)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 1: manifests for ubuntu:16", string(body))
+	})
+
+	t.Run("it can require clients to present a certificate", func(t *testing.T) {
+		serverTLSInfo, serverCleanup := withTestServerTLSFiles(t)
+		defer serverCleanup()
+		clientCA, clientCACleanup := withTestCAFiles(t)
+		defer clientCACleanup()
+
+		mTLSConfig := &Config{
+			Registries:    config.Registries,
+			Mirror:        &MirrorConfig{DefaultRegistry: registry1Address, TLS: serverTLSInfo},
+			AccessControl: &AccessControlConfig{TLS: &ListenerTLSConfig{ClientCAPath: clientCA.CertPath}},
+		}
+		mTLSAddress, mTLSCleanup := withTestRegistryMirror(t, mTLSConfig, hijacker, proxy)
+		defer mTLSCleanup()
+		mTLSURL := "https://" + mTLSAddress
+
+		withoutCert := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsClientConfig(t)}}
+		_, err := withoutCert.Get(mTLSURL + "/v2/")
+		assert.Error(t, err)
+
+		ca, err := tls.X509KeyPair([]byte(caCert), []byte(caKey))
+		require.NoError(t, err)
+		ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+		require.NoError(t, err)
+		clientCert, err := genCert(&ca, "client")
+		require.NoError(t, err)
+
+		tlsConfig := tlsClientConfig(t)
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+		withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, body := makeRequest(t, withCert, mTLSURL, "/v2/ubuntu/manifests/16")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 1: manifests for ubuntu:16", string(body))
+	})
+
+	t.Run("it refuses to check client certificates without serving TLS", func(t *testing.T) {
+		plainConfig := &Config{
+			Registries:    config.Registries,
+			Mirror:        &MirrorConfig{ListenAddress: localhostAddr(getAvailablePort(t))},
+			AccessControl: &AccessControlConfig{TLS: &ListenerTLSConfig{ClientCAPath: "/etc/kraken-proxy/ca.pem"}},
+		}
+		_, err := NewRegistryMirror(plainConfig, hijacker, proxy)
+		assert.Error(t, err)
+	})
+
+	t.Run("it's not configured by default", func(t *testing.T) {
+		mirror, err := NewRegistryMirror(&Config{}, hijacker, proxy)
+		require.NoError(t, err)
+		assert.Nil(t, mirror)
+	})
+}
+
+/*** Helpers below ***/
+
+// starts a registry mirror, and returns the address it listens on.
+func withTestRegistryMirror(t *testing.T, config *Config, hijacker *DockerRegistryHijacker, proxy *MitmProxy) (string, func()) {
+	config.Mirror.ListenAddress = localhostAddr(getAvailablePort(t))
+	mirror, err := NewRegistryMirror(config, hijacker, proxy)
+	require.NoError(t, err)
+	require.NotNil(t, mirror)
+
+	listeningChan := make(chan interface{})
+	go func() {
+		assert.NoError(t, mirror.start(listeningChan))
+	}()
+
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for registry mirror to start listening on %s", config.Mirror.ListenAddress)
+	}
+
+	ready, _ := mirror.CheckReadiness(context.Background())
+	assert.True(t, ready)
+
+	return config.Mirror.ListenAddress, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), genericTestTimeout)
+		defer cancel()
+		require.NoError(t, mirror.Shutdown(ctx))
+	}
+}
+
+func assertRegistryErrorCode(t *testing.T, expectedCode string, body []byte) {
+	errs := &registryAPIErrors{}
+	require.NoError(t, json.Unmarshal(body, errs))
+	require.Len(t, errs.Errors, 1)
+	assert.Equal(t, expectedCode, errs.Errors[0].Code)
+}
@@ -0,0 +1,432 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/uber/kraken/lib/backend/registrybackend"
+	"github.com/uber/kraken/lib/backend/registrybackend/security"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+const (
+	// the shortest lifetime tokens get, as per the registry token spec; also the default when token
+	// servers don't say how long their tokens are valid for
+	minimumTokenLifetime = time.Minute
+	// tokens get refreshed in the background once that fraction of their lifetime is left
+	tokenRefreshFraction = 5
+
+	tokenFetchTimeout = 30 * time.Second
+
+	tokenClientID = "kraken-proxy"
+)
+
+// tokenResponse is what token servers reply with, see
+// https://docs.docker.com/registry/spec/auth/token/#token-response-fields
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	// in seconds
+	ExpiresIn int `json:"expires_in"`
+}
+
+// a tokenMetricsReporter gets told about token cache hits & misses, and token fetches; it can be nil.
+type tokenMetricsReporter func(name MitmProxyStatsdMetricName, labels MetricLabels)
+
+func (r tokenMetricsReporter) report(name MitmProxyStatsdMetricName, labels MetricLabels) {
+	if r != nil {
+		r(name, labels)
+	}
+}
+
+type tokenKey struct {
+	repository string
+	scope      string
+}
+
+type cachedToken struct {
+	token     string
+	fetchedAt time.Time
+	expiresAt time.Time
+	// whether it's being refreshed in the background
+	refreshing bool
+}
+
+// a tokenFetch is a token being fetched for a request; other requests for the same repository wait for it
+// rather than fetching their own.
+type tokenFetch struct {
+	done  chan struct{}
+	token *cachedToken
+	err   error
+}
+
+// tokenAuthenticator authenticates to a registry with basic auth or bearer tokens, depending on its
+// challenge; unlike kraken's authenticator, it caches both the registry's challenge and tokens, per
+// repository and scope, and refreshes tokens in the background shortly before they expire, so that pulls
+// don't need a round-trip to the token server.
+type tokenAuthenticator struct {
+	address   string
+	security  security.Config
+	transport *http.Transport
+	// nil if there are no credentials for the registry, then requests get sent as they are
+	credentials auth.CredentialStore
+
+	// nil until the first request, and after the registry rejects a token
+	challenges []challenge.Challenge
+	tokens     map[tokenKey]*cachedToken
+	fetches    map[tokenKey]*tokenFetch
+	mutex      sync.Mutex
+
+	// allows overriding in tests
+	now func() time.Time
+}
+
+var _ security.Authenticator = &tokenAuthenticator{}
+
+func newTokenAuthenticator(config registrybackend.Config, credentials auth.CredentialStore, transport *http.Transport) (*tokenAuthenticator, error) {
+	tlsConfig, err := config.Security.TLS.BuildClient()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to build TLS config for %q", config.Address)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &tokenAuthenticator{
+		address:     config.Address,
+		security:    config.Security,
+		transport:   transport,
+		credentials: credentials,
+		tokens:      make(map[tokenKey]*cachedToken),
+		fetches:     make(map[tokenKey]*tokenFetch),
+		now:         time.Now,
+	}, nil
+}
+
+// securityCredentialStore returns the store for the credentials from the registry's security block, nil
+// if there are none: credentials from a helper get cached like the ones from a credentials block.
+func securityCredentialStore(config registrybackend.Config) auth.CredentialStore {
+	switch {
+	case config.Security.RemoteCredentialsStore != "":
+		return newRefreshingCredentialStore(config.Address, &CredentialsConfig{Helper: config.Security.RemoteCredentialsStore})
+	case config.Security.BasicAuth != nil:
+		return &staticCredentialStore{registryCredentials{
+			username:      config.Security.BasicAuth.Username,
+			secret:        config.Security.BasicAuth.Password,
+			identityToken: config.Security.BasicAuth.IdentityToken,
+		}}
+	default:
+		return nil
+	}
+}
+
+func (a *tokenAuthenticator) Authenticate(repo string) ([]httputil.SendOption, error) {
+	return a.authenticate(repo, nil)
+}
+
+// authenticate is the same as Authenticate, reporting token cache metrics to report.
+func (a *tokenAuthenticator) authenticate(repo string, report tokenMetricsReporter) ([]httputil.SendOption, error) {
+	if a.security.TLS.Client.Disabled {
+		return []httputil.SendOption{httputil.SendNoop()}, nil
+	}
+
+	var opts []httputil.SendOption
+	if !a.security.EnableHTTPFallback {
+		opts = append(opts, httputil.DisableHTTPFallback())
+	}
+	if a.credentials == nil {
+		return append(opts, httputil.SendTLSTransport(a.transport)), nil
+	}
+
+	challenges, err := a.challenge(opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get the auth challenge from %s", a.address)
+	}
+
+	authorization, err := a.authorization(repo, challenges, report)
+	if err != nil {
+		return nil, err
+	}
+	if authorization == "" {
+		return append(opts, httputil.SendTLSTransport(a.transport)), nil
+	}
+
+	modifier := &authorizationModifier{host: a.address, authorization: authorization}
+	return append(opts, httputil.SendTLSTransport(transport.NewTransport(a.transport, modifier))), nil
+}
+
+// invalidate forgets the tokens for the repository, as well as the registry's challenge, once the registry
+// has rejected one; returns false if there were none, i.e. there's no point retrying.
+func (a *tokenAuthenticator) invalidate(repo string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	invalidated := false
+	for key := range a.tokens {
+		if key.repository == repo {
+			delete(a.tokens, key)
+			invalidated = true
+		}
+	}
+	if invalidated {
+		a.challenges = nil
+	}
+	return invalidated
+}
+
+// challenge returns the registry's challenges, asking for them the first time.
+func (a *tokenAuthenticator) challenge(opts []httputil.SendOption) ([]challenge.Challenge, error) {
+	a.mutex.Lock()
+	challenges := a.challenges
+	a.mutex.Unlock()
+	if challenges != nil {
+		return challenges, nil
+	}
+
+	opts = append(opts,
+		httputil.SendTLSTransport(a.transport),
+		httputil.SendAcceptedCodes(http.StatusOK, http.StatusUnauthorized))
+
+	response, err := httputil.Get(fmt.Sprintf("http://%s/v2/", a.address), opts...)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	// registries that let anyone in have no challenge, an empty slice so we don't ask again
+	challenges = []challenge.Challenge{}
+	if response.StatusCode == http.StatusUnauthorized {
+		challenges = challenge.ResponseChallenges(response)
+	}
+
+	a.mutex.Lock()
+	a.challenges = challenges
+	a.mutex.Unlock()
+	return challenges, nil
+}
+
+// authorization returns the Authorization header to send to the registry for the repository, empty if none.
+func (a *tokenAuthenticator) authorization(repo string, challenges []challenge.Challenge, report tokenMetricsReporter) (string, error) {
+	for _, c := range challenges {
+		switch c.Scheme {
+		case "bearer":
+			token, err := a.token(repo, c.Parameters, report)
+			if err != nil {
+				return "", err
+			}
+			return "Bearer " + token, nil
+		case "basic":
+			if username, password := a.credentials.Basic(nil); username != "" {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// token returns a pull token for the repository, from the cache if there's a valid one there.
+func (a *tokenAuthenticator) token(repo string, parameters map[string]string, report tokenMetricsReporter) (string, error) {
+	key := tokenKey{
+		repository: repo,
+		scope:      auth.RepositoryScope{Repository: repo, Actions: []string{"pull"}}.String(),
+	}
+
+	a.mutex.Lock()
+	now := a.now()
+	if cached, present := a.tokens[key]; present && now.Before(cached.expiresAt) {
+		if !cached.refreshing && now.After(cached.refreshAt()) {
+			cached.refreshing = true
+			go a.refresh(key, parameters, report)
+		}
+		a.mutex.Unlock()
+
+		report.report(TokenCacheHitCounter, nil)
+		return cached.token, nil
+	}
+
+	fetch, inFlight := a.fetches[key]
+	if !inFlight {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		a.fetches[key] = fetch
+	}
+	a.mutex.Unlock()
+
+	report.report(TokenCacheMissCounter, nil)
+
+	if inFlight {
+		<-fetch.done
+	} else {
+		fetch.token, fetch.err = a.fetch(key, parameters, report)
+
+		a.mutex.Lock()
+		if fetch.err == nil {
+			a.cacheToken(key, fetch.token)
+		}
+		delete(a.fetches, key)
+		a.mutex.Unlock()
+		close(fetch.done)
+	}
+
+	if fetch.err != nil {
+		return "", fetch.err
+	}
+	return fetch.token.token, nil
+}
+
+// refresh fetches a new token in the background; tokens that fail to get refreshed keep being used until
+// they expire.
+func (a *tokenAuthenticator) refresh(key tokenKey, parameters map[string]string, report tokenMetricsReporter) {
+	token, err := a.fetch(key, parameters, report)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err != nil {
+		log.Warnf("Unable to refresh token for %s/%s, still using the current one: %v", a.address, key.repository, err)
+		if cached, present := a.tokens[key]; present {
+			cached.refreshing = false
+		}
+		return
+	}
+	a.cacheToken(key, token)
+}
+
+// cacheToken caches token, and prunes the expired ones, e.g. for repositories that don't get pulled anymore;
+// expects the lock to be held.
+func (a *tokenAuthenticator) cacheToken(key tokenKey, token *cachedToken) {
+	now := a.now()
+	for cachedKey, cached := range a.tokens {
+		if !now.Before(cached.expiresAt) {
+			delete(a.tokens, cachedKey)
+		}
+	}
+	a.tokens[key] = token
+}
+
+// fetch gets a new token from the token server, with a refresh token if we have one, and basic credentials
+// otherwise, or anonymously if we have neither.
+func (a *tokenAuthenticator) fetch(key tokenKey, parameters map[string]string, report tokenMetricsReporter) (token *cachedToken, err error) {
+	realm := parameters["realm"]
+	realmURL, err := url.Parse(realm)
+	if err != nil || realm == "" {
+		return nil, errors.Errorf("invalid token realm %q in the challenge from %s", realm, a.address)
+	}
+	service := parameters["service"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), tokenFetchTimeout)
+	defer cancel()
+	opts := []httputil.SendOption{
+		httputil.SendTransport(a.transport),
+		httputil.DisableHTTPFallback(),
+		httputil.SendContext(ctx),
+	}
+
+	var response *http.Response
+	if refreshToken := a.credentials.RefreshToken(realmURL, service); refreshToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+			"service":       {service},
+			"scope":         {key.scope},
+			"client_id":     {tokenClientID},
+		}
+		response, err = httputil.Post(realm, append(opts,
+			httputil.SendBody(strings.NewReader(form.Encode())),
+			httputil.SendHeaders(map[string]string{"Content-Type": "application/x-www-form-urlencoded"}))...)
+	} else {
+		query := realmURL.Query()
+		query.Set("service", service)
+		query.Set("scope", key.scope)
+		query.Set("client_id", tokenClientID)
+
+		headers := make(map[string]string)
+		if username, password := a.credentials.Basic(realmURL); username != "" {
+			query.Set("account", username)
+			headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		}
+		realmURL.RawQuery = query.Encode()
+
+		response, err = httputil.Get(realmURL.String(), append(opts, httputil.SendHeaders(headers))...)
+	}
+
+	report.report(TokenFetchCounter, MetricLabels{StatusClassLabel: statusClass(response, err)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get a token for %s/%s", a.address, key.repository)
+	}
+	defer response.Body.Close()
+
+	parsed := &tokenResponse{}
+	if err := json.NewDecoder(response.Body).Decode(parsed); err != nil {
+		return nil, errors.Wrapf(err, "unable to decode token for %s/%s", a.address, key.repository)
+	}
+	if parsed.Token == "" {
+		parsed.Token = parsed.AccessToken
+	}
+	if parsed.Token == "" {
+		return nil, errors.Errorf("no token in the response from %s", realm)
+	}
+
+	lifetime := time.Duration(parsed.ExpiresIn) * time.Second
+	if lifetime < minimumTokenLifetime {
+		lifetime = minimumTokenLifetime
+	}
+	// lifetimes start when we get tokens rather than when the token server says it issued them, so that
+	// clock skew doesn't get tokens used after they've expired
+	now := a.now()
+	return &cachedToken{
+		token:     parsed.Token,
+		fetchedAt: now,
+		expiresAt: now.Add(lifetime),
+	}, nil
+}
+
+func (t *cachedToken) refreshAt() time.Time {
+	lifetime := t.expiresAt.Sub(t.fetchedAt)
+	return t.expiresAt.Add(-lifetime / tokenRefreshFraction)
+}
+
+// authorizationModifier sets the Authorization header on requests to the registry, but not on requests
+// it redirects to, e.g. pre-signed blob storage URLs, which would reject them.
+type authorizationModifier struct {
+	host          string
+	authorization string
+}
+
+var _ transport.RequestModifier = &authorizationModifier{}
+
+func (m *authorizationModifier) ModifyRequest(request *http.Request) error {
+	if request.URL.Host == m.host {
+		request.Header.Set("Authorization", m.authorization)
+	}
+	return nil
+}
+
+// staticCredentialStore serves the credentials from a registry's security block.
+type staticCredentialStore struct {
+	credentials registryCredentials
+}
+
+var _ auth.CredentialStore = &staticCredentialStore{}
+
+func (s *staticCredentialStore) Basic(*url.URL) (string, string) {
+	return s.credentials.username, s.credentials.secret
+}
+
+func (s *staticCredentialStore) RefreshToken(*url.URL, string) string {
+	return s.credentials.identityToken
+}
+
+func (s *staticCredentialStore) SetRefreshToken(*url.URL, string, string) {}
@@ -0,0 +1,344 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/engine-api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	registry := &tokenRegistry{expiresIn: 300}
+	address, registryCleanup := registry.start(t)
+	defer registryCleanup()
+
+	clock := &fakeClock{}
+	newAuthenticator := func(credentials *registryCredentials) *tokenAuthenticator {
+		config := krakenconfig.Config{Address: address}
+		config.Security.EnableHTTPFallback = true
+
+		var store auth.CredentialStore
+		if credentials != nil {
+			store = &staticCredentialStore{*credentials}
+		}
+		authenticator, err := newTokenAuthenticator(config, store, (&upstreamDialer{}).newTransport())
+		require.NoError(t, err)
+		authenticator.now = clock.now
+		return authenticator
+	}
+
+	// returns the Authorization header the registry got
+	pull := func(authenticator *tokenAuthenticator, repository string) string {
+		opts, err := authenticator.Authenticate(repository)
+		require.NoError(t, err)
+
+		response, err := httputil.Get(fmt.Sprintf("http://%s/v2/%s/manifests/latest", address, repository), opts...)
+		require.NoError(t, err)
+		return string(readResponseBody(t, response))
+	}
+
+	authenticator := newAuthenticator(&registryCredentials{username: "bob", secret: "pw"})
+	defer authenticator.transport.CloseIdleConnections()
+
+	// tokens are cached per repository, and so is the challenge
+	assert.Equal(t, "Bearer token-1", pull(authenticator, "ubuntu"))
+	assert.Equal(t, "Bearer token-1", pull(authenticator, "ubuntu"))
+	assert.Equal(t, "Bearer token-2", pull(authenticator, "debian"))
+	assert.Equal(t, int32(2), registry.fetchCount())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&registry.pings))
+
+	lastFetch := registry.lastFetch()
+	assert.Equal(t, "bob:pw", lastFetch.basic)
+	assert.Equal(t, "repository:debian:pull", lastFetch.scope)
+	assert.Equal(t, tokenRegistryService, lastFetch.service)
+
+	// about to expire, they get refreshed in the background
+	clock.advance(250 * time.Second)
+	assert.Equal(t, "Bearer token-1", pull(authenticator, "ubuntu"))
+	assert.Eventually(t, func() bool {
+		return pull(authenticator, "ubuntu") == "Bearer token-3"
+	}, genericTestTimeout, 10*time.Millisecond)
+
+	// expired, they get fetched right away
+	clock.advance(10 * time.Minute)
+	assert.Equal(t, "Bearer token-4", pull(authenticator, "debian"))
+	assert.Equal(t, int32(4), registry.fetchCount())
+	// and the expired ones get pruned
+	authenticator.mutex.Lock()
+	assert.Equal(t, 1, len(authenticator.tokens))
+	authenticator.mutex.Unlock()
+
+	t.Run("invalidating tokens", func(t *testing.T) {
+		assert.True(t, authenticator.invalidate("debian"))
+		assert.False(t, authenticator.invalidate("debian"))
+		assert.False(t, authenticator.invalidate("alpine"))
+
+		pingsBefore := atomic.LoadInt32(&registry.pings)
+		assert.Equal(t, "Bearer token-5", pull(authenticator, "debian"))
+		assert.Equal(t, pingsBefore+1, atomic.LoadInt32(&registry.pings))
+	})
+
+	t.Run("concurrent requests for the same repository share the same fetch", func(t *testing.T) {
+		fetchesBefore := registry.fetchCount()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := authenticator.Authenticate("alpine")
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, fetchesBefore+1, registry.fetchCount())
+	})
+
+	t.Run("identity tokens get exchanged for tokens", func(t *testing.T) {
+		withIdentityToken := newAuthenticator(&registryCredentials{identityToken: "refresh-me"})
+		defer withIdentityToken.transport.CloseIdleConnections()
+
+		assert.Contains(t, pull(withIdentityToken, "ubuntu"), "Bearer token-")
+		lastFetch := registry.lastFetch()
+		assert.Equal(t, "refresh_token", lastFetch.grantType)
+		assert.Equal(t, "refresh-me", lastFetch.refreshToken)
+		assert.Equal(t, "repository:ubuntu:pull", lastFetch.scope)
+	})
+
+	t.Run("without credentials, requests get sent as they are", func(t *testing.T) {
+		anonymous := newAuthenticator(nil)
+		defer anonymous.transport.CloseIdleConnections()
+
+		fetchesBefore := registry.fetchCount()
+		opts, err := anonymous.Authenticate("ubuntu")
+		require.NoError(t, err)
+		_, err = httputil.Get(fmt.Sprintf("http://%s/v2/ubuntu/manifests/latest", address), opts...)
+		assert.True(t, httputil.IsStatus(err, http.StatusUnauthorized))
+		assert.Equal(t, fetchesBefore, registry.fetchCount())
+	})
+}
+
+func TestDockerRegistryHijackerTokenCache(t *testing.T) {
+	originAddress, originCleanup := withDummyRegistry(t, 1)
+	defer originCleanup()
+
+	redirect := &tokenRegistry{expiresIn: 3600}
+	redirectAddress, redirectCleanup := redirect.start(t)
+	defer redirectCleanup()
+
+	redirectConfig := RedirectRegistry{Config: krakenConfig(redirectAddress)}
+	redirectConfig.Security.EnableHTTPFallback = true
+	redirectConfig.Security.BasicAuth = &types.AuthConfig{Username: "bob", Password: "pw"}
+
+	registry := Registry{
+		Config:    krakenConfig(originAddress),
+		Redirects: []RedirectRegistry{redirectConfig},
+	}
+	registry.Security.EnableHTTPFallback = true
+
+	hijacker, err := NewDockerRegistryHijacker(&Config{Registries: []Registry{registry}})
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	sanitizedRedirect := strings.NewReplacer(".", "_", ":", "_").Replace(redirectAddress)
+	hit := fmt.Sprintf("%s.%s:1", TokenCacheHitCounter, sanitizedRedirect)
+	miss := fmt.Sprintf("%s.%s:1", TokenCacheMissCounter, sanitizedRedirect)
+	fetch := fmt.Sprintf("%s.%s.2xx:1", TokenFetchCounter, sanitizedRedirect)
+
+	// returns the response's body, and the metrics reported
+	pull := func() (string, []string) {
+		reporter := &recordingMetricsReporter{hijacker: hijacker}
+		request := withMetricsReporter(buildGetRequest(t, "http://"+originAddress+"/v2/ubuntu/manifests/18"), reporter)
+
+		hijacked, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		require.NoError(t, err)
+		require.True(t, hijacked)
+		return string(readResponseBody(t, response)), reporter.metrics
+	}
+
+	t.Run("tokens get fetched once, then served from the cache", func(t *testing.T) {
+		body, metrics := pull()
+		assert.Equal(t, "Bearer token-1", body)
+		assert.Contains(t, metrics, miss)
+		assert.Contains(t, metrics, fetch)
+		assert.NotContains(t, metrics, hit)
+
+		body, metrics = pull()
+		assert.Equal(t, "Bearer token-1", body)
+		assert.Contains(t, metrics, hit)
+		assert.NotContains(t, metrics, miss)
+		assert.NotContains(t, metrics, fetch)
+
+		assert.Equal(t, int32(1), redirect.fetchCount())
+	})
+
+	t.Run("a rejected token gets invalidated, and the request retried with a new one", func(t *testing.T) {
+		redirect.revoke("token-1")
+
+		body, metrics := pull()
+		assert.Equal(t, "Bearer token-2", body)
+		assert.Contains(t, metrics, hit)
+		assert.Contains(t, metrics, miss)
+		assert.Contains(t, metrics, fetch)
+	})
+
+	t.Run("it only retries once", func(t *testing.T) {
+		redirect.revoke("token-2")
+		redirect.revoke("token-3")
+		manifestsBefore := atomic.LoadInt32(&redirect.manifests)
+
+		reporter := &recordingMetricsReporter{hijacker: hijacker}
+		request := withMetricsReporter(buildGetRequest(t, "http://"+originAddress+"/v2/ubuntu/manifests/18"), reporter)
+		_, _, err := hijacker.RequestHandler(&dummyResponseWriter{}, request)
+		// not on the origin either
+		assert.Error(t, err)
+
+		assert.Equal(t, manifestsBefore+2, atomic.LoadInt32(&redirect.manifests))
+		assert.Equal(t, int32(3), redirect.fetchCount())
+	})
+}
+
+/*** Helpers below ***/
+
+const tokenRegistryService = "test-registry"
+
+// a tokenRegistry requires bearer tokens, that it issues itself as token-<n>, n being how many it's issued;
+// its manifests reply with the Authorization header they got.
+type tokenRegistry struct {
+	// in seconds
+	expiresIn int
+
+	pings     int32
+	manifests int32
+
+	fetches []tokenRegistryFetch
+	revoked map[string]bool
+	mutex   sync.Mutex
+}
+
+type tokenRegistryFetch struct {
+	basic        string
+	grantType    string
+	refreshToken string
+	scope        string
+	service      string
+}
+
+func (r *tokenRegistry) fetchCount() int32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return int32(len(r.fetches))
+}
+
+func (r *tokenRegistry) lastFetch() tokenRegistryFetch {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.fetches[len(r.fetches)-1]
+}
+
+func (r *tokenRegistry) revoke(token string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.revoked == nil {
+		r.revoked = make(map[string]bool)
+	}
+	r.revoked[token] = true
+}
+
+// valid returns true iff the Authorization header carries a token the registry issued, and hasn't revoked.
+func (r *tokenRegistry) valid(authorization string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || r.revoked[token] {
+		return false
+	}
+	for i := range r.fetches {
+		if token == fmt.Sprintf("token-%d", i+1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tokenRegistry) issue(t *testing.T, request *http.Request) string {
+	require.NoError(t, request.ParseForm())
+
+	fetch := tokenRegistryFetch{
+		grantType:    request.Form.Get("grant_type"),
+		refreshToken: request.Form.Get("refresh_token"),
+		scope:        request.Form.Get("scope"),
+		service:      request.Form.Get("service"),
+	}
+	if username, password, ok := request.BasicAuth(); ok {
+		fetch.basic = username + ":" + password
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.fetches = append(r.fetches, fetch)
+	return fmt.Sprintf("token-%d", len(r.fetches))
+}
+
+func (r *tokenRegistry) start(t *testing.T) (address string, cleanup func()) {
+	address = localhostAddr(getAvailablePort(t))
+
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/token" {
+			require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+				"token":      r.issue(t, request),
+				"expires_in": r.expiresIn,
+			}))
+			return
+		}
+
+		if strings.TrimRight(request.URL.Path, "/") == "/v2" {
+			atomic.AddInt32(&r.pings, 1)
+		} else {
+			atomic.AddInt32(&r.manifests, 1)
+		}
+
+		authorization := request.Header.Get("Authorization")
+		if !r.valid(authorization) {
+			writer.Header().Set(wwwAuthenticateHeader,
+				fmt.Sprintf(`Bearer realm="http://%s/token",service=%q`, address, tokenRegistryService))
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, err := writer.Write([]byte(authorization))
+		require.NoError(t, err)
+	}
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: http.HandlerFunc(handler),
+	}
+
+	listeningChan := make(chan interface{})
+	go func() {
+		require.NoError(t, startHTTPServer(server, listeningChan, nil, ""))
+	}()
+
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for token registry to start listening")
+	}
+
+	return address, func() {
+		require.NoError(t, server.Close())
+	}
+}
@@ -0,0 +1,304 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/uber/kraken/lib/backend/registrybackend/security"
+	"github.com/uber/kraken/utils/httputil"
+)
+
+const (
+	// Docker Hub's legacy address, which reference normalizes to docker.io
+	legacyDockerHubAddress = "index.docker.io"
+
+	defaultImageTag = "latest"
+)
+
+// what we accept when probing manifests, so that registries don't reply 404 for manifest lists and OCI images
+var probeManifestMediaTypes = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+// RouteExplanation describes how the DockerRegistryHijacker would handle pulling an image's manifest.
+type RouteExplanation struct {
+	Image      string `json:"image"`
+	Host       string `json:"host"`
+	Repository string `json:"repository"`
+	Reference  string `json:"reference"`
+
+	// empty if no registry matches, in which case pulls simply get proxied through
+	Registry  string `json:"registry,omitempty"`
+	MatchedBy string `json:"matched_by,omitempty"`
+	// registries listed after the matching one that would match too, but never get used
+	Shadowed []string `json:"shadowed,omitempty"`
+	// whether clients need to authenticate to the registry themselves
+	ClientAuth bool `json:"client_auth,omitempty"`
+
+	// in the order they'd be tried: first the redirects, then the origin registry
+	Attempts []*RouteAttempt `json:"attempts,omitempty"`
+
+	// only when probing: the first registry that would serve the image, if any
+	ServedBy string `json:"served_by,omitempty"`
+}
+
+// RouteAttempt is a registry the DockerRegistryHijacker would try to pull an image from.
+type RouteAttempt struct {
+	Registry string `json:"registry"`
+	Origin   bool   `json:"origin,omitempty"`
+	// the rewrite_repositories rule that applies, if any
+	RewriteRule   string `json:"rewrite_repositories,omitempty"`
+	URL           string `json:"url"`
+	Authenticator string `json:"authenticator"`
+	HTTPFallback  bool   `json:"http_fallback,omitempty"`
+	// for redirects, what happens to the client's credentials
+	ClientCredentials ClientCredentialsPolicy `json:"client_credentials,omitempty"`
+
+	// only when probing
+	Probe *RouteProbe `json:"probe,omitempty"`
+
+	client     *registryClient
+	repository string
+}
+
+// RouteProbe is the outcome of a HEAD request for an image's manifest.
+type RouteProbe struct {
+	// 0 if the registry didn't respond
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Duration   string `json:"duration"`
+}
+
+// Explain describes how a pull of image, e.g. ubuntu:20.04 or quay.io/org/repo@sha256:..., would get
+// handled; if probe is true, it also sends a HEAD request for the image's manifest to each registry that
+// would be tried, to tell which would serve it.
+func (h *DockerRegistryHijacker) Explain(ctx context.Context, image string, probe bool) (*RouteExplanation, error) {
+	host, repository, ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &RouteExplanation{
+		Image:      image,
+		Host:       host,
+		Repository: repository,
+		Reference:  ref,
+	}
+
+	var matched *hijackedRegistry
+	for _, registry := range h.currentRegistries() {
+		matchedBy := registry.matchedBy(host)
+		if matchedBy == "" {
+			continue
+		}
+
+		if matched == nil {
+			matched = registry
+			explanation.Registry = registry.Address
+			explanation.MatchedBy = matchedBy
+			explanation.ClientAuth = registry.clientAuth != nil
+		} else {
+			explanation.Shadowed = append(explanation.Shadowed, registry.Address)
+		}
+	}
+	if matched == nil {
+		return explanation, nil
+	}
+
+	for _, redirect := range matched.redirects {
+		attempt := newRouteAttempt(redirect.registryClient, redirect.rewriteRepositories, repository, ref)
+		attempt.ClientCredentials = redirect.clientCredentials
+		explanation.Attempts = append(explanation.Attempts, attempt)
+	}
+	origin := newRouteAttempt(matched.registryClient, "", repository, ref)
+	origin.Origin = true
+	explanation.Attempts = append(explanation.Attempts, origin)
+
+	if probe {
+		for _, attempt := range explanation.Attempts {
+			attempt.Probe = attempt.probe(ctx, ref)
+			if attempt.Probe.Error == "" && explanation.ServedBy == "" {
+				explanation.ServedBy = attempt.Registry
+			}
+		}
+	}
+
+	return explanation, nil
+}
+
+// String renders the explanation for humans.
+func (e *RouteExplanation) String() string {
+	var result strings.Builder
+
+	fmt.Fprintf(&result, "Image:      %s\nHost:       %s\nRepository: %s\nReference:  %s\n",
+		e.Image, e.Host, e.Repository, e.Reference)
+
+	if e.Registry == "" {
+		result.WriteString("\nNo registry matches, pulls are proxied through as is\n")
+		return result.String()
+	}
+
+	fmt.Fprintf(&result, "Registry:   %s, matched by %s\n", e.Registry, e.MatchedBy)
+	if len(e.Shadowed) != 0 {
+		fmt.Fprintf(&result, "Shadowed:   %s\n", strings.Join(e.Shadowed, ", "))
+	}
+	if e.ClientAuth {
+		result.WriteString("Clients need to be allowed to pull from the registry itself\n")
+	}
+
+	result.WriteString("\nTried in order:\n")
+	for i, attempt := range e.Attempts {
+		kind := "redirect"
+		if attempt.Origin {
+			kind = "origin"
+		}
+		fmt.Fprintf(&result, "%d. %s %s\n", i+1, kind, attempt.Registry)
+		fmt.Fprintf(&result, "   URL:  %s\n", attempt.URL)
+		if attempt.RewriteRule != "" {
+			fmt.Fprintf(&result, "   Rewritten with: %s\n", attempt.RewriteRule)
+		}
+		auth := attempt.Authenticator
+		if attempt.HTTPFallback {
+			auth += ", falling back to HTTP"
+		}
+		fmt.Fprintf(&result, "   Auth: %s\n", auth)
+		if attempt.ClientCredentials != "" {
+			fmt.Fprintf(&result, "   Client credentials: %s\n", attempt.ClientCredentials)
+		}
+
+		if probe := attempt.Probe; probe != nil {
+			if probe.Error == "" {
+				fmt.Fprintf(&result, "   Probe: %d in %s\n", probe.StatusCode, probe.Duration)
+			} else {
+				fmt.Fprintf(&result, "   Probe: failed in %s: %s\n", probe.Duration, probe.Error)
+			}
+		}
+	}
+
+	if e.Attempts[0].Probe != nil {
+		if e.ServedBy == "" {
+			result.WriteString("\nNo registry would serve the image\n")
+		} else {
+			fmt.Fprintf(&result, "\nWould be served by %s\n", e.ServedBy)
+		}
+	}
+
+	return result.String()
+}
+
+func newRouteAttempt(client *registryClient, rewriteRule, repository, ref string) *RouteAttempt {
+	newRepository := rewriteRepository(rewriteRule, repository, ref)
+
+	return &RouteAttempt{
+		Registry:      client.Address,
+		RewriteRule:   rewriteRule,
+		URL:           fmt.Sprintf("https://%s/v2/%s/%ss/%s", client.Address, newRepository, manifestQuery, ref),
+		Authenticator: describeAuthenticator(client.Security, client.credentials),
+		HTTPFallback:  client.Security.EnableHTTPFallback,
+		client:        client,
+		repository:    newRepository,
+	}
+}
+
+// probe sends a HEAD request for the manifest, the same way RequestHandler would send a GET.
+func (a *RouteAttempt) probe(ctx context.Context, ref string) *RouteProbe {
+	startedAt := time.Now()
+	result := &RouteProbe{}
+	defer func() {
+		result.Duration = time.Since(startedAt).Round(time.Millisecond).String()
+	}()
+
+	opts, err := authenticate(ctx, a.client, a.repository, nil)
+	if err != nil {
+		result.Error = errors.Wrap(err, "unable to authenticate").Error()
+		return result
+	}
+	opts = append([]httputil.SendOption{httputil.SendTransport(a.client.transport)}, opts...)
+	opts = append(opts,
+		httputil.SendHeaders(map[string]string{"Accept": probeManifestMediaTypes}),
+		httputil.SendTimeout(a.client.Config.Timeout),
+		httputil.SendContext(ctx))
+
+	response, err := httputil.Head(fmt.Sprintf("http://%s/v2/%s/%ss/%s", a.client.Address, a.repository, manifestQuery, ref), opts...)
+	if err != nil {
+		if statusErr, ok := err.(httputil.StatusError); ok {
+			result.StatusCode = statusErr.Status
+		}
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+	if response.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("unexpected status %d", response.StatusCode)
+	}
+	return result
+}
+
+// matchedBy returns how host matches the registry, or an empty string if it doesn't; same rules as findRegistry.
+func (r *hijackedRegistry) matchedBy(host string) string {
+	if r.Address == host {
+		return "address"
+	}
+	if r.matchingRegex != nil && r.matchingRegex.MatchString(host) {
+		return fmt.Sprintf("matching_regex %q", r.matchingRegex.String())
+	}
+	return ""
+}
+
+// parseImageReference splits image into the host pulls get sent to, the repository, and the tag or digest.
+func parseImageReference(image string) (host, repository, ref string, err error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", "", errors.Wrapf(err, "invalid image reference %q", image)
+	}
+
+	host = reference.Domain(named)
+	if host == dockerHubNamespace {
+		if strings.HasPrefix(image, legacyDockerHubAddress+"/") {
+			host = legacyDockerHubAddress
+		} else {
+			host = dockerHubRegistryAddress
+		}
+	}
+
+	// digests take precedence over tags, same as when pulling
+	switch typed := named.(type) {
+	case reference.Digested:
+		ref = typed.Digest().String()
+	case reference.Tagged:
+		ref = typed.Tag()
+	default:
+		ref = defaultImageTag
+	}
+
+	return host, reference.Path(named), ref, nil
+}
+
+func describeAuthenticator(config security.Config, credentials *CredentialsConfig) string {
+	switch {
+	case config.TLS.Client.Disabled:
+		return "none, TLS is disabled"
+	case credentials != nil && credentials.Helper != "":
+		return fmt.Sprintf("basic or token auth, with credentials from the %q helper, refreshed before they expire", credentials.Helper)
+	case credentials != nil:
+		return fmt.Sprintf("basic or token auth, with credentials from %q, refreshed before they expire", credentials.DockerConfig)
+	case config.RemoteCredentialsStore != "":
+		return fmt.Sprintf("basic or token auth, with credentials from the %q helper", config.RemoteCredentialsStore)
+	case config.BasicAuth != nil && config.BasicAuth.IdentityToken != "":
+		return "token auth, with an identity token"
+	case config.BasicAuth != nil:
+		return fmt.Sprintf("basic or token auth, as %q", config.BasicAuth.Username)
+	default:
+		return "anonymous"
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImageReference(t *testing.T) {
+	for _, testCase := range []struct {
+		image      string
+		host       string
+		repository string
+		ref        string
+	}{
+		{image: "ubuntu", host: "registry-1.docker.io", repository: "library/ubuntu", ref: "latest"},
+		{image: "docker.io/org/repo:1.0", host: "registry-1.docker.io", repository: "org/repo", ref: "1.0"},
+		{image: "index.docker.io/library/ubuntu:20.04", host: "index.docker.io", repository: "library/ubuntu", ref: "20.04"},
+		{image: "localhost:5000/a/b/c:tag", host: "localhost:5000", repository: "a/b/c", ref: "tag"},
+		{
+			image:      "quay.io/org/repo:1.0@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			host:       "quay.io",
+			repository: "org/repo",
+			ref:        "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+	} {
+		host, repository, ref, err := parseImageReference(testCase.image)
+		require.NoError(t, err, testCase.image)
+		assert.Equal(t, testCase.host, host, testCase.image)
+		assert.Equal(t, testCase.repository, repository, testCase.image)
+		assert.Equal(t, testCase.ref, ref, testCase.image)
+	}
+
+	_, _, _, err := parseImageReference("UPPERCASE/not:valid")
+	assert.Error(t, err)
+}
+
+func TestDockerRegistryHijackerExplain(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:16")
+	defer registryCleanup()
+	redirect1Address, redirect1Cleanup := withDummyRegistry(t, 2)
+	defer redirect1Cleanup()
+	redirect2Address, redirect2Cleanup := withDummyRegistry(t, 3, "mirror-ubuntu:16")
+	defer redirect2Cleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	redirect1 := RedirectRegistry{Config: krakenConfig(redirect1Address)}
+	redirect1.Security.EnableHTTPFallback = true
+	redirect2 := RedirectRegistry{Config: krakenConfig(redirect2Address), RewriteRepositories: "mirror-%r"}
+	redirect2.Security.EnableHTTPFallback = true
+	origin := Registry{Config: krakenConfig(registryAddress), Redirects: []RedirectRegistry{redirect1, redirect2}}
+	origin.Security.EnableHTTPFallback = true
+
+	config := &Config{
+		Registries: []Registry{
+			origin,
+			{
+				Config:        krakenConfig("catch-all.example.com"),
+				MatchingRegex: ".*",
+				Redirects:     []RedirectRegistry{{Config: krakenConfig("localhost:5000")}},
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	t.Run("it lists the attempts in order, with rewritten URLs", func(t *testing.T) {
+		explanation, err := hijacker.Explain(context.Background(), registryAddress+"/ubuntu:16", false)
+		require.NoError(t, err)
+
+		assert.Equal(t, registryAddress, explanation.Registry)
+		assert.Equal(t, "address", explanation.MatchedBy)
+		assert.Equal(t, []string{"catch-all.example.com"}, explanation.Shadowed)
+
+		require.Len(t, explanation.Attempts, 3)
+		assert.Equal(t, "https://"+redirect1Address+"/v2/ubuntu/manifests/16", explanation.Attempts[0].URL)
+		assert.Equal(t, "https://"+redirect2Address+"/v2/mirror-ubuntu/manifests/16", explanation.Attempts[1].URL)
+		assert.Equal(t, "mirror-%r", explanation.Attempts[1].RewriteRule)
+		assert.True(t, explanation.Attempts[2].Origin)
+		assert.Equal(t, "anonymous", explanation.Attempts[2].Authenticator)
+		for _, attempt := range explanation.Attempts {
+			assert.Nil(t, attempt.Probe)
+		}
+		assert.Empty(t, explanation.ServedBy)
+	})
+
+	t.Run("it tells which registry would serve the image when probing", func(t *testing.T) {
+		explanation, err := hijacker.Explain(context.Background(), registryAddress+"/ubuntu:16", true)
+		require.NoError(t, err)
+
+		require.Len(t, explanation.Attempts, 3)
+		assert.Equal(t, http.StatusNotFound, explanation.Attempts[0].Probe.StatusCode)
+		assert.NotEmpty(t, explanation.Attempts[0].Probe.Error)
+		assert.Equal(t, http.StatusOK, explanation.Attempts[1].Probe.StatusCode)
+		assert.Empty(t, explanation.Attempts[1].Probe.Error)
+		assert.Equal(t, http.StatusOK, explanation.Attempts[2].Probe.StatusCode)
+		assert.Equal(t, redirect2Address, explanation.ServedBy)
+
+		assert.Contains(t, explanation.String(), "Would be served by "+redirect2Address)
+	})
+
+	t.Run("it reports registries matched by regex", func(t *testing.T) {
+		explanation, err := hijacker.Explain(context.Background(), "quay.io/org/repo", false)
+		require.NoError(t, err)
+
+		assert.Equal(t, "catch-all.example.com", explanation.Registry)
+		assert.Equal(t, `matching_regex ".*"`, explanation.MatchedBy)
+	})
+
+	t.Run("it's served by the admin server", func(t *testing.T) {
+		adminAddress, adminCleanup := withTestAdminServer(t, &Config{}, WithRouteExplanations(hijacker))
+		defer adminCleanup()
+		baseURL := "http://" + adminAddress
+
+		resp, body := makeRequest(t, nil, baseURL, "/explain?probe=true&image="+url.QueryEscape(registryAddress+"/ubuntu:16"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		explanation := &RouteExplanation{}
+		require.NoError(t, json.Unmarshal(body, explanation))
+		assert.Equal(t, redirect2Address, explanation.ServedBy)
+
+		resp, _ = makeRequest(t, nil, baseURL, "/explain?image=UPPERCASE/not:valid")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
@@ -0,0 +1,385 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	goerrors "errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929 for username/password authentication.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5CommandConnect = 0x01
+
+	socks5AddressIPv4   = 0x01
+	socks5AddressDomain = 0x03
+	socks5AddressIPv6   = 0x04
+
+	socks5ReplySucceeded               = 0x00
+	socks5ReplyGeneralFailure          = 0x01
+	socks5ReplyNetworkUnreachable      = 0x03
+	socks5ReplyHostUnreachable         = 0x04
+	socks5ReplyConnectionRefused       = 0x05
+	socks5ReplyCommandNotSupported     = 0x07
+	socks5ReplyAddressTypeNotSupported = 0x08
+
+	// the first byte of TLS handshake records, that all TLS connections start with
+	tlsRecordTypeHandshake = 0x16
+
+	// how long we wait for clients to go through the SOCKS5 handshake, and then to send their first bytes
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+var errSocks5AuthFailed = errors.New("SOCKS5 authentication failed")
+
+// socks5Server accepts SOCKS5 connections, and hands them over to its mitmHandler once the SOCKS5
+// handshake is done, so that they get either intercepted or tunneled just like transparent connections.
+type socks5Server struct {
+	handler    *mitmHandler
+	controller *accessController
+
+	// if not nil, gets called for each client that fails to authenticate
+	unauthenticated func(conn net.Conn)
+
+	// defaults to socks5HandshakeTimeout, allows overriding in tests
+	handshakeTimeout time.Duration
+}
+
+// serve accepts connections until the listener gets closed.
+func (s *socks5Server) serve(listener net.Listener) error {
+	return serveConns(listener, s.serveConn)
+}
+
+func (s *socks5Server) serveConn(conn net.Conn) {
+	handshakeTimeout := s.handshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = socks5HandshakeTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		log.Warnf("Unable to set deadline on SOCKS5 connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	address, err := s.handshake(reader, conn)
+	if err != nil {
+		if err == errSocks5AuthFailed && s.unauthenticated != nil {
+			s.unauthenticated(conn)
+		}
+		log.Warnf("SOCKS5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if net.ParseIP(dnsName(address)) != nil {
+		// whether to intercept depends on the server name the client asks for, see serveIPConn
+		s.serveIPConn(conn, reader, address)
+		return
+	}
+
+	if !s.handler.intercept(address) {
+		upstreamConn, ok := s.dial(conn, address)
+		if ok {
+			s.handler.tunnel(connectRequest(address), &bufferedConn{Conn: conn, reader: reader}, upstreamConn)
+		}
+		return
+	}
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded); err != nil {
+		log.Warnf("Unable to reply to SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	isTLS, ok := peekIsTLS(conn, reader)
+	if !ok {
+		return
+	}
+
+	clientConn := &bufferedConn{Conn: conn, reader: reader}
+	if isTLS {
+		s.handler.interceptTLS(clientConn, address, dnsName(address))
+	} else {
+		s.handler.interceptHTTP(clientConn, address)
+	}
+}
+
+// serveIPConn serves clients that gave an IP rather than a domain name: the server name from their
+// TLS ClientHello, if any, is what decides whether to intercept, just like for transparent connections.
+// Since clients only send it once we've replied, upstream gets dialed first, to be able to let them
+// know if it can't be reached.
+func (s *socks5Server) serveIPConn(conn net.Conn, reader *bufio.Reader, address string) {
+	upstreamConn, ok := s.dial(conn, address)
+	if !ok {
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		log.Warnf("Unable to set read deadline on SOCKS5 connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		upstreamConn.Close()
+		return
+	}
+	isTLS, ok := peekIsTLS(conn, reader)
+	if !ok {
+		upstreamConn.Close()
+		return
+	}
+
+	var clientConn net.Conn = &bufferedConn{Conn: conn, reader: reader}
+	serverName := dnsName(address)
+	if isTLS {
+		err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+		var hello *tls.ClientHelloInfo
+		var replayConn net.Conn
+		if err == nil {
+			hello, replayConn, err = peekClientHello(clientConn)
+		}
+		if err == nil {
+			err = conn.SetReadDeadline(time.Time{})
+		}
+		if err != nil {
+			log.Warnf("Unable to read TLS ClientHello from SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			upstreamConn.Close()
+			return
+		}
+
+		clientConn = replayConn
+		if hello.ServerName != "" {
+			serverName = hello.ServerName
+		}
+	}
+
+	// the address as the client sees it
+	_, port, _ := net.SplitHostPort(address)
+	clientAddress := net.JoinHostPort(serverName, port)
+
+	if !s.handler.intercept(clientAddress) {
+		s.handler.tunnel(connectRequest(clientAddress), clientConn, upstreamConn)
+		return
+	}
+
+	upstreamConn.Close()
+	if isTLS {
+		s.handler.interceptTLS(clientConn, address, serverName)
+	} else {
+		s.handler.interceptHTTP(clientConn, address)
+	}
+}
+
+// dial dials address, lets the client know how that went, and clears the handshake deadline; if it returns
+// false, the client's connection has been closed.
+func (s *socks5Server) dial(conn net.Conn, address string) (net.Conn, bool) {
+	upstreamConn, err := s.handler.dialer.DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		log.Warnf("Unable to dial %s: %v", address, err)
+		_ = writeSocks5Reply(conn, socks5DialErrorReply(err))
+		conn.Close()
+		return nil, false
+	}
+
+	err = writeSocks5Reply(conn, socks5ReplySucceeded)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Warnf("Unable to reply to SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		upstreamConn.Close()
+		return nil, false
+	}
+	return upstreamConn, true
+}
+
+// peekIsTLS tells whether the client speaks TLS or plain HTTP, from its first byte; if it returns false
+// as its second value, the client's connection has been closed.
+func peekIsTLS(conn net.Conn, reader *bufio.Reader) (isTLS bool, ok bool) {
+	firstBytes, err := reader.Peek(1)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Warnf("Unable to read from SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return false, false
+	}
+	return firstBytes[0] == tlsRecordTypeHandshake, true
+}
+
+// handshake goes through the method negotiation, the authentication if required, and then reads
+// the client's request; it returns the address (host:port) the client wants to connect to.
+func (s *socks5Server) handshake(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", errors.Wrap(err, "unable to read greeting")
+	}
+	if header[0] != socks5Version {
+		return "", errors.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", errors.Wrap(err, "unable to read authentication methods")
+	}
+
+	method := byte(socks5AuthNone)
+	if s.controller.requiresAuthentication() {
+		method = socks5AuthUserPass
+	}
+	if !containsByte(methods, method) {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", errors.Errorf("no acceptable authentication method among %v", methods)
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	if method == socks5AuthUserPass {
+		if err := s.authenticate(reader, conn); err != nil {
+			return "", err
+		}
+	}
+
+	return readSocks5Request(reader, conn)
+}
+
+// authenticate goes through the username/password authentication from RFC 1929.
+func (s *socks5Server) authenticate(reader *bufio.Reader, conn net.Conn) error {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "unable to read authentication request")
+	}
+	if version != socks5UserPassVersion {
+		return errors.Errorf("unsupported username/password authentication version %d", version)
+	}
+
+	username, err := readSocks5String(reader)
+	if err != nil {
+		return errors.Wrap(err, "unable to read username")
+	}
+	password, err := readSocks5String(reader)
+	if err != nil {
+		return errors.Wrap(err, "unable to read password")
+	}
+
+	if !s.controller.validCredentials(username, password) {
+		_, _ = conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return errSocks5AuthFailed
+	}
+	_, err = conn.Write([]byte{socks5UserPassVersion, socks5UserPassSuccess})
+	return err
+}
+
+func readSocks5Request(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", errors.Wrap(err, "unable to read request")
+	}
+	if header[0] != socks5Version {
+		return "", errors.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AddressIPv4, socks5AddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", errors.Wrap(err, "unable to read IP address")
+		}
+		host = ip.String()
+	case socks5AddressDomain:
+		domain, err := readSocks5String(reader)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to read domain name")
+		}
+		host = domain
+	default:
+		_ = writeSocks5Reply(conn, socks5ReplyAddressTypeNotSupported)
+		return "", errors.Errorf("unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", errors.Wrap(err, "unable to read port")
+	}
+
+	// only checking the command now, once the whole request has been read, so that
+	// the client gets a proper reply
+	if header[1] != socks5CommandConnect {
+		_ = writeSocks5Reply(conn, socks5ReplyCommandNotSupported)
+		return "", errors.Errorf("unsupported command %d", header[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// reads a string prefixed with its length on one byte.
+func readSocks5String(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return "", err
+	}
+	return string(buffer), nil
+}
+
+// writeSocks5Reply writes a reply with the given code; we never give out meaningful bound addresses.
+func writeSocks5Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5DialErrorReply maps errors from dialing upstream to SOCKS5 reply codes.
+func socks5DialErrorReply(err error) byte {
+	switch {
+	case isSyscallError(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case isSyscallError(err, syscall.ENETUNREACH):
+		return socks5ReplyNetworkUnreachable
+	case isSyscallError(err, syscall.EHOSTUNREACH):
+		return socks5ReplyHostUnreachable
+	}
+	if _, ok := errors.Cause(err).(*net.DNSError); ok {
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyGeneralFailure
+}
+
+func isSyscallError(err error, errno syscall.Errno) bool {
+	return goerrors.Is(errors.Cause(err), errno)
+}
+
+func containsByte(slice []byte, b byte) bool {
+	for _, candidate := range slice {
+		if candidate == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocks5Proxy(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer registryCleanup()
+
+	hijacker := &testMitmHijacker{
+		DefaultMitmHijacker: &DefaultMitmHijacker{},
+		t:                   t,
+		upstreamClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsClientConfig(t),
+			},
+		},
+		baseURL: baseURL,
+	}
+
+	t.Run("it intercepts connections the hijacker is interested in", func(t *testing.T) {
+		statsdClient := &testStatsdClient{}
+		socks5Address, proxyCleanup := withTestSocks5Proxy(t, hijacker, statsdClient)
+		defer proxyCleanup()
+		client := newSocks5Client(t, "socks5://"+socks5Address)
+
+		t.Run("with a hijacked TLS request", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			resp, respBody := makeRequest(t, client, baseURL, "/hijack_me")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, helloWorld, respBody)
+			assert.Equal(t, "new_world", resp.Header.Get("Brave"))
+			// the client sees a certificate forged by the proxy
+			assert.Equal(t, "localhost", peerCommonName(resp))
+
+			assert.Equal(t, []string{"/hello_world"}, upstreamServer.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(HijackedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+
+		t.Run("with a proxied TLS request", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			resp, respBody := makeRequest(t, client, baseURL, "/ok")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, ok, respBody)
+			assert.Equal(t, "localhost", peerCommonName(resp))
+
+			assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+
+		t.Run("with a hijacked plain HTTP request", func(t *testing.T) {
+			statsdClient.reset()
+
+			resp, respBody := makeRequest(t, client, "http://"+registryAddress, "/direct_reply")
+
+			assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+			assert.Equal(t, directReply, respBody)
+			assert.Equal(t, "toi", resp.Header.Get("coucou"))
+
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(HijackedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+
+		t.Run("with a proxied plain HTTP request", func(t *testing.T) {
+			statsdClient.reset()
+
+			resp, respBody := makeRequest(t, client, "http://"+registryAddress, "/v2/ubuntu/manifests/18")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "from registry 1: manifests for ubuntu:18", string(respBody))
+
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+	})
+
+	t.Run("it tunnels other connections to their destination", func(t *testing.T) {
+		upstreamServer.reset()
+
+		nonIntercepting := &nonInterceptingHijacker{testMitmHijacker: hijacker}
+		statsdClient := &testStatsdClient{}
+		socks5Address, proxyCleanup := withTestSocks5Proxy(t, nonIntercepting, statsdClient)
+		defer proxyCleanup()
+		client := newSocks5Client(t, "socks5://"+socks5Address)
+
+		resp, _ := makeRequest(t, client, baseURL, "/hijack_me")
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		// the client sees the upstream's own certificate
+		assert.Equal(t, "localhost.local", peerCommonName(resp))
+
+		assert.Equal(t, []string{"/hijack_me"}, upstreamServer.reset())
+		assert.Equal(t, []string{localhostAddr(upstreamPort)}, nonIntercepting.reset())
+		assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(TunneledConnectionCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+
+		t.Run("and keeps tunnels open past the handshake timeout", func(t *testing.T) {
+			socks5Address, proxyCleanup := withTestSocks5Proxy(t, nonIntercepting, &testStatsdClient{}, func(p *MitmProxy) {
+				p.socks5HandshakeTimeout = time.Second
+			})
+			defer proxyCleanup()
+			client := newSocks5Client(t, "socks5://"+socks5Address)
+
+			// takes 3.5 seconds to stream
+			resp, respBody := makeRequest(t, client, baseURL, "/stream")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, 7*len(streamData), len(respBody))
+			assert.Equal(t, []string{localhostAddr(upstreamPort)}, nonIntercepting.reset())
+		})
+
+		t.Run("and lets the client know when it can't reach upstream", func(t *testing.T) {
+			conn := dialSocks5(t, socks5Address)
+			defer conn.Close()
+
+			// CONNECT to a port nobody is listening on
+			port := getAvailablePort(t)
+			writeToConn(t, conn, socks5Version, 1, socks5AuthNone)
+			assert.Equal(t, []byte{socks5Version, socks5AuthNone}, readFromConn(t, conn, 2))
+			writeToConn(t, conn, socks5Version, socks5CommandConnect, 0, socks5AddressIPv4, 127, 0, 0, 1, byte(port>>8), byte(port))
+			assert.Equal(t, []byte{socks5Version, socks5ReplyConnectionRefused}, readFromConn(t, conn, 10)[:2])
+		})
+	})
+
+	t.Run("when given an IP, it decides whether to intercept based on the server name", func(t *testing.T) {
+		namedIntercepting := &namedInterceptingHijacker{
+			nonInterceptingHijacker: &nonInterceptingHijacker{testMitmHijacker: hijacker},
+			name:                    "localhost",
+		}
+		statsdClient := &testStatsdClient{}
+		socks5Address, proxyCleanup := withTestSocks5Proxy(t, namedIntercepting, statsdClient)
+		defer proxyCleanup()
+		ipBaseURL := fmt.Sprintf("https://127.0.0.1:%d", upstreamPort)
+
+		t.Run("it intercepts when the server name matches", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			client := newSocks5Client(t, "socks5://"+socks5Address)
+			client.Transport.(*http.Transport).TLSClientConfig.ServerName = "localhost"
+			resp, respBody := makeRequest(t, client, ipBaseURL, "/hijack_me")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, helloWorld, respBody)
+			assert.Equal(t, "localhost", peerCommonName(resp))
+
+			assert.Equal(t, []string{"/hello_world"}, upstreamServer.reset())
+			assert.Equal(t, []string{localhostAddr(upstreamPort)}, namedIntercepting.reset())
+		})
+
+		t.Run("it tunnels otherwise", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			client := newSocks5Client(t, "socks5://"+socks5Address)
+			client.Transport.(*http.Transport).TLSClientConfig.ServerName = "localhost.local"
+			resp, _ := makeRequest(t, client, ipBaseURL, "/hijack_me")
+
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			assert.Equal(t, "localhost.local", peerCommonName(resp))
+
+			assert.Equal(t, []string{"/hijack_me"}, upstreamServer.reset())
+			assert.Equal(t, []string{net.JoinHostPort("localhost.local", strconv.Itoa(upstreamPort))}, namedIntercepting.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(TunneledConnectionCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+	})
+
+	t.Run("it requires clients to authenticate when there's a users file", func(t *testing.T) {
+		usersFile, usersCleanup := withUsersFile(t, "alice:secret\n")
+		defer usersCleanup()
+
+		statsdClient := &testStatsdClient{}
+		socks5Address, proxyCleanup := withTestSocks5Proxy(t, hijacker, statsdClient, WithAccessControl(&AccessControlConfig{
+			UsersFile: usersFile,
+		}))
+		defer proxyCleanup()
+
+		t.Run("with valid credentials", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			client := newSocks5Client(t, "socks5://alice:secret@"+socks5Address)
+			resp, respBody := makeRequest(t, client, baseURL, "/ok")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, ok, respBody)
+
+			assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+
+		t.Run("with invalid credentials", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			client := newSocks5Client(t, "socks5://alice:wrong@"+socks5Address)
+			_, err := client.Get(baseURL + "/ok")
+			assert.Error(t, err)
+
+			assert.Nil(t, upstreamServer.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(UnauthenticatedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+
+		t.Run("without credentials", func(t *testing.T) {
+			conn := dialSocks5(t, socks5Address)
+			defer conn.Close()
+
+			writeToConn(t, conn, socks5Version, 1, socks5AuthNone)
+			assert.Equal(t, []byte{socks5Version, socks5AuthNoAcceptable}, readFromConn(t, conn, 2))
+		})
+	})
+
+	t.Run("it only supports CONNECT commands", func(t *testing.T) {
+		socks5Address, proxyCleanup := withTestSocks5Proxy(t, hijacker, &testStatsdClient{})
+		defer proxyCleanup()
+
+		conn := dialSocks5(t, socks5Address)
+		defer conn.Close()
+
+		writeToConn(t, conn, socks5Version, 2, socks5AuthUserPass, socks5AuthNone)
+		assert.Equal(t, []byte{socks5Version, socks5AuthNone}, readFromConn(t, conn, 2))
+		// BIND request
+		writeToConn(t, conn, socks5Version, 0x02, 0, socks5AddressDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80)
+		assert.Equal(t, []byte{socks5Version, socks5ReplyCommandNotSupported}, readFromConn(t, conn, 10)[:2])
+	})
+}
+
+/*** Helpers below ***/
+
+// a namedInterceptingHijacker only intercepts connections to hosts with the given name.
+type namedInterceptingHijacker struct {
+	*nonInterceptingHijacker
+	name string
+}
+
+func (h *namedInterceptingHijacker) ShouldIntercept(address string) bool {
+	h.nonInterceptingHijacker.ShouldIntercept(address)
+	return dnsName(address) == h.name
+}
+
+// starts a test MitmProxy with a SOCKS5 listener, and returns the latter's address.
+func withTestSocks5Proxy(t *testing.T, hijacker MitmHijacker, statsdClient *testStatsdClient, opts ...MitmProxyOption) (string, func()) {
+	socks5Address := localhostAddr(getAvailablePort(t))
+	opts = append(opts, WithSocks5Listener(&Socks5ProxyConfig{
+		ListenAddress: socks5Address,
+	}))
+	_, cleanup := withTestProxy(t, hijacker, statsdClient, opts...)
+	return socks5Address, cleanup
+}
+
+func newSocks5Client(t *testing.T, proxyURL string) *http.Client {
+	parsedURL, err := url.Parse(proxyURL)
+	require.NoError(t, err)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsClientConfig(t),
+			Proxy:           http.ProxyURL(parsedURL),
+		},
+	}
+}
+
+func dialSocks5(t *testing.T, address string) net.Conn {
+	conn, err := net.DialTimeout("tcp", address, genericTestTimeout)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(genericTestTimeout)))
+	return conn
+}
+
+func writeToConn(t *testing.T, conn net.Conn, data ...byte) {
+	_, err := conn.Write(data)
+	require.NoError(t, err)
+}
+
+func readFromConn(t *testing.T, conn net.Conn, n int) []byte {
+	buffer := make([]byte, n)
+	_, err := io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	return buffer
+}
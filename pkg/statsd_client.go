@@ -1,6 +1,10 @@
 package pkg
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cactus/go-statsd-client/statsd"
@@ -11,6 +15,20 @@ const (
 	defaultFlushBytes    = 512
 )
 
+// MetricTags are the DogStatsD tags to attach to a statsd metric point.
+type MetricTags map[string]string
+
+// a TaggedStatSender is a statsd.StatSender that can also attach DogStatsD tags to metric points;
+// when a MitmProxy's statsd client is one, it uses the hijacker's TaggedMetricName instead of its
+// TransformMetricName.
+type TaggedStatSender interface {
+	statsd.StatSender
+
+	IncWithTags(stat string, value int64, rate float32, tags MetricTags) error
+	TimingDurationWithTags(stat string, delta time.Duration, rate float32, tags MetricTags) error
+}
+
+// NewStatsdClient returns a TaggedStatSender if the config enables DogStatsD tags.
 func NewStatsdClient(config *Config) (statsd.StatSender, error) {
 	if config == nil || config.Statsd == nil || config.Statsd.Address == "" {
 		return nil, nil
@@ -25,5 +43,59 @@ func NewStatsdClient(config *Config) (statsd.StatSender, error) {
 		flushBytes = defaultFlushBytes
 	}
 
-	return statsd.NewBufferedClient(config.Statsd.Address, config.Statsd.Prefix, flushInterval, flushBytes)
+	client, err := statsd.NewBufferedClient(config.Statsd.Address, config.Statsd.Prefix, flushInterval, flushBytes)
+	if err != nil || !config.Statsd.DogStatsD {
+		return client, err
+	}
+	return &dogStatsdClient{Statter: client}, nil
+}
+
+// dogStatsdClient sends tags the DogStatsD way, appended to the metric points: "name:1|c|#tag1:value1,tag2:value2".
+type dogStatsdClient struct {
+	statsd.Statter
+}
+
+var _ TaggedStatSender = &dogStatsdClient{}
+
+func (c *dogStatsdClient) IncWithTags(stat string, value int64, rate float32, tags MetricTags) error {
+	return c.rawWithTags(stat, fmt.Sprintf("%d|c", value), rate, tags)
+}
+
+func (c *dogStatsdClient) TimingDurationWithTags(stat string, delta time.Duration, rate float32, tags MetricTags) error {
+	ms := float64(delta) / float64(time.Millisecond)
+	return c.rawWithTags(stat, fmt.Sprintf("%s|ms", formatFloat(ms)), rate, tags)
+}
+
+// the sample rate goes before the tags, so it can't be left to Raw to add it.
+func (c *dogStatsdClient) rawWithTags(stat, value string, rate float32, tags MetricTags) error {
+	if rate < 1 {
+		if !statsd.DefaultSampler(rate) {
+			return nil
+		}
+		value += "|@" + formatFloat(float64(rate))
+	}
+	return c.Raw(stat, value+formatTags(tags), 1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// formatTags sorts tags by name, so that the same tags always yield the same suffix.
+func formatTags(tags MetricTags) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, 0, len(tags))
+	for _, name := range names {
+		formatted = append(formatted, name+":"+tags[name])
+	}
+	return "|#" + strings.Join(formatted, ",")
 }
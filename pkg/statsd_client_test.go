@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatsdClient(t *testing.T) {
+	t.Run("it returns nil when statsd is not configured", func(t *testing.T) {
+		client, err := NewStatsdClient(&Config{})
+		assert.NoError(t, err)
+		assert.Nil(t, client)
+	})
+
+	t.Run("it only returns a TaggedStatSender if DogStatsD is enabled", func(t *testing.T) {
+		client, err := NewStatsdClient(&Config{Statsd: &StatsdConfig{Address: "127.0.0.1:8125"}})
+		require.NoError(t, err)
+		defer client.(interface{ Close() error }).Close()
+
+		_, tagged := client.(TaggedStatSender)
+		assert.False(t, tagged)
+	})
+
+	t.Run("with DogStatsD, it sends tags", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		client, err := NewStatsdClient(&Config{Statsd: &StatsdConfig{
+			Address:   conn.LocalAddr().String(),
+			Prefix:    "kraken-proxy",
+			DogStatsD: true,
+		}})
+		require.NoError(t, err)
+		taggedClient, ok := client.(TaggedStatSender)
+		require.True(t, ok)
+		defer taggedClient.(interface{ Close() error }).Close()
+
+		require.NoError(t, taggedClient.IncWithTags(string(HijackedRequestCounter), 2, 1,
+			MetricTags{"registry": "index.docker.io", "outcome": "redirected"}))
+		require.NoError(t, taggedClient.TimingDurationWithTags(string(RedirectTimeToFirstByte), 1500*time.Microsecond, 1, nil))
+		require.NoError(t, taggedClient.Inc(string(ProxiedRequestCounter), 1, 1))
+
+		assert.Equal(t, []string{
+			"kraken-proxy.mitm.hijacked:2|c|#outcome:redirected,registry:index.docker.io",
+			"kraken-proxy.registry.redirect.ttfb:1.5|ms",
+			"kraken-proxy.mitm.proxied:1|c",
+		}, readStatsdLines(t, conn, 3))
+	})
+}
+
+/*** Helpers below ***/
+
+func readStatsdLines(t *testing.T, conn net.PacketConn, expectedLines int) []string {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(genericTestTimeout)))
+
+	var lines []string
+	buffer := make([]byte, 1500)
+	for len(lines) < expectedLines {
+		n, _, err := conn.ReadFrom(buffer)
+		require.NoError(t, err)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(buffer[:n])), "\n")...)
+	}
+	return lines
+}
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"sync"
 	"time"
 
 	"github.com/cactus/go-statsd-client/statsd"
@@ -9,6 +10,7 @@ import (
 // testStatsdClient is a simple in-memory statsd.StatSender implementation, for test purposes.
 type testStatsdClient struct {
 	calls []statsdCall
+	mutex sync.Mutex
 }
 
 type statsdCall struct {
@@ -20,101 +22,133 @@ type statsdCall struct {
 	valueStr string
 
 	rate float32
+
+	// only for the calls to a testTaggedStatsdClient's *WithTags methods.
+	tags MetricTags
 }
 
 var _ statsd.StatSender = &testStatsdClient{}
 
 func (c *testStatsdClient) Inc(stat string, value int64, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "Inc",
 		stat:       stat,
 		valueInt:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) Dec(stat string, value int64, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "Dec",
 		stat:       stat,
 		valueInt:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) Gauge(stat string, value int64, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "Gauge",
 		stat:       stat,
 		valueInt:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) GaugeDelta(stat string, value int64, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "GaugeDelta",
 		stat:       stat,
 		valueInt:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) Timing(stat string, value int64, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "Timing",
 		stat:       stat,
 		valueInt:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) TimingDuration(stat string, duration time.Duration, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "TimingDuration",
 		stat:       stat,
 		valueInt:   int64(duration),
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) Set(stat string, value string, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "Set",
 		stat:       stat,
 		valueStr:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) SetInt(stat string, value int64, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "SetInt",
 		stat:       stat,
 		valueInt:   value,
 		rate:       rate,
 	})
-	return nil
 }
 
 func (c *testStatsdClient) Raw(stat string, value string, rate float32) error {
-	c.calls = append(c.calls, statsdCall{
+	return c.record(statsdCall{
 		methodName: "Raw",
 		stat:       stat,
 		valueStr:   value,
 		rate:       rate,
 	})
+}
+
+// testTaggedStatsdClient is the same as testStatsdClient, for DogStatsD clients.
+type testTaggedStatsdClient struct {
+	testStatsdClient
+}
+
+var _ TaggedStatSender = &testTaggedStatsdClient{}
+
+func (c *testTaggedStatsdClient) IncWithTags(stat string, value int64, rate float32, tags MetricTags) error {
+	return c.record(statsdCall{
+		methodName: "IncWithTags",
+		stat:       stat,
+		valueInt:   value,
+		rate:       rate,
+		tags:       tags,
+	})
+}
+
+func (c *testTaggedStatsdClient) TimingDurationWithTags(stat string, duration time.Duration, rate float32, tags MetricTags) error {
+	return c.record(statsdCall{
+		methodName: "TimingDurationWithTags",
+		stat:       stat,
+		valueInt:   int64(duration),
+		rate:       rate,
+		tags:       tags,
+	})
+}
+
+func (c *testStatsdClient) record(call statsdCall) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.calls = append(c.calls, call)
 	return nil
 }
 
 func (c *testStatsdClient) reset() []statsdCall {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	calls := c.calls
 	c.calls = nil
 	return calls
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,16 +15,33 @@ import (
 // only for tests.
 const genericTestTimeout = 5 * time.Second
 
+var (
+	// the ports getAvailablePort has already returned
+	usedPorts      = make(map[int]bool)
+	usedPortsMutex sync.Mutex
+)
+
 // getAvailablePort asks the kernel for an available port, that is ready to use - only for tests.
+// It never returns the same port twice, so that tests can get several ports before listening on any of them.
 func getAvailablePort(t *testing.T) int {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	require.Nil(t, err)
+	usedPortsMutex.Lock()
+	defer usedPortsMutex.Unlock()
+
+	for {
+		addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+		require.Nil(t, err)
 
-	listen, err := net.ListenTCP("tcp", addr)
-	require.Nil(t, err)
+		listen, err := net.ListenTCP("tcp", addr)
+		require.Nil(t, err)
 
-	defer listen.Close()
-	return listen.Addr().(*net.TCPAddr).Port
+		port := listen.Addr().(*net.TCPAddr).Port
+		require.NoError(t, listen.Close())
+
+		if !usedPorts[port] {
+			usedPorts[port] = true
+			return port
+		}
+	}
 }
 
 func localhostAddr(port int) string {
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/wk8/kraken-proxy"
+
+	defaultTracingServiceName = "kraken-proxy"
+)
+
+// the span attributes specific to kraken-proxy; the others come from OpenTelemetry's semantic conventions.
+const (
+	hijackedAttribute   = attribute.Key("kraken_proxy.hijacked")
+	registryAttribute   = attribute.Key("kraken_proxy.registry")
+	repositoryAttribute = attribute.Key("kraken_proxy.repository")
+	referenceAttribute  = attribute.Key("kraken_proxy.reference")
+	queryTypeAttribute  = attribute.Key("kraken_proxy.query_type")
+)
+
+// we propagate W3C trace-context, both from clients and to redirect registries.
+var traceContextPropagator = propagation.TraceContext{}
+
+// Tracing exports OpenTelemetry traces with a span per request handled by a MitmProxy; hijackers can
+// create child spans with startSpan.
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// NewTracing returns nil if tracing is not configured.
+func NewTracing(config *Config) (*Tracing, error) {
+	if config == nil || config.Tracing == nil {
+		return nil, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(config.Tracing.Endpoint),
+	}
+	if config.Tracing.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(config.Tracing.URLPath))
+	}
+	if config.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(config.Tracing.Headers) != 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(config.Tracing.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create OTLP exporter")
+	}
+
+	serviceName := config.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	sampleRatio := 1.0
+	if config.Tracing.SampleRatio != nil {
+		sampleRatio = *config.Tracing.SampleRatio
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+
+	return newTracing(provider), nil
+}
+
+func newTracing(provider *sdktrace.TracerProvider) *Tracing {
+	return &Tracing{
+		provider: provider,
+		tracer:   provider.Tracer(tracerName),
+	}
+}
+
+// Shutdown flushes the spans that haven't been exported yet.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+// startRequestSpan starts the span for an incoming request, as a child of the client's span if the
+// request carries a trace-context, and returns a copy of the request carrying the new span.
+func (t *Tracing) startRequestSpan(request *http.Request) (*http.Request, trace.Span) {
+	ctx := traceContextPropagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := t.tracer.Start(ctx, "kraken-proxy.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(request.Method),
+			semconv.HTTPHostKey.String(request.Host),
+			semconv.HTTPTargetKey.String(request.URL.RequestURI()),
+			semconv.HTTPClientIPKey.String(clientIP(request)),
+		))
+	return request.WithContext(ctx), span
+}
+
+func clientIP(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+// startSpan starts a child span of the one in ctx; it's a no-op if there's no span in ctx, in
+// particular when tracing is not enabled.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan records err on span, if any, and then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext adds the W3C trace-context headers for the span in ctx to headers.
+func injectTraceContext(ctx context.Context, headers map[string]string) {
+	traceContextPropagator.Inject(ctx, mapCarrier(headers))
+}
+
+// mapCarrier allows propagating trace-context through the maps of headers that Kraken's httputil uses;
+// keys are canonicalized so that we override any trace-context headers copied from the client's request.
+type mapCarrier map[string]string
+
+var _ propagation.TextMapCarrier = mapCarrier{}
+
+func (c mapCarrier) Get(key string) string {
+	return c[http.CanonicalHeaderKey(key)]
+}
+
+func (c mapCarrier) Set(key, value string) {
+	c[http.CanonicalHeaderKey(key)] = value
+}
+
+func (c mapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	registryAddress, registryCleanup := withDummyRegistry(t, 1)
+	defer registryCleanup()
+	redirect1Address, redirect1Cleanup := withDummyRegistry(t, 2)
+	defer redirect1Cleanup()
+	redirect2Address, redirect2Cleanup := withDummyRegistry(t, 3, "ubuntu:18")
+	defer redirect2Cleanup()
+
+	_, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	hijacker, err := NewDockerRegistryHijacker(&Config{
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: registryAddress,
+				},
+				Redirects: redirects(redirect1Address, redirect2Address),
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer hijacker.closeIdleConnections()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracing := newTracing(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	proxyPort, proxyCleanup := withTestProxy(t, hijacker, nil, WithTracing(tracing))
+	defer proxyCleanup()
+	proxyClient := newProxyClient(t, "http://"+localhostAddr(proxyPort), nil)
+
+	// the client is itself part of a trace
+	clientTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID := "00f067aa0ba902b7"
+	request, err := http.NewRequest("GET", "http://"+registryAddress+"/v2/ubuntu/manifests/18", nil)
+	require.NoError(t, err)
+	request.Header.Set("traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-01")
+
+	resp, err := proxyClient.Do(request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "from registry 3: manifests for ubuntu:18", string(readResponseBody(t, resp)))
+
+	// the request's span ends after the response has been sent
+	spans := waitForEndedSpans(t, recorder, 5)
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		assert.Equal(t, clientTraceID, span.SpanContext().TraceID().String())
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+
+	// one span for the incoming request, child of the client's
+	require.Equal(t, 1, len(byName["kraken-proxy.request"]))
+	requestSpan := byName["kraken-proxy.request"][0]
+	assert.Equal(t, clientSpanID, requestSpan.Parent().SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, requestSpan.SpanKind())
+	assert.Contains(t, requestSpan.Attributes(), hijackedAttribute.Bool(true))
+
+	// then one per redirect tried, the first one failing
+	tries := byName["kraken-proxy.try_registry"]
+	require.Equal(t, 2, len(tries))
+	if tries[0].StartTime().After(tries[1].StartTime()) {
+		tries[0], tries[1] = tries[1], tries[0]
+	}
+	for i, redirectAddress := range []string{redirect1Address, redirect2Address} {
+		assert.Equal(t, requestSpan.SpanContext().SpanID(), tries[i].Parent().SpanID())
+		assert.Contains(t, tries[i].Attributes(), registryAttribute.String(redirectAddress))
+	}
+	assert.Equal(t, codes.Error, tries[0].Status().Code)
+	assert.Equal(t, codes.Unset, tries[1].Status().Code)
+
+	// each with its own authentication span
+	authentications := byName["kraken-proxy.authenticate"]
+	require.Equal(t, 2, len(authentications))
+	for _, authentication := range authentications {
+		parentID := authentication.Parent().SpanID()
+		assert.True(t, parentID == tries[0].SpanContext().SpanID() || parentID == tries[1].SpanContext().SpanID())
+	}
+
+	// and the trace-context got propagated to the redirect that served the request
+	assert.Equal(t, "00-"+clientTraceID+"-"+tries[1].SpanContext().SpanID().String()+"-01", resp.Header.Get("echoed-traceparent"))
+}
+
+func TestStartSpanWithoutTracing(t *testing.T) {
+	ctx, span := startSpan(context.Background(), "test")
+	defer span.End()
+
+	assert.False(t, span.SpanContext().IsValid())
+	assert.False(t, span.IsRecording())
+	assert.False(t, trace.SpanFromContext(ctx).IsRecording())
+}
+
+/*** Helpers below ***/
+
+func waitForEndedSpans(t *testing.T, recorder *tracetest.SpanRecorder, expected int) []sdktrace.ReadOnlySpan {
+	deadline := time.Now().Add(genericTestTimeout)
+	for {
+		spans := recorder.Ended()
+		if len(spans) >= expected || time.Now().After(deadline) {
+			require.Equal(t, expected, len(spans))
+			return spans
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
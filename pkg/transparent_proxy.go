@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTransparentUpstreamPort = 443
+
+	// how long we wait for clients to send their TLS ClientHello
+	clientHelloTimeout = 10 * time.Second
+)
+
+var (
+	errNoOriginalDestination = errors.New("unable to determine the original destination")
+
+	// returned by the tls.Config used to peek at ClientHellos, to abort the handshake.
+	errClientHelloPeeked = errors.New("peeked at ClientHello")
+)
+
+// serveTransparent accepts TLS connections redirected to the proxy, typically by an iptables REDIRECT rule,
+// until the listener gets closed.
+func (h *mitmHandler) serveTransparent(listener net.Listener, config *TransparentProxyConfig) error {
+	defaultUpstreamPort := config.DefaultUpstreamPort
+	if defaultUpstreamPort == 0 {
+		defaultUpstreamPort = defaultTransparentUpstreamPort
+	}
+
+	return serveConns(listener, func(conn net.Conn) {
+		h.serveTransparentConn(conn, strconv.Itoa(defaultUpstreamPort))
+	})
+}
+
+// serveTransparentConn determines where the client was trying to connect to, from either the socket's
+// original destination or the SNI from its ClientHello, and then either intercepts or tunnels the connection.
+func (h *mitmHandler) serveTransparentConn(conn net.Conn, defaultUpstreamPort string) {
+	upstreamAddress, err := originalDestination(conn)
+	if err != nil {
+		log.Debugf("No original destination for transparent connection from %s: %v", conn.RemoteAddr(), err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		log.Warnf("Unable to set read deadline on transparent connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	hello, conn, err := peekClientHello(conn)
+	if err == nil {
+		err = conn.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Warnf("Unable to read TLS ClientHello from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	serverName := hello.ServerName
+	switch {
+	case upstreamAddress == "" && serverName == "":
+		log.Warnf("Unable to determine where transparent connection from %s is going to", conn.RemoteAddr())
+		conn.Close()
+		return
+	case upstreamAddress == "":
+		upstreamAddress = net.JoinHostPort(serverName, defaultUpstreamPort)
+	case serverName == "":
+		serverName = dnsName(upstreamAddress)
+	}
+
+	// the address as the client sees it
+	_, port, _ := net.SplitHostPort(upstreamAddress)
+	address := net.JoinHostPort(serverName, port)
+
+	if h.intercept(address) {
+		h.interceptTLS(conn, upstreamAddress, serverName)
+		return
+	}
+
+	upstreamConn, err := h.dialer.DialContext(context.Background(), "tcp", upstreamAddress)
+	if err != nil {
+		log.Warnf("Unable to dial %s: %v", upstreamAddress, err)
+		conn.Close()
+		return
+	}
+	h.tunnel(connectRequest(address), conn, upstreamConn)
+}
+
+// peekClientHello reads the TLS ClientHello sent by the client, and returns it along with a net.Conn that
+// replays what has been read so far.
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	buffer := &bytes.Buffer{}
+	var hello *tls.ClientHelloInfo
+
+	err := tls.Server(&readOnlyConn{Conn: conn, reader: io.TeeReader(conn, buffer)}, &tls.Config{
+		GetConfigForClient: func(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{
+				ServerName:      clientHello.ServerName,
+				SupportedProtos: clientHello.SupportedProtos,
+			}
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	replayConn := &bufferedConn{Conn: conn, reader: io.MultiReader(buffer, conn)}
+	if hello == nil {
+		return nil, replayConn, errors.Wrap(err, "no ClientHello")
+	}
+	return hello, replayConn, nil
+}
+
+// a readOnlyConn is a net.Conn that can only be read from, only used to peek at ClientHellos.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c *readOnlyConn) Write([]byte) (int, error)   { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                { return nil }
+func (c *readOnlyConn) SetDeadline(time.Time) error { return nil }
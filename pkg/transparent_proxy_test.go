@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransparentProxy(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	baseURL := "https://" + localhostAddr(upstreamPort)
+
+	hijacker := &testMitmHijacker{
+		DefaultMitmHijacker: &DefaultMitmHijacker{},
+		t:                   t,
+		upstreamClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsClientConfig(t),
+			},
+		},
+		baseURL: baseURL,
+	}
+
+	// simulates what an iptables REDIRECT rule would do, by sending all connections to the transparent listener;
+	// since there's no original destination for these connections, the proxy routes them based on SNI.
+	withTransparentClient := func(t *testing.T, hijacker MitmHijacker, statsdClient *testStatsdClient) (*http.Client, func()) {
+		transparentAddress := localhostAddr(getAvailablePort(t))
+		_, proxyCleanup := withTestProxy(t, hijacker, statsdClient, WithTransparentListener(&TransparentProxyConfig{
+			ListenAddress:       transparentAddress,
+			DefaultUpstreamPort: upstreamPort,
+		}))
+
+		dialer := &net.Dialer{}
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsClientConfig(t),
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, transparentAddress)
+				},
+			},
+		}, proxyCleanup
+	}
+
+	t.Run("it intercepts connections the hijacker is interested in", func(t *testing.T) {
+		statsdClient := &testStatsdClient{}
+		client, cleanup := withTransparentClient(t, hijacker, statsdClient)
+		defer cleanup()
+
+		t.Run("with a hijacked request", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			resp, respBody := makeRequest(t, client, baseURL, "/hijack_me")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, helloWorld, respBody)
+			assert.Equal(t, "new_world", resp.Header.Get("Brave"))
+			// the client sees a certificate forged by the proxy
+			assert.Equal(t, "localhost", peerCommonName(resp))
+
+			assert.Equal(t, []string{"/hello_world"}, upstreamServer.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(HijackedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+
+		t.Run("with a proxied request", func(t *testing.T) {
+			upstreamServer.reset()
+			statsdClient.reset()
+
+			resp, respBody := makeRequest(t, client, baseURL, "/ok")
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, ok, respBody)
+			assert.Equal(t, "localhost", peerCommonName(resp))
+
+			assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+			assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(ProxiedRequestCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+		})
+	})
+
+	t.Run("it splices other connections to their destination", func(t *testing.T) {
+		upstreamServer.reset()
+
+		nonIntercepting := &nonInterceptingHijacker{testMitmHijacker: hijacker}
+		statsdClient := &testStatsdClient{}
+		client, cleanup := withTransparentClient(t, nonIntercepting, statsdClient)
+		defer cleanup()
+
+		resp, _ := makeRequest(t, client, baseURL, "/hijack_me")
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		// the client sees the upstream's own certificate
+		assert.Equal(t, "localhost.local", peerCommonName(resp))
+
+		assert.Equal(t, []string{"/hijack_me"}, upstreamServer.reset())
+		assert.Equal(t, []string{localhostAddr(upstreamPort)}, nonIntercepting.reset())
+		assert.Equal(t, []statsdCall{{methodName: "Inc", stat: string(TunneledConnectionCounter), valueInt: 1, valueStr: "", rate: 1}}, statsdClient.reset())
+	})
+}
+
+func TestPeekClientHello(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	clientConfig := tlsClientConfig(t)
+	clientConfig.ServerName = "localhost"
+	clientConfig.NextProtos = []string{"h2", "http/1.1"}
+	client := tls.Client(clientConn, clientConfig)
+
+	handshakeErr := make(chan error, 1)
+	go func() {
+		handshakeErr <- client.Handshake()
+	}()
+
+	hello, replayConn, err := peekClientHello(serverConn)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", hello.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, hello.SupportedProtos)
+
+	// the TLS handshake can then proceed normally
+	tlsInfo, cleanup := withTestServerTLSFiles(t)
+	defer cleanup()
+	cert, err := tls.LoadX509KeyPair(tlsInfo.CertPath, tlsInfo.KeyPath)
+	require.NoError(t, err)
+
+	server := tls.Server(replayConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, server.Handshake())
+	require.NoError(t, <-handshakeErr)
+	assert.Equal(t, "localhost.local", client.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
@@ -0,0 +1,312 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUpstreamDialTimeout = 30 * time.Second
+	defaultUpstreamKeepAlive   = 30 * time.Second
+)
+
+// upstreamDialer dials upstream servers, either directly or by chaining to an upstream HTTP(S) proxy.
+type upstreamDialer struct {
+	// nil if no upstream proxy is configured
+	proxyURL *url.URL
+	// the value of the Proxy-Authorization header to send to the proxy, if any
+	proxyAuthorization string
+	noProxy            []*noProxyRule
+
+	dialer *net.Dialer
+
+	// applied to the transports returned by newTransport; can be nil
+	connections *UpstreamConnectionsConfig
+}
+
+// a noProxyRule is one entry from the no_proxy list.
+type noProxyRule struct {
+	// "*" matches everything
+	matchAll bool
+	// set for IPs and CIDRs
+	ipNet *net.IPNet
+	// set for domain names; matches the domain itself and all its sub-domains
+	domain string
+	// if not empty, the rule only applies to that port
+	port string
+}
+
+func newUpstreamDialer(config *UpstreamProxyConfig, connections *UpstreamConnectionsConfig) (*upstreamDialer, error) {
+	dialer := &upstreamDialer{
+		dialer: &net.Dialer{
+			Timeout:   defaultUpstreamDialTimeout,
+			KeepAlive: defaultUpstreamKeepAlive,
+		},
+		connections: connections,
+	}
+
+	if config == nil || config.URL == "" {
+		return dialer, nil
+	}
+
+	rawURL := config.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid upstream proxy URL %q", config.URL)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, errors.Errorf("unsupported upstream proxy scheme %q, only http and https are supported", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, errors.Errorf("no host in upstream proxy URL %q", config.URL)
+	}
+	if proxyURL.Port() == "" {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), defaultPort(proxyURL.Scheme))
+	}
+
+	if config.BasicAuth != nil {
+		proxyURL.User = url.UserPassword(config.BasicAuth.Username, config.BasicAuth.Password)
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		dialer.proxyAuthorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	dialer.proxyURL = proxyURL
+
+	for _, entry := range config.NoProxy {
+		rule, err := parseNoProxyRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			dialer.noProxy = append(dialer.noProxy, rule)
+		}
+	}
+
+	return dialer, nil
+}
+
+// DialContext dials the given address, through the upstream proxy if there is one and the address
+// is not excluded by no_proxy rules.
+func (d *upstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !d.shouldProxy(address) {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to dial upstream proxy %s", d.proxyURL.Host)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(d.dialer.Timeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tunnel, err := d.connect(conn, address)
+	if err == nil {
+		err = tunnel.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connect asks the upstream proxy to open a tunnel to address over conn.
+func (d *upstreamDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: d.proxyURL.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, errors.Wrapf(err, "TLS handshake with upstream proxy %s failed", d.proxyURL.Host)
+		}
+		conn = tlsConn
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.proxyAuthorization != "" {
+		request.Header.Set("Proxy-Authorization", d.proxyAuthorization)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, errors.Wrapf(err, "unable to send CONNECT request to upstream proxy %s", d.proxyURL.Host)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read CONNECT response from upstream proxy %s", d.proxyURL.Host)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("upstream proxy %s refused to CONNECT to %s: %s", d.proxyURL.Host, address, response.Status)
+	}
+
+	if reader.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// transportProxy is meant to be used as a http.Transport's Proxy function.
+func (d *upstreamDialer) transportProxy(request *http.Request) (*url.URL, error) {
+	if d.proxyURL == nil {
+		return http.ProxyFromEnvironment(request)
+	}
+	if !d.shouldProxy(canonicalAddr(request.URL)) {
+		return nil, nil
+	}
+	return d.proxyURL, nil
+}
+
+// newTransport returns a new http.Transport, with the same defaults as http.DefaultTransport, that
+// goes through the upstream proxy when relevant, and pools connections as configured.
+func (d *upstreamDialer) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = d.transportProxy
+
+	if d.connections != nil {
+		transport.MaxConnsPerHost = d.connections.MaxConnsPerHost
+		if d.connections.MaxIdleConnsPerHost != 0 {
+			transport.MaxIdleConnsPerHost = d.connections.MaxIdleConnsPerHost
+		}
+		if d.connections.IdleConnTimeout != 0 {
+			transport.IdleConnTimeout = d.connections.IdleConnTimeout
+		}
+		if d.connections.DisableHTTP2 {
+			transport.ForceAttemptHTTP2 = false
+			transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+	}
+
+	return transport
+}
+
+func (d *upstreamDialer) http2Disabled() bool {
+	return d.connections != nil && d.connections.DisableHTTP2
+}
+
+func (d *upstreamDialer) shouldProxy(address string) bool {
+	if d.proxyURL == nil {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, rule := range d.noProxy {
+		if rule.matches(host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNoProxyRule parses entries à la NO_PROXY env variable: "*", IPs, CIDRs, or domain
+// names, optionally followed by a port.
+func parseNoProxyRule(entry string) (*noProxyRule, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return nil, nil
+	}
+	if entry == "*" {
+		return &noProxyRule{matchAll: true}, nil
+	}
+
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return &noProxyRule{ipNet: ipNet}, nil
+	}
+
+	rule := &noProxyRule{}
+	host := entry
+	if h, port, err := net.SplitHostPort(entry); err == nil {
+		host = h
+		rule.port = port
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return rule, nil
+	}
+
+	rule.domain = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "*"), "."), ".")
+	if rule.domain == "" {
+		return nil, errors.Errorf("invalid no_proxy entry %q", entry)
+	}
+	return rule, nil
+}
+
+func (r *noProxyRule) matches(host, port string) bool {
+	if r.matchAll {
+		return true
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	if r.ipNet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipNet.Contains(ip)
+	}
+	return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+// bufferedConn is a net.Conn that reads from its reader, typically to not lose any bytes that might have
+// been buffered before handing the connection over.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// canonicalAddr returns the URL's host:port, with the port defaulting to the scheme's.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,385 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	krakenconfig "github.com/uber/kraken/lib/backend/registrybackend"
+)
+
+func TestMitmProxyWithUpstreamProxy(t *testing.T) {
+	upstreamServer := &dummyUpstreamServer{
+		t: t,
+	}
+	upstreamPort, upstreamCleanup := withDummyUpstreamServer(t, upstreamServer)
+	defer upstreamCleanup()
+	upstreamAddress := localhostAddr(upstreamPort)
+
+	registryAddress, registryCleanup := withDummyRegistry(t, 1, "ubuntu:18")
+	defer registryCleanup()
+
+	upstreamProxy, upstreamProxyAddress, upstreamProxyCleanup := withRecordingProxy(t, nil)
+	defer upstreamProxyCleanup()
+
+	withProxyClient := func(t *testing.T, config *UpstreamProxyConfig) (*http.Client, func()) {
+		proxyPort, proxyCleanup := withTestProxy(t, &DefaultMitmHijacker{}, nil, WithUpstreamProxy(config))
+
+		proxyURL, err := url.Parse("http://" + localhostAddr(proxyPort))
+		require.NoError(t, err)
+
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsClientConfig(t),
+				Proxy:           http.ProxyURL(proxyURL),
+			},
+		}, proxyCleanup
+	}
+
+	t.Run("CONNECT tunnels go through the upstream proxy", func(t *testing.T) {
+		upstreamServer.reset()
+		upstreamProxy.reset()
+
+		proxyClient, proxyCleanup := withProxyClient(t, &UpstreamProxyConfig{
+			URL: "http://" + upstreamProxyAddress,
+		})
+		defer proxyCleanup()
+
+		resp, respBody := makeRequest(t, proxyClient, "https://"+upstreamAddress, "/ok")
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, ok, respBody)
+
+		assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+		assert.Equal(t, []string{"CONNECT " + upstreamAddress}, upstreamProxy.reset())
+	})
+
+	t.Run("plain HTTP requests go through the upstream proxy", func(t *testing.T) {
+		upstreamProxy.reset()
+
+		proxyClient, proxyCleanup := withProxyClient(t, &UpstreamProxyConfig{
+			URL: upstreamProxyAddress,
+		})
+		defer proxyCleanup()
+
+		resp, respBody := makeRequest(t, proxyClient, "http://"+registryAddress, "/v2/ubuntu/manifests/18")
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "from registry 1: manifests for ubuntu:18", string(respBody))
+
+		assert.Equal(t, []string{"GET http://" + registryAddress + "/v2/ubuntu/manifests/18"}, upstreamProxy.reset())
+	})
+
+	t.Run("hosts excluded by no_proxy rules are dialed directly", func(t *testing.T) {
+		upstreamServer.reset()
+		upstreamProxy.reset()
+
+		proxyClient, proxyCleanup := withProxyClient(t, &UpstreamProxyConfig{
+			URL:     "http://" + upstreamProxyAddress,
+			NoProxy: []string{"example.com", "localhost"},
+		})
+		defer proxyCleanup()
+
+		resp, respBody := makeRequest(t, proxyClient, "https://"+upstreamAddress, "/ok")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, ok, respBody)
+
+		resp, _ = makeRequest(t, proxyClient, "http://"+registryAddress, "/v2/ubuntu/manifests/18")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+		assert.Equal(t, 0, len(upstreamProxy.reset()))
+	})
+
+	t.Run("it authenticates to the upstream proxy when configured to", func(t *testing.T) {
+		credentials := &BasicAuthCredentials{
+			Username: "user",
+			Password: "pwd",
+		}
+		authProxy, authProxyAddress, authProxyCleanup := withRecordingProxy(t, credentials)
+		defer authProxyCleanup()
+
+		t.Run("with the right credentials", func(t *testing.T) {
+			upstreamServer.reset()
+			authProxy.reset()
+
+			proxyClient, proxyCleanup := withProxyClient(t, &UpstreamProxyConfig{
+				URL:       "http://" + authProxyAddress,
+				BasicAuth: credentials,
+			})
+			defer proxyCleanup()
+
+			resp, respBody := makeRequest(t, proxyClient, "https://"+upstreamAddress, "/ok")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, ok, respBody)
+
+			resp, _ = makeRequest(t, proxyClient, "http://"+registryAddress, "/v2/ubuntu/manifests/18")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			assert.Equal(t, []string{"/ok"}, upstreamServer.reset())
+			assert.Equal(t, []string{
+				"CONNECT " + upstreamAddress,
+				"GET http://" + registryAddress + "/v2/ubuntu/manifests/18",
+			}, authProxy.reset())
+		})
+
+		t.Run("with the wrong credentials", func(t *testing.T) {
+			upstreamServer.reset()
+			authProxy.reset()
+
+			proxyClient, proxyCleanup := withProxyClient(t, &UpstreamProxyConfig{
+				URL: "http://" + authProxyAddress,
+				BasicAuth: &BasicAuthCredentials{
+					Username: "user",
+					Password: "wrong",
+				},
+			})
+			defer proxyCleanup()
+
+			// upstream connections are only dialed once the client has sent its request
+			resp, _ := makeRequest(t, proxyClient, "https://"+upstreamAddress, "/ok")
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+			resp, _ = makeRequest(t, proxyClient, "http://"+registryAddress, "/v2/ubuntu/manifests/18")
+			assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+			assert.Equal(t, 0, len(upstreamServer.reset()))
+			assert.Equal(t, 0, len(authProxy.reset()))
+		})
+	})
+}
+
+func TestDockerRegistryHijackerWithUpstreamProxy(t *testing.T) {
+	redirectAddress, redirectCleanup := withDummyRegistry(t, 1, "ubuntu:16")
+	defer redirectCleanup()
+
+	originAddress, originCleanup := withDummyRegistry(t, 2, "ubuntu:18")
+	defer originCleanup()
+
+	upstreamProxy, upstreamProxyAddress, upstreamProxyCleanup := withRecordingProxy(t, nil)
+	defer upstreamProxyCleanup()
+
+	authRequests, authCleanup := withDummyAuthenticators()
+	defer authCleanup()
+
+	config := &Config{
+		UpstreamProxy: &UpstreamProxyConfig{
+			URL: "http://" + upstreamProxyAddress,
+		},
+		Registries: []Registry{
+			{
+				Config: krakenconfig.Config{
+					Address: originAddress,
+				},
+				Redirects: redirects(redirectAddress),
+			},
+		},
+	}
+
+	hijacker, err := NewDockerRegistryHijacker(config)
+	require.NoError(t, err)
+
+	hijacked, response, err := hijacker.RequestHandler(&dummyResponseWriter{}, buildGetRequest(t, "http://"+originAddress+"/v2/ubuntu/blobs/18"))
+
+	assert.True(t, hijacked)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "from registry 2: blobs for ubuntu:18", string(readResponseBody(t, response)))
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(authRequests.requests))
+
+	assert.Equal(t, []string{
+		"GET http://" + redirectAddress + "/v2/ubuntu/blobs/18",
+		"GET http://" + originAddress + "/v2/ubuntu/blobs/18",
+	}, upstreamProxy.reset())
+}
+
+func TestUpstreamDialerShouldProxy(t *testing.T) {
+	dialer, err := newUpstreamDialer(&UpstreamProxyConfig{
+		URL:     "proxy.corp",
+		NoProxy: []string{"example.com", ".internal", "10.0.0.0/8", "192.168.1.1", "kraken:8080", " "},
+	}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "proxy.corp:80", dialer.proxyURL.Host)
+
+	for address, expected := range map[string]bool{
+		"index.docker.io:443":  true,
+		"example.com:443":      false,
+		"EXAMPLE.com:443":      false,
+		"sub.example.com:443":  false,
+		"notexample.com:443":   true,
+		"internal:443":         false,
+		"foo.internal:443":     false,
+		"10.1.2.3:443":         false,
+		"11.1.2.3:443":         true,
+		"192.168.1.1:80":       false,
+		"192.168.1.2:80":       true,
+		"kraken:8080":          false,
+		"kraken:8081":          true,
+		"sub.kraken:8080":      false,
+		"[::1]:443":            true,
+		"example.com.:443":     false,
+		"gcr.io":               true,
+		"quay.io:443":          true,
+		"docker.example.com:1": false,
+	} {
+		assert.Equal(t, expected, dialer.shouldProxy(address), address)
+	}
+
+	t.Run("it never proxies anything if there's no upstream proxy", func(t *testing.T) {
+		dialer, err := newUpstreamDialer(nil, nil)
+		require.NoError(t, err)
+
+		assert.False(t, dialer.shouldProxy("index.docker.io:443"))
+	})
+
+	t.Run("a * no_proxy entry disables proxying altogether", func(t *testing.T) {
+		dialer, err := newUpstreamDialer(&UpstreamProxyConfig{
+			URL:     "https://proxy.corp",
+			NoProxy: []string{"*"},
+		}, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, "proxy.corp:443", dialer.proxyURL.Host)
+		assert.False(t, dialer.shouldProxy("index.docker.io:443"))
+	})
+
+	t.Run("it rejects unsupported schemes", func(t *testing.T) {
+		_, err := newUpstreamDialer(&UpstreamProxyConfig{
+			URL: "socks5://proxy.corp:1080",
+		}, nil)
+		assert.Error(t, err)
+	})
+}
+
+/*** Helpers below ***/
+
+// a recordingProxy is a minimal HTTP forward proxy, that records the requests that go through it.
+type recordingProxy struct {
+	t *testing.T
+	// if not nil, clients have to authenticate with these credentials
+	credentials *BasicAuthCredentials
+
+	requests []string
+	mutex    sync.Mutex
+}
+
+func (p *recordingProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if p.credentials != nil {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.credentials.Username+":"+p.credentials.Password))
+		if request.Header.Get("Proxy-Authorization") != expected {
+			writer.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+
+	if request.Method == http.MethodConnect {
+		p.record(request.Method + " " + request.Host)
+		p.tunnel(writer, request)
+		return
+	}
+
+	p.record(request.Method + " " + request.URL.String())
+
+	request.RequestURI = ""
+	request.Header.Del("Proxy-Authorization")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	for key, values := range response.Header {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(response.StatusCode)
+	_, err = io.Copy(writer, response.Body)
+	require.NoError(p.t, err)
+}
+
+func (p *recordingProxy) tunnel(writer http.ResponseWriter, request *http.Request) {
+	upstreamConn, err := net.DialTimeout("tcp", request.Host, genericTestTimeout)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	clientConn, _, err := writer.(http.Hijacker).Hijack()
+	require.NoError(p.t, err)
+	defer clientConn.Close()
+
+	_, err = clientConn.Write(okHeader)
+	require.NoError(p.t, err)
+
+	done := make(chan interface{}, 2)
+	go func() {
+		_, _ = io.Copy(upstreamConn, clientConn)
+		done <- nil
+	}()
+	go func() {
+		_, _ = io.Copy(clientConn, upstreamConn)
+		done <- nil
+	}()
+	<-done
+}
+
+func (p *recordingProxy) record(request string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.requests = append(p.requests, request)
+}
+
+func (p *recordingProxy) reset() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	requests := p.requests
+	p.requests = nil
+	return requests
+}
+
+// starts a recordingProxy, and returns it, its address, and a function to tear it down when done testing.
+func withRecordingProxy(t *testing.T, credentials *BasicAuthCredentials) (*recordingProxy, string, func()) {
+	proxy := &recordingProxy{
+		t:           t,
+		credentials: credentials,
+	}
+
+	address := localhostAddr(getAvailablePort(t))
+	server := &http.Server{
+		Addr:    address,
+		Handler: proxy,
+	}
+
+	listeningChan := make(chan interface{})
+
+	go func() {
+		require.NoError(t, startHTTPServer(server, listeningChan, nil, ""))
+	}()
+
+	select {
+	case <-listeningChan:
+	case <-time.After(genericTestTimeout):
+		t.Fatalf("Timed out waiting for recording proxy to start listening")
+	}
+
+	return proxy, address, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), genericTestTimeout)
+		defer cancel()
+		require.NoError(t, server.Shutdown(ctx))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	goerrors "errors"
 	"net"
 	"net/http"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -33,3 +34,25 @@ func startHTTPServer(server *http.Server, listeningChan chan interface{}, tlsInf
 	}
 	return err
 }
+
+// how long to wait before accepting connections again after a temporary error
+const acceptRetryDelay = 10 * time.Millisecond
+
+// serveConns accepts connections from listener, and handles each of them in its own goroutine,
+// until the listener gets closed.
+func serveConns(listener net.Listener, handle func(conn net.Conn)) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// same as what http.Server does
+			if temporaryErr, ok := err.(interface{ Temporary() bool }); ok && temporaryErr.Temporary() {
+				log.Warnf("Temporary error when accepting connection on %s: %v", listener.Addr(), err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			return err
+		}
+
+		go handle(conn)
+	}
+}